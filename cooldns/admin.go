@@ -0,0 +1,75 @@
+// The CoolDNS Project. The simple dynamic dns server and update service.
+// Copyright (C) 2014 The CoolDNS Authors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.package main
+
+package cooldns
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// Name of the administrator in the basic authorization of /admin
+const adminUser = "admin"
+
+// Largest master file accepted by /admin/zone
+const adminMaxZoneSize = 32 << 20
+
+// Requests to /admin need basic authorization as adminUser with the admin
+// secret. Without a secret there is no admin access at all.
+func adminAuth(secret string) func(http.ResponseWriter, *http.Request) {
+	return func(res http.ResponseWriter, req *http.Request) {
+		rAuth, err := base64.StdEncoding.DecodeString(
+			strings.TrimPrefix(req.Header.Get("Authorization"), "Basic "))
+		if err != nil || secret == "" {
+			returnAuthErr(res, "Authorization Required")
+			return
+		}
+		expected := adminUser + ":" + secret
+		if subtle.ConstantTimeCompare(rAuth, []byte(expected)) != 1 {
+			log.Println("Admin: Wrong credentials from", req.RemoteAddr)
+			returnAuthErr(res, "Authorization Required")
+		}
+	}
+}
+
+// GET /admin/zone?zone=<zone> exports the zone as master file
+func adminExport(files ZoneFiles) func(http.ResponseWriter, *http.Request) {
+	return func(res http.ResponseWriter, req *http.Request) {
+		res.Header().Set("Content-Type", "text/dns")
+		if err := files.Export(res, req.URL.Query().Get("zone")); err != nil {
+			http.Error(res, err.Error(), http.StatusBadRequest)
+		}
+	}
+}
+
+// POST /admin/zone?zone=<zone> imports the master file in the body. With
+// dryrun=yes only the changes are reported.
+func adminImport(files ZoneFiles) func(http.ResponseWriter, *http.Request) {
+	return func(res http.ResponseWriter, req *http.Request) {
+		dryRun := strings.ToLower(req.URL.Query().Get("dryrun")) == "yes"
+		body := http.MaxBytesReader(res, req.Body, adminMaxZoneSize)
+		result, err := files.Import(body, req.URL.Query().Get("zone"), dryRun)
+		if err != nil {
+			http.Error(res, err.Error(), http.StatusBadRequest)
+			return
+		}
+		res.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		res.Write([]byte(result.String()))
+	}
+}
@@ -19,7 +19,10 @@ package cooldns
 import (
 	"code.google.com/p/go.crypto/scrypt"
 	"crypto/subtle"
+	"encoding/base64"
 	"errors"
+	"fmt"
+	"io"
 	"os"
 	"unicode/utf8"
 )
@@ -29,6 +32,8 @@ const (
 	Scryptr      int = 8
 	Scryptp      int = 1
 	ScryptKeyLen int = 32
+	// Length of the generated TSIG secrets in bytes (hmac-sha256 block size)
+	TsigKeyLen int = 32
 )
 
 var (
@@ -39,6 +44,9 @@ type Auth struct {
 	Name string
 	Salt []byte
 	Key  []byte
+	// TSIG secret (base64) used to authenticate DNS UPDATE messages. The
+	// key name equals the name of the Auth.
+	TsigKey string
 }
 
 func checkConstraints(name, secret string) bool {
@@ -84,13 +92,40 @@ func NewAuth(name, secret string) (*Auth, error) {
 		return nil, err
 	}
 
+	tsigKey, err := NewTsigKey()
+	if err != nil {
+		return nil, err
+	}
+
 	return &Auth{
-		Name: name,
-		Salt: salt,
-		Key:  key,
+		Name:    name,
+		Salt:    salt,
+		Key:     key,
+		TsigKey: tsigKey,
 	}, nil
 }
 
+// NewTsigKey generates a random TSIG secret and returns it base64 encoded,
+// the way it is used in key files of nsupdate and friends.
+func NewTsigKey() (string, error) {
+	rand, err := os.Open("/dev/urandom")
+	if err != nil {
+		return "", err
+	}
+	defer rand.Close()
+	return readTsigKey(rand)
+}
+
+// Read a TSIG secret of TsigKeyLen bytes and return it base64 encoded
+func readTsigKey(r io.Reader) (string, error) {
+	secret := make([]byte, TsigKeyLen)
+	c, err := io.ReadFull(r, secret)
+	if c < TsigKeyLen {
+		return "", fmt.Errorf("Read %d of %d random bytes for the TSIG key: %v", c, TsigKeyLen, err)
+	}
+	return base64.StdEncoding.EncodeToString(secret), nil
+}
+
 // CheckAuth Checks if a name, secret touple is identical to the one used for
 // the initial key. We return ok=true if the touple matches, else ok=false.
 //
@@ -17,6 +17,8 @@
 package cooldns
 
 import (
+	"encoding/base64"
+	"strings"
 	"testing"
 )
 
@@ -91,3 +93,25 @@ func TestNewAuth(t *testing.T) {
 		}
 	}
 }
+
+func TestNewTsigKey(t *testing.T) {
+	a, err := NewAuth("totally.new.domain.", "12345678")
+	if err != nil {
+		t.Fatal("NewAuth Returned Error:", err)
+	}
+	secret, err := base64.StdEncoding.DecodeString(a.TsigKey)
+	if err != nil || len(secret) != TsigKeyLen {
+		t.Errorf("Malformed TSIG key: %#v", a.TsigKey)
+	}
+	b, _ := NewAuth("totally.new.domain.", "12345678")
+	if a.TsigKey == b.TsigKey {
+		t.Error("TSIG keys are not random")
+	}
+}
+
+func TestReadTsigKeyShort(t *testing.T) {
+	key, err := readTsigKey(strings.NewReader("too short"))
+	if err == nil || key != "" {
+		t.Errorf("Short read returned key %q and error %v", key, err)
+	}
+}
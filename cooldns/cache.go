@@ -17,6 +17,10 @@
 package cooldns
 
 import (
+	"github.com/miekg/dns"
+	"net"
+	"sort"
+	"strings"
 	"sync"
 )
 
@@ -24,23 +28,137 @@ type DnsDB struct {
 	sync.RWMutex
 	db    map[string]*Entry
 	users map[string]*Auth
+	// Number of names below every name that has names below it
+	parents map[string]int
+	// Hostnames of the entries that hold records of owners below them
+	owners map[string]string
+	// Hostnames of the entries with an address, by the reverse name of the
+	// address
+	reverse map[string][]string
 }
 
 func NewCache() *DnsDB {
 	return &DnsDB{
-		db:    make(map[string]*Entry),
-		users: make(map[string]*Auth),
+		db:      make(map[string]*Entry),
+		users:   make(map[string]*Auth),
+		parents: make(map[string]int),
+		owners:  make(map[string]string),
+		reverse: make(map[string][]string),
 	}
 }
 
 func (d *DnsDB) LoadCache(m map[string]*Entry, u map[string]*Auth) {
 	d.db = m
 	d.users = u
+	d.parents = make(map[string]int)
+	d.owners = make(map[string]string)
+	d.reverse = make(map[string][]string)
+	for _, e := range m {
+		d.addNames(e)
+	}
+}
+
+// Names of an entry, the hostname and the owners of records below it.
+// Offline entries only keep the names of the records they serve.
+func entryNames(e *Entry) []string {
+	if e.hidden() {
+		return nil
+	}
+	names := []string{e.Hostname}
+	if !e.serving() {
+		return names
+	}
+	for _, owner := range e.owners() {
+		names = append(names, owner+"."+e.Hostname)
+	}
+	return names
+}
+
+// Reverse names of the addresses of an entry that opted in to PTR records
+func reverseNames(e *Entry) []string {
+	if !e.Reverse || !e.serving() {
+		return nil
+	}
+	var names []string
+	for _, ips := range [][]net.IP{e.Ip4s, e.Ip6s} {
+		for _, ip := range ips {
+			name, err := dns.ReverseAddr(ip.String())
+			if err == nil {
+				names = append(names, name)
+			}
+		}
+	}
+	return names
+}
+
+func (d *DnsDB) addNames(e *Entry) {
+	for _, name := range entryNames(e) {
+		if name != e.Hostname {
+			d.owners[name] = e.Hostname
+		}
+		d.addParents(name)
+	}
+	for _, name := range reverseNames(e) {
+		d.reverse[name] = append(d.reverse[name], e.Hostname)
+		d.addParents(name)
+	}
+}
+
+func (d *DnsDB) removeNames(e *Entry) {
+	for _, name := range entryNames(e) {
+		if name != e.Hostname {
+			delete(d.owners, name)
+		}
+		d.removeParents(name)
+	}
+	for _, name := range reverseNames(e) {
+		// Build a new list, the old one may be in use by a lookup
+		var hostnames []string
+		for _, hostname := range d.reverse[name] {
+			if hostname != e.Hostname {
+				hostnames = append(hostnames, hostname)
+			}
+		}
+		if len(hostnames) == 0 {
+			delete(d.reverse, name)
+		} else {
+			d.reverse[name] = hostnames
+		}
+		d.removeParents(name)
+	}
+}
+
+func (d *DnsDB) addParents(name string) {
+	for parent := parentName(name); parent != ""; parent = parentName(parent) {
+		d.parents[parent]++
+	}
+}
+
+func (d *DnsDB) removeParents(name string) {
+	for parent := parentName(name); parent != ""; parent = parentName(parent) {
+		d.parents[parent]--
+		if d.parents[parent] == 0 {
+			delete(d.parents, parent)
+		}
+	}
+}
+
+// Name without its first label, empty for top level domains
+func parentName(name string) string {
+	i := strings.Index(name, ".")
+	if i < 0 || i == len(name)-1 {
+		return ""
+	}
+	return name[i+1:]
 }
 
 func (d *DnsDB) Put(e *Entry) {
 	d.Lock()
 	defer d.Unlock()
+	if old := d.db[e.Hostname]; old != nil {
+		d.removeNames(old)
+	}
+	d.addNames(e)
 	d.db[e.Hostname] = e
 }
 
@@ -50,6 +168,72 @@ func (d *DnsDB) Get(name string) *Entry {
 	return d.db[name]
 }
 
+// Find the entry that answers for name according to RFC 4592. Offline
+// entries in OfflineNxdomain mode do not exist. Delegated entries answer for
+// all names at and below them. Explicit entries win, followed by owners of
+// records below an entry, then names with names below them exist without
+// data (empty non-terminals). Otherwise the wildcard of the closest encloser
+// applies, if it has one.
+// owner is the owner of the records within the entry, empty for the
+// hostname itself and wildcards. exists is false if the name does not exist
+// at all.
+func (d *DnsDB) Lookup(name string) (e *Entry, owner string, exists bool) {
+	d.RLock()
+	defer d.RUnlock()
+	for n := name; n != ""; n = parentName(n) {
+		if e := d.db[n]; e != nil && !e.hidden() && e.delegated() {
+			return e, "", true
+		}
+	}
+	if e := d.db[name]; e != nil && !e.hidden() {
+		return e, "", true
+	}
+	if hostname, ok := d.owners[name]; ok {
+		return d.db[hostname], strings.TrimSuffix(name, "."+hostname), true
+	}
+	if d.parents[name] > 0 {
+		return nil, "", true
+	}
+	for encloser := parentName(name); encloser != ""; encloser = parentName(encloser) {
+		if e := d.db[encloser]; e != nil && !e.hidden() {
+			if e.Wildcard {
+				return e, "", true
+			}
+			return nil, "", false
+		}
+		if d.parents[encloser] > 0 {
+			return nil, "", false
+		}
+	}
+	return nil, "", false
+}
+
+// Hostnames of the entries with the address of a reverse name. Names with
+// reverse names below them exist without hostnames, exists is false if the
+// name does not exist at all.
+func (d *DnsDB) LookupReverse(name string) (hostnames []string, exists bool) {
+	d.RLock()
+	defer d.RUnlock()
+	hostnames = d.reverse[name]
+	return hostnames, len(hostnames) != 0 || d.parents[name] > 0
+}
+
+// All entries ordered by hostname
+func (d *DnsDB) All() []*Entry {
+	d.RLock()
+	defer d.RUnlock()
+	var names []string
+	for name := range d.db {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	entries := make([]*Entry, 0, len(names))
+	for _, name := range names {
+		entries = append(entries, d.db[name])
+	}
+	return entries
+}
+
 func (d *DnsDB) PutUser(a *Auth) {
 	d.Lock()
 	defer d.Unlock()
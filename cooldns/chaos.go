@@ -0,0 +1,62 @@
+// The CoolDNS Project. The simple dynamic dns server and update service.
+// Copyright (C) 2014 The CoolDNS Authors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.package main
+
+package cooldns
+
+import (
+	"github.com/miekg/dns"
+	"log"
+	"strings"
+)
+
+// TXT of a name in class CHAOS that identifies the server, empty if the
+// name is unknown or the answer is not configured
+func (h *dnsHandler) chaosTxt(name string) string {
+	switch strings.ToLower(name) {
+	case "version.bind.", "version.server.":
+		return h.version
+	case "hostname.bind.", "id.server.":
+		return h.serverId
+	}
+	return ""
+}
+
+// Answer a query in class CHAOS. Only TXT records exist.
+func (h *dnsHandler) handleChaos(w dns.ResponseWriter, r *dns.Msg) {
+	question := r.Question[0]
+	m := new(dns.Msg)
+	m.SetReply(r)
+	m.Authoritative = true
+	if question.Qtype == dns.TypeTXT || question.Qtype == dns.TypeANY {
+		m.Answer = []dns.RR{&dns.TXT{
+			Hdr: dns.RR_Header{Name: question.Name,
+				Rrtype: dns.TypeTXT,
+				Class:  dns.ClassCHAOS,
+				Ttl:    0},
+			Txt: []string{h.chaosTxt(question.Name)},
+		}}
+	}
+	if r.IsEdns0() != nil {
+		m.SetEdns0(ednsSize, false)
+	}
+	if !h.limit(w, "", m) {
+		return
+	}
+	err := w.WriteMsg(m)
+	if err != nil {
+		log.Println("WOOPS ERRRROOOORR:", err)
+	}
+}
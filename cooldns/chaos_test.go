@@ -0,0 +1,74 @@
+// The CoolDNS Project. The simple dynamic dns server and update service.
+// Copyright (C) 2014 The CoolDNS Authors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.package main
+
+package cooldns
+
+import (
+	"github.com/miekg/dns"
+	"testing"
+)
+
+func chaosQuery(port, name string, qtype uint16) (*dns.Msg, error) {
+	m := new(dns.Msg)
+	m.SetQuestion(name, qtype)
+	m.Question[0].Qclass = dns.ClassCHAOS
+	return dnsExchange(port, m)
+}
+
+func TestDnsChaos(t *testing.T) {
+	db, err := getTmpDB()
+	if err != nil {
+		t.Fatal("Failed to create temporary DB")
+	}
+	port := startDnsServerConfig(db, &DnsServerConfig{
+		Domain:   "ist.nicht.cool.",
+		ServerId: "ns1.fra",
+	})
+
+	for _, name := range []string{"hostname.bind.", "ID.Server."} {
+		in, err := chaosQuery(port, name, dns.TypeTXT)
+		if err != nil {
+			t.Fatal("Query failed:", err)
+		}
+		if in.Rcode != dns.RcodeSuccess || !in.Authoritative || len(in.Answer) != 1 {
+			t.Fatalf("Unexpected answer for %s: %s", name, in)
+		}
+		txt := in.Answer[0].(*dns.TXT)
+		if txt.Hdr.Class != dns.ClassCHAOS || len(txt.Txt) != 1 || txt.Txt[0] != "ns1.fra" {
+			t.Errorf("Unexpected answer for %s: %s", name, txt)
+		}
+	}
+
+	// Other types have no data
+	in, err := chaosQuery(port, "id.server.", dns.TypeA)
+	if err != nil {
+		t.Fatal("Query failed:", err)
+	}
+	if in.Rcode != dns.RcodeSuccess || len(in.Answer) != 0 {
+		t.Error("Unexpected answer for type A:", in)
+	}
+
+	// The version is not set, unknown names are refused as well
+	for _, name := range []string{"version.bind.", "version.server.", "authors.bind."} {
+		in, err := chaosQuery(port, name, dns.TypeTXT)
+		if err != nil {
+			t.Fatal("Query failed:", err)
+		}
+		if in.Rcode != dns.RcodeRefused {
+			t.Errorf("%s answered %s, expected REFUSED", name, dns.RcodeToString[in.Rcode])
+		}
+	}
+}
@@ -17,7 +17,10 @@
 package cooldns
 
 import (
+	"log"
 	"os"
+	"strconv"
+	"strings"
 )
 
 // Server Confiuration object holds instance specific variables
@@ -30,6 +33,10 @@ type Config struct {
 	WebConfig    *WebConfig
 	DnsConfig    *DnsServerConfig // Server Configuration
 	InfluxConfig *InfluxConfig    // Influx DB configuration
+	// Further zones served besides Domain, see SetZones
+	Zones []*ZoneConfig
+	// Views of the zones, see SetViews
+	Views []*ViewConfig
 }
 
 func LoadConfig() *Config {
@@ -38,6 +45,20 @@ func LoadConfig() *Config {
 	c.DnsConfig = loadDnsConfig()
 	c.InfluxConfig = loadInfluxConfig()
 	c.SetDomain(os.Getenv("COOLDNS_SUFFIX"))
+	if file := os.Getenv("COOLDNS_ZONES"); file != "" {
+		zones, err := loadZones(file)
+		if err != nil {
+			log.Fatalf("Failed to load the zones from %s: %s", file, err)
+		}
+		c.SetZones(zones)
+	}
+	if file := os.Getenv("COOLDNS_VIEWS"); file != "" {
+		views, err := loadViews(file)
+		if err != nil {
+			log.Fatalf("Failed to load the views from %s: %s", file, err)
+		}
+		c.SetViews(views)
+	}
 	return c
 }
 
@@ -53,6 +74,9 @@ func loadWebConfig() *WebConfig {
 	}
 	w.RcPubKey = os.Getenv("COOLDNS_RC_PUB")
 	w.RcPrivKey = os.Getenv("COOLDNS_RC_PRIV")
+	w.AdminSecret = os.Getenv("COOLDNS_ADMIN_SECRET")
+	w.TrustedProxies = strings.Fields(strings.Replace(
+		os.Getenv("COOLDNS_TRUSTED_PROXIES"), ",", " ", -1))
 	return w
 }
 
@@ -61,13 +85,68 @@ func loadDnsConfig() *DnsServerConfig {
 	if listen == "" {
 		listen = ":8053"
 	}
+	var nameservers []string
+	for _, ns := range strings.Fields(strings.Replace(os.Getenv("COOLDNS_NS"), ",", " ", -1)) {
+		nameservers = append(nameservers, fqdn(ns))
+	}
 	return &DnsServerConfig{
-		Listen:  listen,
-		TsigKey: os.Getenv("COOLDNS_TSIG_KEY"),
+		Listen:      listen,
+		TsigKey:     os.Getenv("COOLDNS_TSIG_KEY"),
+		Nameservers: nameservers,
+		Hostmaster:  fqdn(os.Getenv("COOLDNS_HOSTMASTER")),
+		DefaultTtl:  loadTtl("COOLDNS_TTL"),
+		MinTtl:      loadTtl("COOLDNS_TTL_MIN"),
+		MaxTtl:      loadTtl("COOLDNS_TTL_MAX"),
+		Notify:      strings.Fields(strings.Replace(os.Getenv("COOLDNS_NOTIFY"), ",", " ", -1)),
+		DnssecKeys:  os.Getenv("COOLDNS_DNSSEC_KEYS"),
+		TlsCert:     os.Getenv("COOLDNS_DOT_CERT"),
+		TlsKey:      os.Getenv("COOLDNS_DOT_KEY"),
+		TlsListen:   os.Getenv("COOLDNS_DOT_LISTEN"),
+		ReversePrefixes: strings.Fields(strings.Replace(
+			os.Getenv("COOLDNS_REVERSE_PREFIXES"), ",", " ", -1)),
+		Parking: strings.Fields(strings.Replace(
+			os.Getenv("COOLDNS_OFFLINE_PARKING"), ",", " ", -1)),
+		RrlRate: uint32(loadNumber("COOLDNS_RRL_RATE")),
+		RrlSlip: loadNumber("COOLDNS_RRL_SLIP"),
+
+		QueryLog:       os.Getenv("COOLDNS_QUERY_LOG"),
+		QueryLogFormat: os.Getenv("COOLDNS_QUERY_LOG_FORMAT"),
+		QueryLogSample: loadNumber("COOLDNS_QUERY_LOG_SAMPLE"),
+
+		Primary:  os.Getenv("COOLDNS_PRIMARY"),
+		Version:  os.Getenv("COOLDNS_VERSION"),
+		ServerId: os.Getenv("COOLDNS_SERVER_ID"),
+		IpNames:  strings.ToLower(os.Getenv("COOLDNS_IP_NAMES")) == "yes",
 	}
 
 }
 
+// Read a TTL in seconds from the environment, zero if unset
+func loadTtl(env string) uint32 {
+	v := os.Getenv(env)
+	if v == "" {
+		return 0
+	}
+	ttl, err := parseTtl(v)
+	if err != nil {
+		log.Fatalf("Malformatted TTL in %s: %s", env, err)
+	}
+	return ttl
+}
+
+// Read a number from the environment, zero if unset
+func loadNumber(env string) int {
+	v := os.Getenv(env)
+	if v == "" {
+		return 0
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		log.Fatalf("Malformatted number in %s: %s", env, err)
+	}
+	return n
+}
+
 func loadInfluxConfig() *InfluxConfig {
 	host := os.Getenv("COOLDNS_INFLUX_HOST")
 	database := os.Getenv("COOLDNS_INFLUX_DB")
@@ -93,3 +172,18 @@ func (c *Config) SetDomain(d string) {
 	c.DnsConfig.Domain = d
 	c.WebConfig.Domain = d
 }
+
+// Serve further zones with their own settings. A zone named like the Domain
+// sets the settings of the Domain.
+func (c *Config) SetZones(zones []*ZoneConfig) {
+	c.Zones = zones
+	c.DnsConfig.Zones = zones
+	c.WebConfig.Zones = zones
+}
+
+// Answer clients of the views with the addresses entries have for them
+func (c *Config) SetViews(views []*ViewConfig) {
+	c.Views = views
+	c.DnsConfig.Views = views
+	c.WebConfig.Views = newViewNames(views)
+}
@@ -17,8 +17,11 @@
 package cooldns
 
 import (
+	"errors"
 	"fmt"
 	"net"
+	"strconv"
+	"strings"
 )
 
 type MxEntry struct {
@@ -34,20 +37,113 @@ type Entry struct {
 	Txts     []string
 	Mxs      []MxEntry
 	Cname    string
+	// Time to live of all records of the entry in seconds. Zero means the
+	// default TTL of the zone is used.
+	Ttl uint32
+	// The records also answer for all names below the hostname that do not
+	// exist themselves, like a "*.<hostname>" wildcard.
+	Wildcard bool
+	// The addresses of the entry get PTR records in the reverse zones
+	Reverse bool
+	// What the entry answers while it is offline, one of the Offline*
+	// modes. Empty means OfflineNxdomain.
+	OfflineMode string
+	// Further records in presentation format, optionally preceded by an
+	// owner name below the hostname made of underscore labels, e.g.
+	// "_sip._udp 10 5 5060 sip.example.com.". See records.go
+	Srvs   []string
+	Caas   []string
+	Ptrs   []string
+	Sshfps []string
+	Tlsas  []string
+	Https  []string
+	Svcbs  []string
+	// Name servers the hostname and all names below it are delegated to.
+	// Name servers at or below the hostname get its addresses as glue.
+	Nss []string
+	// Addresses the entry answers with in views, by name of the view.
+	// Views without addresses get the addresses above.
+	ViewIps map[string][]net.IP
+	// How the addresses are ordered in answers, one of the Answer*
+	// policies. Empty means AnswerFixed.
+	AnswerPolicy string
+	// Weights of the addresses in AnswerWeighted mode by address,
+	// addresses without a weight count once
+	Weights map[string]uint32
 }
 
 func (e *Entry) String() string {
-	return fmt.Sprintf("%s\n\tIpv6: %v\n\tIpv4: %v\n\tOffline: %v\n\tTxt: %v\n\tMxs: %v\n\tCname: %s",
-		e.Hostname, e.Ip6s, e.Ip4s, e.Offline, e.Txts, e.Mxs, e.Cname)
+	return fmt.Sprintf("%s\n\tIpv6: %v\n\tIpv4: %v\n\tOffline: %v %s\n\tTxt: %v\n\tMxs: %v\n\tCname: %s\n\tTtl: %d\n\tWildcard: %v\n\tReverse: %v",
+		e.Hostname, e.Ip6s, e.Ip4s, e.Offline, e.OfflineMode, e.Txts, e.Mxs, e.Cname, e.Ttl, e.Wildcard, e.Reverse) +
+		fmt.Sprintf("\n\tSrv: %v\n\tCaa: %v\n\tPtr: %v\n\tSshfp: %v\n\tTlsa: %v\n\tHttps: %v\n\tSvcb: %v\n\tNs: %v\n\tViews: %v\n\tPolicy: %s %v",
+			e.Srvs, e.Caas, e.Ptrs, e.Sshfps, e.Tlsas, e.Https, e.Svcbs, e.Nss, e.ViewIps,
+			e.AnswerPolicy, e.Weights)
 }
 
-// Specifies the four methods that are needed from a DB
+// Copy returns a deep copy of the entry that can be modified without
+// touching the one held by the cache.
+func (e *Entry) Copy() *Entry {
+	c := *e
+	c.Ip6s = append([]net.IP(nil), e.Ip6s...)
+	c.Ip4s = append([]net.IP(nil), e.Ip4s...)
+	c.Txts = append([]string(nil), e.Txts...)
+	c.Mxs = append([]MxEntry(nil), e.Mxs...)
+	c.Nss = append([]string(nil), e.Nss...)
+	if e.ViewIps != nil {
+		c.ViewIps = make(map[string][]net.IP)
+		for view, ips := range e.ViewIps {
+			c.ViewIps[view] = append([]net.IP(nil), ips...)
+		}
+	}
+	if e.Weights != nil {
+		c.Weights = make(map[string]uint32)
+		for ip, w := range e.Weights {
+			c.Weights[ip] = w
+		}
+	}
+	for _, rrtype := range rdataTypes {
+		field := c.rdata(rrtype)
+		*field = append([]string(nil), *field...)
+	}
+	return &c
+}
+
+// Parse a TTL in seconds. TTLs are limited to 2^31 - 1 by RFC 2181.
+func parseTtl(s string) (uint32, error) {
+	ttl, err := strconv.ParseUint(strings.TrimSpace(s), 10, 31)
+	return uint32(ttl), err
+}
+
+// A single change of the zone. Old is nil if the entry was created.
+type JournalEntry struct {
+	Serial   uint32 // Serial of the zone after the change
+	Old, New *Entry
+}
+
+// Journal returns this error if the changes requested are no longer recorded
+var ErrJournalIncomplete = errors.New("Journal does not reach back to serial")
+
+// Specifies the methods that are needed from a DB
 // All methods shall be callable from sevferal goroutines at a time.
 type CoolDB interface {
 	GetEntry(string) *Entry
+	// Entry answering for a name, including wildcards. See DnsDB.Lookup
+	LookupEntry(string) (*Entry, string, bool)
+	// Hostnames for the reverse name of an address. See DnsDB.LookupReverse
+	LookupReverse(string) ([]string, bool)
 	SaveEntry(*Entry) error
 	GetAuth(string) *Auth
 	SaveAuth(*Auth) error
 
+	// All entries of the zone
+	Entries() []*Entry
+	// Serial of the zone, increased with every saved entry
+	Serial() uint32
+	// All changes after the given serial in order
+	Journal(uint32) ([]*JournalEntry, error)
+	// Register a function that is called with the new serial after every
+	// change of the zone. It must not block.
+	OnChange(func(uint32))
+
 	Close() error
 }
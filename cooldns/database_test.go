@@ -17,7 +17,9 @@
 package cooldns
 
 import (
+	"database/sql"
 	"fmt"
+	"github.com/miekg/dns"
 	"io"
 	"io/ioutil"
 	"net"
@@ -61,6 +63,7 @@ var entries = []*Entry{
 	&Entry{Hostname: "test2.ist.nicht.cool.",
 		Ip4s:    []net.IP{net.ParseIP("192.168.0.2")},
 		Offline: false,
+		Ttl:     3600,
 		Txts:    []string{"Hallo Welt", "Zweite Zeile"},
 		Mxs: []MxEntry{
 			MxEntry{"mail.deine.mutter.de", 1000},
@@ -94,6 +97,130 @@ func TestCacheCreation(t *testing.T) {
 
 }
 
+type cacheLookupTest struct {
+	Name     string
+	Hostname string // hostname of the expected entry, "" for none
+	Owner    string
+	Exists   bool
+}
+
+// Entries: wild (wildcard), explicit.wild, b.c.wild, gone.wild (offline)
+// and sip with an SRV record at _sip._udp.sip, del is delegated and has
+// explicit.del below it
+var cachelookuptests = []cacheLookupTest{
+	{"wild.ist.nicht.cool.", "wild.ist.nicht.cool.", "", true},
+	{"git.wild.ist.nicht.cool.", "wild.ist.nicht.cool.", "", true},
+	{"a.b.wild.ist.nicht.cool.", "wild.ist.nicht.cool.", "", true},
+	// Explicit entries win over the wildcard
+	{"explicit.wild.ist.nicht.cool.", "explicit.wild.ist.nicht.cool.", "", true},
+	// The wildcard is not inherited below explicit entries
+	{"x.explicit.wild.ist.nicht.cool.", "", "", false},
+	// Empty non-terminals exist and block the wildcard
+	{"c.wild.ist.nicht.cool.", "", "", true},
+	{"x.c.wild.ist.nicht.cool.", "", "", false},
+	{"b.c.wild.ist.nicht.cool.", "b.c.wild.ist.nicht.cool.", "", true},
+	// Offline entries do not exist, the wildcard answers for them
+	{"gone.wild.ist.nicht.cool.", "wild.ist.nicht.cool.", "", true},
+	{"x.gone.wild.ist.nicht.cool.", "wild.ist.nicht.cool.", "", true},
+	{"other.ist.nicht.cool.", "", "", false},
+	{"ist.nicht.cool.", "", "", true},
+	// Owners of records below an entry
+	{"_sip._udp.sip.ist.nicht.cool.", "sip.ist.nicht.cool.", "_sip._udp", true},
+	{"_udp.sip.ist.nicht.cool.", "", "", true},
+	{"_sip._tcp.sip.ist.nicht.cool.", "", "", false},
+	// Delegations answer for everything below them
+	{"del.ist.nicht.cool.", "del.ist.nicht.cool.", "", true},
+	{"x.del.ist.nicht.cool.", "del.ist.nicht.cool.", "", true},
+	{"explicit.del.ist.nicht.cool.", "del.ist.nicht.cool.", "", true},
+}
+
+func TestCacheLookup(t *testing.T) {
+	cache := NewCache()
+	cache.Put(&Entry{Hostname: "wild.ist.nicht.cool.", Wildcard: true})
+	cache.Put(&Entry{Hostname: "explicit.wild.ist.nicht.cool."})
+	cache.Put(&Entry{Hostname: "b.c.wild.ist.nicht.cool."})
+	cache.Put(&Entry{Hostname: "gone.wild.ist.nicht.cool.", Offline: true})
+	cache.Put(&Entry{
+		Hostname: "sip.ist.nicht.cool.",
+		Srvs:     []string{"_sip._udp 10 5 5060 sip.ist.nicht.cool."},
+	})
+	cache.Put(&Entry{Hostname: "del.ist.nicht.cool.", Nss: []string{"ns.example.org."}})
+	cache.Put(&Entry{Hostname: "explicit.del.ist.nicht.cool."})
+
+	for _, test := range cachelookuptests {
+		e, owner, exists := cache.Lookup(test.Name)
+		hostname := ""
+		if e != nil {
+			hostname = e.Hostname
+		}
+		if hostname != test.Hostname || owner != test.Owner || exists != test.Exists {
+			t.Errorf("Lookup %s: got %q %q %v, expected %q %q %v",
+				test.Name, hostname, owner, exists, test.Hostname, test.Owner, test.Exists)
+		}
+	}
+
+	// Replacing the entry removes the names of its old records
+	cache.Put(&Entry{Hostname: "sip.ist.nicht.cool."})
+	if _, _, exists := cache.Lookup("_udp.sip.ist.nicht.cool."); exists {
+		t.Error("Owner of removed record still exists")
+	}
+}
+
+func TestCacheReverse(t *testing.T) {
+	cache := NewCache()
+	cache.Put(&Entry{
+		Hostname: "rev.ist.nicht.cool.",
+		Ip4s:     []net.IP{net.ParseIP("192.168.0.1")},
+		Ip6s:     []net.IP{net.ParseIP("2001:db8::1")},
+		Reverse:  true,
+	})
+	cache.Put(&Entry{
+		Hostname: "other.ist.nicht.cool.",
+		Ip4s:     []net.IP{net.ParseIP("192.168.0.1")},
+		Reverse:  true,
+	})
+	cache.Put(&Entry{
+		Hostname: "private.ist.nicht.cool.",
+		Ip4s:     []net.IP{net.ParseIP("192.168.0.2")},
+	})
+
+	hostnames, exists := cache.LookupReverse("1.0.168.192.in-addr.arpa.")
+	if !exists || !stringArrayCompare(hostnames, []string{"rev.ist.nicht.cool.", "other.ist.nicht.cool."}) {
+		t.Error("Wrong hostnames for IPv4 address:", hostnames)
+	}
+	ip6, _ := dns.ReverseAddr("2001:db8::1")
+	hostnames, exists = cache.LookupReverse(ip6)
+	if !exists || !stringArrayCompare(hostnames, []string{"rev.ist.nicht.cool."}) {
+		t.Error("Wrong hostnames for IPv6 address:", hostnames)
+	}
+	// Entries that did not opt in have no reverse names
+	if _, exists = cache.LookupReverse("2.0.168.192.in-addr.arpa."); exists {
+		t.Error("Address of entry without reverse names exists")
+	}
+	// Names above addresses exist without hostnames
+	hostnames, exists = cache.LookupReverse("0.168.192.in-addr.arpa.")
+	if !exists || len(hostnames) != 0 {
+		t.Error("Empty non-terminal is missing:", hostnames, exists)
+	}
+
+	// Changed addresses replace the old names
+	cache.Put(&Entry{
+		Hostname: "rev.ist.nicht.cool.",
+		Ip4s:     []net.IP{net.ParseIP("192.168.1.1")},
+		Reverse:  true,
+	})
+	hostnames, _ = cache.LookupReverse("1.0.168.192.in-addr.arpa.")
+	if !stringArrayCompare(hostnames, []string{"other.ist.nicht.cool."}) {
+		t.Error("Old address was not removed:", hostnames)
+	}
+	if _, exists = cache.LookupReverse(ip6); exists {
+		t.Error("Old IPv6 address still exists")
+	}
+	if hostnames, _ = cache.LookupReverse("1.1.168.192.in-addr.arpa."); len(hostnames) != 1 {
+		t.Error("New address is missing")
+	}
+}
+
 var randomSrc io.Reader
 
 func getRandom() io.Reader {
@@ -142,6 +269,9 @@ func genRandEntry() *Entry {
 	// random ipv6
 	ipv6Rand := make([]byte, 16)
 	rand.Read(ipv6Rand)
+	// random ttl
+	ttlRand := make([]byte, 2)
+	rand.Read(ttlRand)
 
 	return &Entry{
 		Hostname: fmt.Sprintf("%x.ist.nicht.cool.", hostnameRand),
@@ -153,6 +283,11 @@ func genRandEntry() *Entry {
 		Mxs: []MxEntry{
 			MxEntry{"mail.deine.mutter.de", 1000},
 		},
+		Ttl:      uint32(ttlRand[0])<<8 | uint32(ttlRand[1]),
+		Wildcard: ttlRand[0]&1 == 1,
+		Reverse:  ttlRand[1]&1 == 1,
+		Srvs:     []string{fmt.Sprintf("_sip._udp 10 5 5060 %x.ist.nicht.cool.", cnameRand)},
+		Caas:     []string{`0 issue "letsencrypt.org"`},
 	}
 
 }
@@ -230,3 +365,164 @@ func TestDatabaseRandomEntry(t *testing.T) {
 		}
 	}
 }
+
+// Databases of older versions lack some columns, make sure they are added
+func TestDatabaseMigration(t *testing.T) {
+	tmpFile, err := getTmpFile()
+	if err != nil {
+		t.Fatal("Failed to create tmp file")
+	}
+	c, err := sql.Open("sqlite3", tmpFile)
+	if err != nil {
+		t.Fatal("Failed to open tmp file:", err)
+	}
+	_, err = c.Exec(`
+	CREATE TABLE cooldns (
+	  hostname TEXT,
+	  ip4 TEXT,
+	  ip6 TEXT,
+	  offline BOOLEAN,
+	  txt TEXT,
+	  mx TEXT,
+	  cname TEXT,
+	UNIQUE (hostname) ON CONFLICT REPLACE
+	);`)
+	if err == nil {
+		_, err = c.Exec(`
+		INSERT INTO cooldns (hostname, ip4, ip6, offline, txt, mx, cname)
+		VALUES ('old.ist.nicht.cool.', '192.168.0.1', '', 0, '', '', '');`)
+	}
+	c.Close()
+	if err != nil {
+		t.Fatal("Failed to create old table:", err)
+	}
+
+	db, err := getDB(tmpFile)
+	if err != nil {
+		t.Fatal("Failed to open old DB:", err)
+	}
+	defer db.Close()
+	e := db.GetEntry("old.ist.nicht.cool.")
+	if e == nil || len(e.Ip4s) != 1 || e.Ttl != 0 {
+		t.Fatal("Old entry was not loaded:", e)
+	}
+	e.Ttl = 3600
+	err = db.SaveEntry(e)
+	if err != nil {
+		t.Fatal("Failed to save entry in migrated DB:", err)
+	}
+}
+
+// Every saved entry increases the serial and is recorded in the journal
+func TestDatabaseOffline(t *testing.T) {
+	tmpFile, err := getTmpFile()
+	if err != nil {
+		t.Fatal("Failed to create tmp file")
+	}
+	db, err := getDB(tmpFile)
+	if err != nil {
+		t.Fatal("Failed to open DB:", err)
+	}
+	e := &Entry{
+		Hostname: "offline.ist.nicht.cool.",
+		Ip4s:     []net.IP{net.ParseIP("192.168.0.1")},
+	}
+	db.SaveEntry(e)
+	if _, _, exists := db.LookupEntry(e.Hostname); !exists {
+		t.Fatal("Online entry does not exist")
+	}
+	offline := e.Copy()
+	offline.Offline = true
+	db.SaveEntry(offline)
+	if _, _, exists := db.LookupEntry(e.Hostname); exists {
+		t.Error("Offline entry still exists")
+	}
+	db.Close()
+
+	// Offline entries stay offline after a restart
+	db, err = getDB(tmpFile)
+	if err != nil {
+		t.Fatal("Failed to reopen DB:", err)
+	}
+	defer db.Close()
+	if _, _, exists := db.LookupEntry(e.Hostname); exists {
+		t.Error("Offline entry exists after restart")
+	}
+	if stored := db.GetEntry(e.Hostname); stored == nil || !stored.Offline ||
+		len(stored.Ip4s) != 1 {
+		t.Error("Offline entry was not stored:", stored)
+	}
+
+	offline.OfflineMode = OfflineLast
+	db.SaveEntry(offline)
+	if entry, _, exists := db.LookupEntry(e.Hostname); !exists || entry.OfflineMode != OfflineLast {
+		t.Error("Offline entry in last mode does not exist")
+	}
+}
+
+func TestDatabaseJournal(t *testing.T) {
+	tmpFile, err := getTmpFile()
+	if err != nil {
+		t.Fatal("Failed to create tmp file")
+	}
+	db, err := getDB(tmpFile)
+	if err != nil {
+		t.Fatal("Failed to create temporary DB:", err)
+	}
+	serial := db.Serial()
+	first, second := genRandEntry(), genRandEntry()
+	second.Hostname = first.Hostname
+	db.SaveEntry(first)
+	db.SaveEntry(second)
+	db.Close()
+
+	rdb, err := getDB(tmpFile)
+	if err != nil {
+		t.Fatal("Failed to reopen temporary DB:", err)
+	}
+	defer rdb.Close()
+	if rdb.Serial() != serial+2 {
+		t.Errorf("Serial is %d, expected %d", rdb.Serial(), serial+2)
+	}
+	journal, err := rdb.Journal(serial)
+	if err != nil || len(journal) != 2 {
+		t.Fatal("Failed to read journal:", journal, err)
+	}
+	if journal[0].Old != nil || !reflect.DeepEqual(journal[0].New, first) {
+		t.Error("Wrong first journal entry:", journal[0].Old, journal[0].New)
+	}
+	if !reflect.DeepEqual(journal[1].Old, first) || !reflect.DeepEqual(journal[1].New, second) {
+		t.Error("Wrong second journal entry:", journal[1].Old, journal[1].New)
+	}
+	journal, err = rdb.Journal(rdb.Serial())
+	if err != nil || len(journal) != 0 {
+		t.Error("Journal of the current serial is not empty:", journal, err)
+	}
+	_, err = rdb.Journal(serial - 1)
+	if err != ErrJournalIncomplete {
+		t.Error("Expected incomplete journal, got", err)
+	}
+}
+
+func TestDatabaseFailedSave(t *testing.T) {
+	db, err := getTmpDB()
+	if err != nil {
+		t.Fatal("Failed to create temporary DB:", err)
+	}
+	defer db.Close()
+	first, second := genRandEntry(), genRandEntry()
+	second.Hostname = first.Hostname
+	db.SaveEntry(first)
+
+	// Without the journal the transaction fails
+	_, err = db.(*SqliteCoolDB).c.Exec("DROP TABLE journal")
+	if err != nil {
+		t.Fatal("Failed to drop the journal:", err)
+	}
+	if err := db.SaveEntry(second); err == nil {
+		t.Fatal("Save without a journal succeeded")
+	}
+	if e := db.GetEntry(first.Hostname); !reflect.DeepEqual(e, first) {
+		t.Error("Failed save changed the cache:", e)
+	}
+}
@@ -0,0 +1,113 @@
+// The CoolDNS Project. The simple dynamic dns server and update service.
+// Copyright (C) 2014 The CoolDNS Authors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.package main
+
+package cooldns
+
+import (
+	"github.com/miekg/dns"
+	"strings"
+)
+
+// Entries that delegate their names to name servers of their own
+func (e *Entry) delegated() bool {
+	return len(e.Nss) != 0 && e.serving()
+}
+
+// Name servers at or below the hostname need the addresses of the entry as
+// glue, nobody could resolve them otherwise
+func (e *Entry) needsGlue(ns string) bool {
+	return dns.IsSubDomain(strings.ToLower(ownerName(e)), strings.ToLower(ns))
+}
+
+func (e *Entry) validateDelegation() (errors []string) {
+	for _, ns := range e.Nss {
+		if !isFqdn(ns) {
+			errors = append(errors, "Malformatted NS record")
+		} else if e.needsGlue(ns) && len(e.Ip4s)+len(e.Ip6s) == 0 {
+			errors = append(errors, "Name server "+ns+" needs an address of the host as glue")
+		}
+	}
+	if len(e.Nss) != 0 && e.Cname != "" {
+		errors = append(errors, "Delegated hosts can not have a CNAME")
+	}
+	return errors
+}
+
+// The delegated entry a name in a zone belongs to as seen from a view, nil
+// if the name is not delegated
+func (h *dnsHandler) delegation(zone, qname, view string) *Entry {
+	if strings.ToLower(qname) == zone || h.forwardZone(zone) == nil {
+		return nil
+	}
+	entry, _, _ := h.lookupEntry(qname)
+	if entry == nil || !entry.delegated() {
+		return nil
+	}
+	return entry.inView(view)
+}
+
+// NS set of a delegated entry
+func (h *dnsHandler) delegationNs(e *Entry) []dns.RR {
+	var rrs []dns.RR
+	for _, nameserver := range e.Nss {
+		rr := new(dns.NS)
+		rr.Hdr = dns.RR_Header{Name: ownerName(e),
+			Rrtype: dns.TypeNS,
+			Class:  dns.ClassINET,
+			Ttl:    h.ttl(e)}
+		rr.Ns = nameserver
+		rrs = append(rrs, rr)
+	}
+	return rrs
+}
+
+// Addresses of the name servers of a delegated entry that need glue
+func (h *dnsHandler) glue(e *Entry) []dns.RR {
+	var rrs []dns.RR
+	seen := make(map[string]bool)
+	for _, nameserver := range e.Nss {
+		name := strings.ToLower(nameserver)
+		if seen[name] || !e.needsGlue(name) {
+			continue
+		}
+		seen[name] = true
+		rrs = append(rrs, h.entryRecords(e, nameserver, dns.TypeA)...)
+		rrs = append(rrs, h.entryRecords(e, nameserver, dns.TypeAAAA)...)
+	}
+	return rrs
+}
+
+// Refer the client to the name servers of a delegated entry. The parent
+// holds no DS records, queries for them get a NODATA answer instead.
+func (h *dnsHandler) referral(m *dns.Msg, zone, qname string, qtype uint16, e *Entry, dnssec bool) {
+	if qtype == dns.TypeDS && strings.ToLower(qname) == strings.ToLower(ownerName(e)) {
+		m.Ns = append(m.Ns, h.negativeSoa(zone))
+		if dnssec {
+			m.Ns = append(m.Ns, nsecCompact(qname, []uint16{dns.TypeNS}))
+		}
+		return
+	}
+	// Only the alias leading here is data of the zone
+	if len(m.Answer) == 0 {
+		m.Authoritative = false
+	}
+	m.Ns = append(m.Ns, h.delegationNs(e)...)
+	if dnssec {
+		// Proves the delegation is insecure
+		m.Ns = append(m.Ns, nsecCompact(ownerName(e), []uint16{dns.TypeNS}))
+	}
+	m.Extra = append(m.Extra, h.glue(e)...)
+}
@@ -0,0 +1,126 @@
+// The CoolDNS Project. The simple dynamic dns server and update service.
+// Copyright (C) 2014 The CoolDNS Authors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.package main
+
+package cooldns
+
+import (
+	"github.com/miekg/dns"
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestValidateDelegation(t *testing.T) {
+	e := &Entry{
+		Hostname: "myhost.ist.nicht.cool.",
+		Nss:      []string{"ns1.myhost.ist.nicht.cool.", "ns.example.org."},
+	}
+	if errors := e.validateDelegation(); len(errors) != 1 {
+		t.Error("Missing glue was not detected:", errors)
+	}
+	e.Ip4s = []net.IP{net.ParseIP("192.168.0.1")}
+	if errors := e.validateDelegation(); len(errors) != 0 {
+		t.Error("Valid delegation was rejected:", errors)
+	}
+	e.Nss = append(e.Nss, "kein name")
+	e.Cname = "example.org."
+	if errors := e.validateDelegation(); len(errors) != 2 {
+		t.Error("Expected 2 errors, got", errors)
+	}
+}
+
+func TestDnsDelegation(t *testing.T) {
+	db, err := getTmpDB()
+	if err != nil {
+		t.Fatal("Failed to create temporary DB")
+	}
+	dir, _, _ := getTmpKeys(t)
+	port := startDnsServerConfig(db, &DnsServerConfig{
+		Domain:     "ist.nicht.cool.",
+		DnssecKeys: dir,
+	})
+	db.SaveEntry(&Entry{
+		Hostname: "myhost.ist.nicht.cool.",
+		Ip4s:     []net.IP{net.ParseIP("192.168.0.1")},
+		Ip6s:     []net.IP{net.ParseIP("fd00::1")},
+		Nss:      []string{"ns1.myhost.ist.nicht.cool.", "ns.example.org."},
+		Txts:     []string{"hidden by the delegation"},
+	})
+	db.SaveEntry(&Entry{
+		Hostname: "alias.ist.nicht.cool.",
+		Cname:    "www.myhost.ist.nicht.cool.",
+	})
+
+	for _, name := range []string{"myhost.ist.nicht.cool.", "www.myhost.ist.nicht.cool."} {
+		in, err := dnsQuery(port, name, dns.TypeTXT)
+		if err != nil {
+			t.Fatal("Query failed:", err)
+		}
+		if in.Rcode != dns.RcodeSuccess || in.Authoritative || len(in.Answer) != 0 ||
+			countType(in.Ns, dns.TypeNS) != 2 || in.Ns[0].Header().Name != "myhost.ist.nicht.cool." {
+			t.Error("Unexpected referral:", in)
+		}
+		if len(in.Extra) != 2 || in.Extra[0].Header().Name != "ns1.myhost.ist.nicht.cool." ||
+			in.Extra[0].(*dns.A).A.String() != "192.168.0.1" {
+			t.Error("Unexpected glue:", in.Extra)
+		}
+	}
+
+	// Aliases into the delegation are answered, followed by the referral
+	in, err := dnsQuery(port, "alias.ist.nicht.cool.", dns.TypeA)
+	if err != nil || !in.Authoritative || len(in.Answer) != 1 || countType(in.Ns, dns.TypeNS) != 2 {
+		t.Error("Unexpected answer for the alias:", in, err)
+	}
+
+	// The parent has no DS records
+	in, err = dnsQuery(port, "myhost.ist.nicht.cool.", dns.TypeDS)
+	if err != nil || !in.Authoritative || len(in.Answer) != 0 || countType(in.Ns, dns.TypeSOA) != 1 {
+		t.Error("Unexpected answer for DS:", in, err)
+	}
+
+	// Signed referrals prove the delegation is insecure, the NS set is
+	// not signed
+	in, err = dnssecQuery(port, "www.myhost.ist.nicht.cool.", dns.TypeA)
+	if err != nil {
+		t.Fatal("Query failed:", err)
+	}
+	var nsec *dns.NSEC
+	for _, rr := range in.Ns {
+		if rr.Header().Rrtype == dns.TypeNSEC {
+			nsec = rr.(*dns.NSEC)
+		}
+		if sig, ok := rr.(*dns.RRSIG); ok && sig.TypeCovered == dns.TypeNS {
+			t.Error("Delegation NS set was signed")
+		}
+	}
+	if nsec == nil || countType(in.Ns, dns.TypeRRSIG) != 1 ||
+		!reflect.DeepEqual(nsec.TypeBitMap, []uint16{dns.TypeNS, dns.TypeRRSIG, dns.TypeNSEC}) {
+		t.Error("Unexpected signed referral:", in.Ns)
+	}
+
+	// Offline delegations in parking mode are no longer delegated
+	db.SaveEntry(&Entry{
+		Hostname:    "myhost.ist.nicht.cool.",
+		Ip4s:        []net.IP{net.ParseIP("192.168.0.1")},
+		Nss:         []string{"ns.example.org."},
+		Offline:     true,
+		OfflineMode: OfflineParking,
+	})
+	in, err = dnsQuery(port, "myhost.ist.nicht.cool.", dns.TypeA)
+	if err != nil || !in.Authoritative || countType(in.Ns, dns.TypeNS) != 0 {
+		t.Error("Offline delegation still refers:", in, err)
+	}
+}
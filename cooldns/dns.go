@@ -18,11 +18,33 @@ package cooldns
 
 import (
 	"code.google.com/p/go.net/idna"
+	"crypto/tls"
+	"fmt"
 	"github.com/miekg/dns"
 	"log"
+	"net"
+	"strings"
 	"time"
 )
 
+// SOA timers announced for the zone. The minimum TTL is also used as the
+// TTL of negative answers (RFC 2308).
+const (
+	soaRefresh uint32 = 3600
+	soaRetry   uint32 = 600
+	soaExpire  uint32 = 604800
+	soaMinttl  uint32 = 60
+	// TTL of the SOA and NS records at the zone apex
+	apexTtl uint32 = 3600
+)
+
+// Defaults for the TTL of entries
+const (
+	defaultTtl    uint32 = 60
+	defaultMinTtl uint32 = 10
+	defaultMaxTtl uint32 = 86400
+)
+
 // Configuration for the DNS server
 type DnsServerConfig struct {
 	Domain string // fqdn of the full Domain name
@@ -30,112 +52,654 @@ type DnsServerConfig struct {
 	// Tsig Key according to the tsig spec (base64 string)
 	// If not set, tsig will not be activated.
 	TsigKey string
+	// Name servers announced in the NS set of the zone apex. The first one
+	// is used as the primary master in the SOA record.
+	// Default is "ns.<Domain>"
+	Nameservers []string
+	// Responsible mailbox in the SOA record. Default is "hostmaster.<Domain>"
+	Hostmaster string
+	// TTL of entries that do not set their own. Default is 60 seconds
+	DefaultTtl uint32
+	// Bounds for the TTL of entries. Default is 10 seconds up to one day.
+	MinTtl, MaxTtl uint32
+	// Secondaries (<host>:<port>) that are notified about every change
+	Notify []string
+	// Directory with the DNSSEC keys of the zone in BIND format.
+	// If not set, the zone is not signed.
+	DnssecKeys string
+	// Certificate and key files (PEM) for DNS over TLS.
+	// If not set, DNS over TLS will not be activated.
+	TlsCert, TlsKey string
+	// DNS over TLS listener <interface>:<port>. Default is ":853"
+	TlsListen string
+	// Address prefixes (CIDR) served as reverse zones with PTR records for
+	// the addresses of entries that opt in. IPv4 prefixes must end at an
+	// octet, IPv6 prefixes at a nibble boundary.
+	ReversePrefixes []string
+	// Addresses or a host name that offline entries in OfflineParking
+	// mode answer with
+	Parking []string
+	// Further zones with their own settings. Domain is served with the
+	// settings above unless it is listed.
+	Zones []*ZoneConfig
+	// Responses per second and client prefix that are sent over UDP for
+	// each kind of response (Response Rate Limiting). If not set, responses
+	// are not limited.
+	RrlRate uint32
+	// Every RrlSlip-th limited response is sent truncated instead of being
+	// dropped. Default is 2, a negative value never slips.
+	RrlSlip int
+	// Destination of the query log: a file, "-" for stdout or
+	// "unix:<path>" for a Frame Streams socket. If not set, queries are
+	// not logged.
+	QueryLog string
+	// Format of the query log, QueryLogDnstap (default) or QueryLogJson
+	QueryLogFormat string
+	// Only every n-th query is logged. Default is 1, all queries.
+	QueryLogSample int
+	// Views answering with the addresses entries have for them
+	Views []*ViewConfig
+	// Primary (<host>:<port>) the zones are transferred from. If set, the
+	// server is a read-only secondary and the database must be a
+	// SecondaryCoolDB.
+	Primary string
+	// Answers to version.bind and version.server, hostname.bind and
+	// id.server in class CHAOS. Queries are refused if not set.
+	Version, ServerId string
+	// Answer names with an embedded address, like 10-0-0-5.ip.<zone>,
+	// without an entry
+	IpNames bool
 }
 
 // Hold a pointer to the actual DnsDB within the CoolDB object
 type dnsHandler struct {
 	db                      CoolDB
 	domain, listen, tsigkey string
+	nameservers             []string
+	hostmaster              string
+	// Forward zones, the zone of domain first
+	zones []*dnsZone
+	// TSIG keys of the zone and all hosts
+	keyring *tsigKeyring
+	// DNS over TLS listener and its configuration
+	tlsListen string
+	tlsConfig *tls.Config
+	// Names of the reverse zones
+	reverseZones []string
+	// Answer of offline entries in OfflineParking mode
+	parking *parking
+	// Response rate limiting, nil if disabled
+	rrl *rateLimiter
+	// Query log, nil if disabled
+	queryLog *queryLogger
+	// Views in the order they are matched
+	views []*dnsView
+	// Next answers of entries in AnswerRoundRobin mode
+	rotation *rotation
+	// Transfers of the zones from the primary, nil if this is the primary
+	secondary *secondary
+	// Identification of the server in class CHAOS
+	version, serverId string
+	// Answer names with an embedded address below ip.<zone>
+	ipNames bool
 	// Metrics Handle
 	metric MetricsHandle
 }
 
+// Start of authority for a zone
+func (h *dnsHandler) soa(zone string) *dns.SOA {
+	// Secondaries announce the SOA of the primary
+	if h.secondary != nil {
+		if soa := h.secondary.db.soa(zone); soa != nil {
+			return soa
+		}
+	}
+	return &dns.SOA{
+		Hdr: dns.RR_Header{Name: zone,
+			Rrtype: dns.TypeSOA,
+			Class:  dns.ClassINET,
+			Ttl:    apexTtl},
+		Ns:      h.nameservers[0],
+		Mbox:    h.hostmaster,
+		Serial:  h.db.Serial(),
+		Refresh: soaRefresh,
+		Retry:   soaRetry,
+		Expire:  soaExpire,
+		Minttl:  soaMinttl,
+	}
+}
+
+// Name server set of the apex of a zone
+func (h *dnsHandler) ns(zone string) []dns.RR {
+	var rrs []dns.RR
+	for _, nameserver := range h.nameservers {
+		rr := new(dns.NS)
+		rr.Hdr = dns.RR_Header{Name: zone,
+			Rrtype: dns.TypeNS,
+			Class:  dns.ClassINET,
+			Ttl:    apexTtl}
+		rr.Ns = nameserver
+		rrs = append(rrs, rr)
+	}
+	return rrs
+}
+
+// SOA record of a zone for the authority section of negative answers.
+// According to RFC 2308 its TTL is the minimum of the SOA TTL and the
+// minimum field.
+func (h *dnsHandler) negativeSoa(zone string) *dns.SOA {
+	soa := h.soa(zone)
+	soa.Hdr.Ttl = soaMinttl
+	return soa
+}
+
+// Records of the apex of a zone for the given type. All zones share the
+// name servers, reverse zones are not signed.
+func (h *dnsHandler) apexRecords(zone string, qtype uint16) []dns.RR {
+	switch qtype {
+	case dns.TypeSOA:
+		return []dns.RR{h.soa(zone)}
+	case dns.TypeNS:
+		return h.ns(zone)
+	case dns.TypeDNSKEY:
+		if signer := h.signer(zone); signer != nil {
+			return signer.dnskeys()
+		}
+	}
+	return nil
+}
+
+// Types present at the apex of a zone
+func (h *dnsHandler) apexTypes(zone string) []uint16 {
+	types := []uint16{dns.TypeSOA, dns.TypeNS}
+	if h.signer(zone) != nil {
+		types = append(types, dns.TypeDNSKEY)
+	}
+	return types
+}
+
+// Zone a name belongs to, empty if the server is not authoritative for it
+func (h *dnsHandler) zoneOf(name string) string {
+	if zone := h.zone(name); zone != nil {
+		return zone.domain
+	}
+	name = strings.ToLower(name)
+	for _, zone := range h.reverseZones {
+		if dns.IsSubDomain(zone, name) {
+			return zone
+		}
+	}
+	return ""
+}
+
+// Name of the reverse zone of an address prefix
+func reverseZone(prefix string) (string, error) {
+	_, ipnet, err := net.ParseCIDR(prefix)
+	if err != nil {
+		return "", err
+	}
+	ones, bits := ipnet.Mask.Size()
+	// Bits per label, octets for IPv4 and nibbles for IPv6
+	step := 4
+	if bits == 32 {
+		step = 8
+	}
+	if ones == 0 || ones%step != 0 {
+		return "", fmt.Errorf("Length of prefix %s is not a multiple of %d", prefix, step)
+	}
+	name, err := dns.ReverseAddr(ipnet.IP.String())
+	if err != nil {
+		return "", err
+	}
+	// Keep the labels of the prefix and in-addr.arpa or ip6.arpa
+	labels := dns.SplitDomainName(name)
+	return dns.Fqdn(strings.Join(labels[len(labels)-ones/step-2:], ".")), nil
+}
+
+// TTL of all records of an entry, limited to the bounds of its zone
+func (h *dnsHandler) ttl(entry *Entry) uint32 {
+	zone := h.zone(ownerName(entry))
+	if zone == nil {
+		// Entries of zones that are no longer served
+		zone = h.zones[0]
+	}
+	ttl := entry.Ttl
+	if ttl == 0 {
+		ttl = zone.defaultTtl
+	}
+	if ttl < zone.minTtl {
+		return zone.minTtl
+	}
+	if ttl > zone.maxTtl {
+		return zone.maxTtl
+	}
+	return ttl
+}
+
+// Records of an entry for the given type, owned by name. If the entry is an
+// alias only the CNAME is returned, the alias address is not resolved.
+func (h *dnsHandler) entryRecords(entry *Entry, name string, qtype uint16) []dns.RR {
+	var rrs []dns.RR
+	ttl := h.ttl(entry)
+	if entry.Cname != "" {
+		cname := new(dns.CNAME)
+		cname.Hdr = dns.RR_Header{Name: name,
+			Rrtype: dns.TypeCNAME,
+			Class:  dns.ClassINET,
+			Ttl:    ttl}
+		cname.Target = entry.Cname
+		return append(rrs, cname)
+	}
+
+	switch qtype {
+	case dns.TypeAAAA:
+		for _, ip6 := range entry.Ip6s {
+			rr := new(dns.AAAA)
+			rr.Hdr = dns.RR_Header{Name: name,
+				Rrtype: dns.TypeAAAA,
+				Class:  dns.ClassINET,
+				Ttl:    ttl}
+			rr.AAAA = ip6
+			rrs = append(rrs, rr)
+		}
+	case dns.TypeA:
+		for _, ip4 := range entry.Ip4s {
+			rr := new(dns.A)
+			rr.Hdr = dns.RR_Header{Name: name,
+				Rrtype: dns.TypeA,
+				Class:  dns.ClassINET,
+				Ttl:    ttl}
+			rr.A = ip4
+			rrs = append(rrs, rr)
+		}
+	case dns.TypeTXT:
+		if len(entry.Txts) == 0 {
+			break
+		}
+		t := new(dns.TXT)
+		t.Hdr = dns.RR_Header{Name: name,
+			Rrtype: dns.TypeTXT,
+			Class:  dns.ClassINET,
+			Ttl:    ttl}
+		t.Txt = entry.Txts
+		rrs = append(rrs, t)
+	case dns.TypeMX:
+		for _, emx := range entry.Mxs {
+			mx := new(dns.MX)
+			mx.Hdr = dns.RR_Header{Name: name,
+				Rrtype: dns.TypeMX,
+				Class:  dns.ClassINET,
+				Ttl:    ttl}
+			mx.Mx = emx.ip
+			mx.Preference = uint16(emx.priority)
+			rrs = append(rrs, mx)
+		}
+	default:
+		rrs = h.rdataRecords(entry, "", name, qtype)
+	}
+	return rrs
+}
+
+// All records of an entry
+func (h *dnsHandler) allRecords(entry *Entry, name string) []dns.RR {
+	if entry.Cname != "" {
+		return h.entryRecords(entry, name, dns.TypeCNAME)
+	}
+	var rrs []dns.RR
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA, dns.TypeMX, dns.TypeTXT} {
+		rrs = append(rrs, h.entryRecords(entry, name, qtype)...)
+	}
+	return append(rrs, h.ownerRecords(entry, "", name)...)
+}
+
+// Types present in a list of records
+func recordTypes(rrs []dns.RR) []uint16 {
+	var types []uint16
+	for _, rr := range rrs {
+		if len(types) == 0 || types[len(types)-1] != rr.Header().Rrtype {
+			types = append(types, rr.Header().Rrtype)
+		}
+	}
+	return types
+}
+
+// Longest chain of aliases that is followed within the zone
+const maxCnameChain = 8
+
+// UDP payload size announced in EDNS0 answers. Larger UDP answers are not
+// sent, as recommended by the DNS flag day 2020.
+const ednsSize uint16 = 1232
+
+// Largest UDP answer the client of a query accepts according to RFC 6891
+func udpSize(r *dns.Msg) int {
+	opt := r.IsEdns0()
+	if opt == nil || opt.UDPSize() < dns.MinMsgSize {
+		return dns.MinMsgSize
+	}
+	if opt.UDPSize() > ednsSize {
+		return int(ednsSize)
+	}
+	return int(opt.UDPSize())
+}
+
+// Length of the TSIG record an answer is signed with
+func tsigLen(name string) int {
+	return dns.Len(&dns.TSIG{
+		Hdr: dns.RR_Header{Name: name,
+			Rrtype: dns.TypeTSIG,
+			Class:  dns.ClassANY},
+		Algorithm: dns.HmacSHA256,
+		MACSize:   32,
+		MAC:       strings.Repeat("00", 32),
+	})
+}
+
+// Rcode of the answer to queries that are not answered with data,
+// RcodeSuccess if the query is answered.
+func (h *dnsHandler) checkQuery(r *dns.Msg) int {
+	if r.Opcode != dns.OpcodeQuery {
+		return dns.RcodeNotImplemented
+	}
+	if len(r.Question) != 1 {
+		return dns.RcodeFormatError
+	}
+	// At most one OPT record is allowed
+	opts := 0
+	for _, rr := range r.Extra {
+		if rr.Header().Rrtype == dns.TypeOPT {
+			opts++
+		}
+	}
+	if opts > 1 {
+		return dns.RcodeFormatError
+	}
+	question := r.Question[0]
+	switch question.Qtype {
+	case dns.TypeOPT, dns.TypeTSIG, dns.TypeTKEY:
+		// Only valid in the additional section
+		return dns.RcodeFormatError
+	case dns.TypeMAILA, dns.TypeMAILB:
+		return dns.RcodeNotImplemented
+	}
+	if question.Qclass == dns.ClassCHAOS {
+		if h.chaosTxt(question.Name) == "" {
+			return dns.RcodeRefused
+		}
+		return dns.RcodeSuccess
+	}
+	if question.Qclass != dns.ClassINET && question.Qclass != dns.ClassANY {
+		return dns.RcodeRefused
+	}
+	zone := h.zoneOf(question.Name)
+	if zone == "" {
+		return dns.RcodeRefused
+	}
+	// Secondaries stop answering once the data of the zone has expired
+	if h.secondary != nil && !h.secondary.serving(zone) {
+		return dns.RcodeServerFailure
+	}
+	return dns.RcodeSuccess
+}
+
+// Minimal answer to ANY queries according to RFC 8482. Aliases answer
+// with their CNAME, other names with a synthesized HINFO record.
+func anyAnswer(rrs []dns.RR) []dns.RR {
+	if len(rrs) == 0 {
+		return nil
+	}
+	if cname, ok := rrs[0].(*dns.CNAME); ok {
+		return []dns.RR{cname}
+	}
+	hinfo := new(dns.HINFO)
+	hinfo.Hdr = dns.RR_Header{Name: rrs[0].Header().Name,
+		Rrtype: dns.TypeHINFO,
+		Class:  dns.ClassINET,
+		Ttl:    rrs[0].Header().Ttl}
+	hinfo.Cpu = "RFC8482"
+	return []dns.RR{hinfo}
+}
+
+// PTR records of a name in a reverse zone
+func (h *dnsHandler) reverseRecords(qname string) (rrs []dns.RR, exists bool) {
+	hostnames, exists := h.db.LookupReverse(strings.ToLower(qname))
+	for _, hostname := range hostnames {
+		entry := h.db.GetEntry(hostname)
+		if entry == nil {
+			continue
+		}
+		ptr := new(dns.PTR)
+		ptr.Hdr = dns.RR_Header{Name: qname,
+			Rrtype: dns.TypePTR,
+			Class:  dns.ClassINET,
+			Ttl:    h.ttl(entry)}
+		ptr.Ptr = ownerName(entry)
+		rrs = append(rrs, ptr)
+	}
+	return rrs, exists
+}
+
+// Look up the entry of a name, see DnsDB.Lookup
+func (h *dnsHandler) lookupEntry(name string) (*Entry, string, bool) {
+	return h.db.LookupEntry(storedName(name))
+}
+
+// Names are stored in lower case and internationalized names in Unicode,
+// names on the wire are in puny code
+func storedName(name string) string {
+	name = strings.ToLower(name)
+	uName, err := idna.ToUnicode(name)
+	if err == nil {
+		return uName
+	}
+	return name
+}
+
+// Look up the records of a name in a zone. types are the types present
+// at the name, exists is false if the name does not exist at all.
+func (h *dnsHandler) lookup(zone, qname, view string, client net.IP, qtype uint16) (answer []dns.RR, types []uint16, exists bool) {
+	var all []dns.RR
+	name := strings.ToLower(qname)
+	if name == zone {
+		for _, rrtype := range h.apexTypes(zone) {
+			all = append(all, h.apexRecords(zone, rrtype)...)
+		}
+		answer = h.apexRecords(zone, qtype)
+	} else if isHealthName(zone, name) {
+		all = []dns.RR{h.healthRecord(zone)}
+		if qtype == dns.TypeTXT {
+			answer = all
+		}
+	} else if h.forwardZone(zone) != nil && isMyIpName(zone, name) {
+		entry := myIpEntry(qname, client)
+		answer = uncached(h.entryRecords(entry, qname, qtype))
+		all = uncached(h.allRecords(entry, qname))
+	} else if h.ipNames && h.forwardZone(zone) != nil && isIpName(zone, name) {
+		entry := ipNameEntry(zone, name)
+		// ip.<zone> itself exists without data
+		if entry == nil {
+			return nil, nil, name == ipNamesLabel+"."+zone
+		}
+		answer = h.entryRecords(entry, qname, qtype)
+		all = h.allRecords(entry, qname)
+	} else if h.forwardZone(zone) == nil {
+		all, exists = h.reverseRecords(qname)
+		if !exists {
+			return nil, nil, false
+		}
+		if qtype == dns.TypePTR {
+			answer = all
+		}
+	} else {
+		var (
+			entry *Entry
+			owner string
+		)
+		entry, owner, exists = h.lookupEntry(name)
+		// Empty non-terminals have no entry and no data
+		if !exists || entry == nil {
+			return nil, nil, exists
+		}
+		entry = h.servedEntry(entry.inView(view))
+		if entry == nil {
+			return nil, nil, false
+		}
+		if owner != "" {
+			answer = h.rdataRecords(entry, owner, qname, qtype)
+			all = h.ownerRecords(entry, owner, qname)
+		} else {
+			answer = h.order(entry, h.entryRecords(entry, qname, qtype))
+			all = h.allRecords(entry, qname)
+		}
+	}
+	if qtype == dns.TypeANY {
+		answer = anyAnswer(all)
+	}
+	return answer, recordTypes(all), true
+}
+
 func (h *dnsHandler) handleRequest(w dns.ResponseWriter, r *dns.Msg) {
 	h.metric.DnsEvent()
+	if r.Opcode == dns.OpcodeUpdate {
+		h.handleUpdate(w, r)
+		return
+	}
+	if r.Opcode == dns.OpcodeNotify && h.secondary != nil {
+		h.handleNotify(w, r)
+		return
+	}
 	m := new(dns.Msg)
+	opt := r.IsEdns0()
+	rcode := h.checkQuery(r)
+	if rcode == dns.RcodeSuccess && opt != nil && opt.Version() != 0 {
+		rcode = dns.RcodeBadVers
+	}
+	if rcode != dns.RcodeSuccess {
+		m.SetRcode(r, rcode)
+		if opt != nil {
+			m.SetEdns0(ednsSize, false)
+		}
+		if tsig := r.IsTsig(); tsig != nil && w.TsigStatus() == nil {
+			m.SetTsig(tsig.Hdr.Name, tsig.Algorithm, 300, time.Now().Unix())
+		}
+		if !h.limit(w, "", m) {
+			return
+		}
+		err := w.WriteMsg(m)
+		if err != nil {
+			log.Println("WOOPS ERRRROOOORR:", err)
+		}
+		return
+	}
+	question := r.Question[0]
+	if question.Qclass == dns.ClassCHAOS {
+		h.handleChaos(w, r)
+		return
+	}
+	if question.Qtype == dns.TypeAXFR || question.Qtype == dns.TypeIXFR {
+		h.handleTransfer(w, r)
+		return
+	}
+	zone := h.zoneOf(question.Name)
 	m.SetReply(r)
+	m.Authoritative = true
+	// Sign the answer if the client asks for DNSSEC records
+	signer := h.signer(zone)
+	dnssec := opt != nil && opt.Do() && signer != nil
+	if opt != nil {
+		m.SetEdns0(ednsSize, dnssec)
+	}
 	defer func(w dns.ResponseWriter, m *dns.Msg) {
+		if !h.limit(w, zone, m) {
+			return
+		}
+		if dnssec {
+			m.Answer = signer.signSection(m.Answer)
+			m.Ns = signer.signSection(m.Ns)
+		}
+		// Answers that do not fit are truncated, the client then
+		// retries over TCP
+		if w.RemoteAddr().Network() == "udp" {
+			size := udpSize(r)
+			if h.tsigkey != "" {
+				size -= tsigLen(h.domain)
+			}
+			m.Truncate(size)
+		}
+		if h.tsigkey != "" {
+			m.SetTsig(h.domain, dns.HmacSHA256, 300, time.Now().Unix())
+		}
 		err := w.WriteMsg(m)
 		if err != nil {
 			log.Println("WOOPS ERRRROOOORR:", err)
 		}
 	}(w, m)
-	if h.tsigkey != "" {
-		m.SetTsig(h.domain, dns.HmacSHA256, 300, time.Now().Unix())
-	}
 
-	for _, question := range r.Question {
-		var entry *Entry
-		// try to convert to puny code
-		qName, err := idna.ToUnicode(question.Name)
-		if err == nil {
-			entry = h.db.GetEntry(qName)
-		} else {
-			entry = h.db.GetEntry(question.Name)
-		}
-		if entry == nil {
+	// Aliases are followed as long as their targets are in the zone, the
+	// answer then ends like the answer for the last target (RFC 6604).
+	name := question.Name
+	if isHealthName(zone, name) {
+		if m.Rcode = h.healthRcode(); m.Rcode != dns.RcodeSuccess {
 			return
 		}
-		// if CNAME exists use it and return. Do not resolve alias
-		// address
-		if entry.Cname != "" {
-			cname := new(dns.CNAME)
-			cname.Hdr = dns.RR_Header{Name: entry.Hostname,
-				Rrtype: dns.TypeCNAME,
-				Class:  dns.ClassINET,
-				Ttl:    0}
-			cname.Target = entry.Cname
-			m.Answer = append(m.Answer, cname)
+	}
+	view := h.view(w, r)
+	client, _ := clientAddr(w.RemoteAddr())
+	seen := make(map[string]bool)
+	for {
+		seen[strings.ToLower(name)] = true
+		if entry := h.delegation(zone, name, view); entry != nil {
+			h.referral(m, zone, name, question.Qtype, entry, dnssec)
 			return
 		}
-
-		switch question.Qtype {
-		case dns.TypeAAAA:
-			for _, ip6 := range entry.Ip6s {
-				rr := new(dns.AAAA)
-				rr.Hdr = dns.RR_Header{Name: entry.Hostname,
-					Rrtype: dns.TypeAAAA,
-					Class:  dns.ClassINET,
-					Ttl:    0}
-				rr.AAAA = ip6
-				m.Answer = append(m.Answer, rr)
-			}
-		case dns.TypeA:
-			for _, ip4 := range entry.Ip4s {
-				rr := new(dns.A)
-				rr.Hdr = dns.RR_Header{Name: entry.Hostname,
-					Rrtype: dns.TypeA,
-					Class:  dns.ClassINET,
-					Ttl:    0}
-				rr.A = ip4
-				m.Answer = append(m.Answer, rr)
+		answer, types, exists := h.lookup(zone, name, view, client, question.Qtype)
+		// The name does not exist in the zone, deny it with
+		// the SOA in the authority section.
+		if !exists {
+			m.Ns = append(m.Ns, h.negativeSoa(zone))
+			if dnssec {
+				// Compact denial answers NOERROR, the NSEC
+				// record tells the name is missing
+				m.Ns = append(m.Ns, nsecCompact(name, []uint16{dns.TypeNXNAME}))
+			} else {
+				m.Rcode = dns.RcodeNameError
 			}
-		case dns.TypeTXT:
-			t := new(dns.TXT)
-			t.Hdr = dns.RR_Header{Name: entry.Hostname,
-				Rrtype: dns.TypeTXT,
-				Class:  dns.ClassINET,
-				Ttl:    0}
-			if len(entry.Txts) == 0 {
-				break
-			}
-			t.Txt = entry.Txts
-			m.Answer = append(m.Answer, t)
-		case dns.TypeMX:
-			for _, emx := range entry.Mxs {
-				mx := new(dns.MX)
-				mx.Hdr = dns.RR_Header{Name: entry.Hostname,
-					Rrtype: dns.TypeMX,
-					Class:  dns.ClassINET,
-					Ttl:    0}
-				mx.Mx = emx.ip
-				mx.Preference = uint16(emx.priority)
-				m.Answer = append(m.Answer, mx)
+			return
+		}
+		// The name exists but has no data for the type (NODATA)
+		if len(answer) == 0 {
+			m.Ns = append(m.Ns, h.negativeSoa(zone))
+			if dnssec {
+				m.Ns = append(m.Ns, nsecCompact(name, types))
 			}
+			return
 		}
-	}
-	return
+		m.Answer = append(m.Answer, answer...)
 
+		cname, ok := answer[0].(*dns.CNAME)
+		if !ok || question.Qtype == dns.TypeCNAME || question.Qtype == dns.TypeANY ||
+			len(seen) > maxCnameChain {
+			return
+		}
+		target := strings.ToLower(cname.Target)
+		if seen[target] || h.zoneOf(target) != zone {
+			return
+		}
+		name = cname.Target
+	}
 }
 
-// Takes Either tcp or udp string
+// Takes Either tcp, udp or tcp-tls string
 func (h *dnsHandler) serve(net string) {
-	server := &dns.Server{Pool: false,
-		Addr: h.listen,
-		Net:  net,
-		TsigSecret: map[string]string{
-			h.domain: h.tsigkey,
-		},
+	server := &dns.Server{
+		Addr:          h.listen,
+		Net:           net,
+		TsigProvider:  h.keyring,
+		MsgAcceptFunc: acceptMsg,
+		Handler:       h.handler(net),
+	}
+	if net == "tcp-tls" {
+		server.Addr = h.tlsListen
+		server.TLSConfig = h.tlsConfig
 	}
 	err := server.ListenAndServe()
 	if err != nil {
@@ -146,8 +710,53 @@ func (h *dnsHandler) serve(net string) {
 // Run DNS Server with given config.
 //
 // A configuration is sufficient if it contains a Domain name, a db mustbe
-// supplied but the metricsHandle can be nil
-func RunDns(config *DnsServerConfig, db CoolDB, metric MetricsHandle) {
+// supplied but the metricsHandle can be nil. The returned Resolver answers
+// queries that arrive by other means, like DNS over HTTPS.
+func RunDns(config *DnsServerConfig, db CoolDB, metric MetricsHandle) Resolver {
+	h := newDnsHandler(config, db, metric)
+
+	if config.QueryLog != "" {
+		var err error
+		h.queryLog, err = newQueryLogger(config.QueryLog, config.QueryLogFormat, config.QueryLogSample)
+		if err != nil {
+			log.Fatal("Failed to setup the query log:", err)
+		}
+	}
+
+	if len(config.Notify) != 0 {
+		newNotifier(h, config.Notify)
+	}
+
+	if config.Primary != "" {
+		if err := checkSecondaryConfig(config); err != nil {
+			log.Fatal(err)
+		}
+		h.secondary = newSecondary(h, config.Primary)
+	}
+
+	if config.TlsCert != "" && config.TlsKey != "" {
+		cert, err := tls.LoadX509KeyPair(config.TlsCert, config.TlsKey)
+		if err != nil {
+			log.Fatal("Failed to load DNS over TLS certificate:", err)
+		}
+		h.tlsConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+		if config.TlsListen != "" {
+			h.tlsListen = config.TlsListen
+		} else {
+			h.tlsListen = ":853"
+		}
+	}
+
+	go h.serve("udp")
+	go h.serve("tcp")
+	if h.tlsConfig != nil {
+		go h.serve("tcp-tls")
+	}
+	return h
+}
+
+// The handler of the zones of a configuration without any listeners
+func newDnsHandler(config *DnsServerConfig, db CoolDB, metric MetricsHandle) *dnsHandler {
 	h := new(dnsHandler)
 	if db == nil {
 		log.Fatal("No database supplied")
@@ -171,9 +780,77 @@ func RunDns(config *DnsServerConfig, db CoolDB, metric MetricsHandle) {
 		h.listen = ":8053"
 	}
 
+	h.version = config.Version
+	h.serverId = config.ServerId
+	h.ipNames = config.IpNames
+
 	h.tsigkey = config.TsigKey
+	h.keyring = &tsigKeyring{db: db, secret: h.tsigkey}
 
-	dns.HandleFunc(config.Domain, h.handleRequest)
-	go h.serve("udp")
-	go h.serve("tcp")
+	if len(config.Nameservers) != 0 {
+		h.nameservers = config.Nameservers
+	} else {
+		h.nameservers = []string{"ns." + config.Domain}
+	}
+
+	if config.Hostmaster != "" {
+		h.hostmaster = config.Hostmaster
+	} else {
+		h.hostmaster = "hostmaster." + config.Domain
+	}
+	for _, zone := range zoneConfigs(h.domain, config.Zones) {
+		h.zones = append(h.zones, newDnsZone(zone, config))
+	}
+	h.keyring.zones = h.zones
+
+	// Zones are signed if there are keys for them, the zone of the domain
+	// must have keys
+	for i, zone := range h.zones {
+		if config.DnssecKeys == "" {
+			break
+		}
+		if i != 0 {
+			if keys, err := loadKeys(config.DnssecKeys, zone.domain); err != nil || len(keys) == 0 {
+				continue
+			}
+		}
+		var err error
+		zone.signer, err = newDnssecSigner(config.DnssecKeys, zone.domain)
+		if err != nil {
+			log.Fatal("Failed to load DNSSEC keys:", err)
+		}
+	}
+
+	for _, prefix := range config.ReversePrefixes {
+		zone, err := reverseZone(prefix)
+		if err != nil {
+			log.Fatal("Malformatted reverse prefix:", err)
+		}
+		h.reverseZones = append(h.reverseZones, zone)
+	}
+
+	var err error
+	h.parking, err = newParking(config.Parking)
+	if err != nil {
+		log.Fatal("Malformatted parking:", err)
+	}
+
+	if config.RrlRate != 0 {
+		slip := config.RrlSlip
+		if slip == 0 {
+			slip = defaultRrlSlip
+		}
+		h.rrl = newRateLimiter(config.RrlRate, slip)
+	}
+
+	h.rotation = newRotation()
+
+	for _, view := range config.Views {
+		v, err := newDnsView(view)
+		if err != nil {
+			log.Fatal("Malformatted view:", err)
+		}
+		h.views = append(h.views, v)
+	}
+	return h
 }
@@ -17,15 +17,36 @@
 package cooldns
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
 	"fmt"
+	"github.com/miekg/dns"
+	"io/ioutil"
+	"math/big"
 	"net"
 	"os/exec"
+	"path/filepath"
+	"reflect"
 	"strings"
 	"testing"
+	"time"
 )
 
 // start a server on a random interface with a db instance and return tcp and udp port
 func startDnsServer(db CoolDB, key string) string {
+	return startDnsServerConfig(db, &DnsServerConfig{
+		Domain:  "ist.nicht.cool.",
+		TsigKey: key,
+	})
+}
+
+// start a server with the given configuration on a random port
+func startDnsServerConfig(db CoolDB, conf *DnsServerConfig) string {
 	tcptest, err := net.ListenTCP("tcp", &net.TCPAddr{
 		IP: net.ParseIP("0.0.0.0"),
 	})
@@ -36,11 +57,7 @@ func startDnsServer(db CoolDB, key string) string {
 	fmt.Println("tcpPort:", tcpPort)
 	tcptest.Close()
 
-	conf := &DnsServerConfig{
-		Domain:  "ist.nicht.cool.",
-		Listen:  ":" + tcpPort,
-		TsigKey: key,
-	}
+	conf.Listen = ":" + tcpPort
 	RunDns(conf, db, nil)
 	return tcpPort
 }
@@ -95,6 +112,26 @@ func testDnsReq(port, rrType string, test *Entry) (string, error) {
 	return fmt.Sprintf("%s", out), nil
 }
 
+// Send a question to the server on localhost. The server is started in the
+// background, so we retry a few times before giving up.
+func dnsQuery(port, name string, qtype uint16) (*dns.Msg, error) {
+	m := new(dns.Msg)
+	m.SetQuestion(name, qtype)
+	return dnsExchange(port, m)
+}
+
+func dnsExchange(port string, m *dns.Msg) (in *dns.Msg, err error) {
+	c := new(dns.Client)
+	for i := 0; i < 10; i++ {
+		in, _, err = c.Exchange(m, "127.0.0.1:"+port)
+		if err == nil {
+			return in, nil
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	return nil, err
+}
+
 func splitLines(out string) []string {
 	fields := strings.FieldsFunc(out, func(f rune) bool {
 		return f == '\n' || f == '\r'
@@ -249,3 +286,724 @@ func TestDnsMX(t *testing.T) {
 		}
 	}
 }
+
+func TestDnsApex(t *testing.T) {
+	db, err := getTmpDB()
+	if err != nil {
+		t.Fatal("Failed to create temporary DB")
+	}
+	port := startDnsServer(db, "")
+
+	in, err := dnsQuery(port, "ist.nicht.cool.", dns.TypeSOA)
+	if err != nil {
+		t.Fatal("Failed:", err)
+	}
+	if !in.Authoritative || in.Rcode != dns.RcodeSuccess || len(in.Answer) != 1 {
+		t.Fatalf("Expected authoritative SOA answer, got:\n%v", in)
+	}
+	soa, ok := in.Answer[0].(*dns.SOA)
+	if !ok || soa.Ns != "ns.ist.nicht.cool." || soa.Mbox != "hostmaster.ist.nicht.cool." {
+		t.Errorf("Malformed SOA record: %v", in.Answer[0])
+	}
+
+	in, err = dnsQuery(port, "ist.nicht.cool.", dns.TypeNS)
+	if err != nil {
+		t.Fatal("Failed:", err)
+	}
+	if !in.Authoritative || len(in.Answer) != 1 {
+		t.Fatalf("Expected authoritative NS answer, got:\n%v", in)
+	}
+	if ns, ok := in.Answer[0].(*dns.NS); !ok || ns.Ns != "ns.ist.nicht.cool." {
+		t.Errorf("Malformed NS record: %v", in.Answer[0])
+	}
+}
+
+type dnsNegativeTest struct {
+	Name  string
+	Qtype uint16
+	Rcode int
+}
+
+var dnsnegativetests = []dnsNegativeTest{
+	// Name does not exist
+	dnsNegativeTest{"noexist.ist.nicht.cool.", dns.TypeA, dns.RcodeNameError},
+	dnsNegativeTest{"noexist.ist.nicht.cool.", dns.TypeTXT, dns.RcodeNameError},
+	// Name exists but has no data for the type
+	dnsNegativeTest{"nodata.ist.nicht.cool.", dns.TypeAAAA, dns.RcodeSuccess},
+	dnsNegativeTest{"nodata.ist.nicht.cool.", dns.TypeMX, dns.RcodeSuccess},
+	dnsNegativeTest{"ist.nicht.cool.", dns.TypeA, dns.RcodeSuccess},
+}
+
+func TestDnsNegative(t *testing.T) {
+	db, err := getTmpDB()
+	if err != nil {
+		t.Fatal("Failed to create temporary DB")
+	}
+	port := startDnsServer(db, "")
+	err = db.SaveEntry(&Entry{
+		Hostname: "nodata.ist.nicht.cool.",
+		Ip4s:     []net.IP{net.ParseIP("1.1.1.1")},
+	})
+	if err != nil {
+		t.Fatal("Error saving entry")
+	}
+
+	for _, test := range dnsnegativetests {
+		in, err := dnsQuery(port, test.Name, test.Qtype)
+		if err != nil {
+			t.Fatal("Failed:", err)
+		}
+		if in.Rcode != test.Rcode || !in.Authoritative || len(in.Answer) != 0 {
+			t.Errorf("Wrong negative answer for %v:\n%v", test, in)
+			continue
+		}
+		if len(in.Ns) != 1 {
+			t.Errorf("No SOA in authority section for %v:\n%v", test, in)
+			continue
+		}
+		soa, ok := in.Ns[0].(*dns.SOA)
+		if !ok || soa.Hdr.Ttl != soa.Minttl {
+			t.Errorf("Wrong SOA in authority section for %v: %v", test, in.Ns[0])
+		}
+	}
+}
+
+type dnsTtlTest struct {
+	Ttl, Expected uint32
+}
+
+var dnsttltests = []dnsTtlTest{
+	// Default
+	dnsTtlTest{0, 60},
+	dnsTtlTest{3600, 3600},
+	// Below minimum
+	dnsTtlTest{1, 10},
+	// Above maximum
+	dnsTtlTest{604800, 86400},
+}
+
+func TestDnsTtl(t *testing.T) {
+	db, err := getTmpDB()
+	if err != nil {
+		t.Fatal("Failed to create temporary DB")
+	}
+	port := startDnsServer(db, "")
+
+	for _, test := range dnsttltests {
+		err := db.SaveEntry(&Entry{
+			Hostname: "ttl.ist.nicht.cool.",
+			Ip4s:     []net.IP{net.ParseIP("1.1.1.1")},
+			Txts:     []string{"Hello World"},
+			Ttl:      test.Ttl,
+		})
+		if err != nil {
+			t.Fatal("Error saving entry")
+		}
+		for _, qtype := range []uint16{dns.TypeA, dns.TypeTXT} {
+			in, err := dnsQuery(port, "ttl.ist.nicht.cool.", qtype)
+			if err != nil {
+				t.Fatal("Failed:", err)
+			}
+			if len(in.Answer) != 1 || in.Answer[0].Header().Ttl != test.Expected {
+				t.Errorf("Expected TTL %d for %v, got:\n%v", test.Expected, test, in)
+			}
+		}
+	}
+}
+
+func TestDnsWildcard(t *testing.T) {
+	db, err := getTmpDB()
+	if err != nil {
+		t.Fatal("Failed to create temporary DB")
+	}
+	port := startDnsServer(db, "")
+	db.SaveEntry(&Entry{
+		Hostname: "wild.ist.nicht.cool.",
+		Ip4s:     []net.IP{net.ParseIP("192.168.0.1")},
+		Wildcard: true,
+	})
+	db.SaveEntry(&Entry{
+		Hostname: "explicit.wild.ist.nicht.cool.",
+		Ip4s:     []net.IP{net.ParseIP("192.168.0.2")},
+	})
+
+	// Synthesized records are owned by the query name
+	in, err := dnsQuery(port, "Git.wild.ist.nicht.cool.", dns.TypeA)
+	if err != nil {
+		t.Fatal("Failed:", err)
+	}
+	if len(in.Answer) != 1 || in.Answer[0].Header().Name != "Git.wild.ist.nicht.cool." ||
+		in.Answer[0].(*dns.A).A.String() != "192.168.0.1" {
+		t.Error("Wildcard was not expanded:", in)
+	}
+	in, err = dnsQuery(port, "explicit.wild.ist.nicht.cool.", dns.TypeA)
+	if err != nil {
+		t.Fatal("Failed:", err)
+	}
+	if len(in.Answer) != 1 || in.Answer[0].(*dns.A).A.String() != "192.168.0.2" {
+		t.Error("Explicit entry did not win over the wildcard:", in)
+	}
+	in, err = dnsQuery(port, "x.explicit.wild.ist.nicht.cool.", dns.TypeA)
+	if err != nil {
+		t.Fatal("Failed:", err)
+	}
+	if in.Rcode != dns.RcodeNameError {
+		t.Error("Wildcard matched below an explicit entry:", in)
+	}
+
+	// Turning the wildcard off removes the synthesized names
+	db.SaveEntry(&Entry{
+		Hostname: "wild.ist.nicht.cool.",
+		Ip4s:     []net.IP{net.ParseIP("192.168.0.1")},
+	})
+	in, err = dnsQuery(port, "git.wild.ist.nicht.cool.", dns.TypeA)
+	if err != nil {
+		t.Fatal("Failed:", err)
+	}
+	if in.Rcode != dns.RcodeNameError {
+		t.Error("Disabled wildcard still answers:", in)
+	}
+}
+
+func TestDnsRecords(t *testing.T) {
+	db, err := getTmpDB()
+	if err != nil {
+		t.Fatal("Failed to create temporary DB")
+	}
+	port := startDnsServer(db, "")
+	db.SaveEntry(&Entry{
+		Hostname: "records.ist.nicht.cool.",
+		Ip4s:     []net.IP{net.ParseIP("192.168.0.1")},
+		Srvs:     []string{"_sip._udp 10 5 5060 sip.ist.nicht.cool."},
+		Caas:     []string{`0 issue "letsencrypt.org"`},
+		Ptrs:     []string{"host.ist.nicht.cool."},
+		Sshfps:   []string{"4 2 0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"},
+		Tlsas:    []string{"_443._tcp 3 1 1 0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"},
+		Https:    []string{"1 . alpn=h2,h3"},
+		Svcbs:    []string{"_dns 1 . alpn=dot"},
+		Ttl:      300,
+	})
+
+	tests := []struct {
+		name   string
+		qtype  uint16
+		answer string
+	}{
+		{"_sip._udp.records.ist.nicht.cool.", dns.TypeSRV, "10 5 5060 sip.ist.nicht.cool."},
+		{"records.ist.nicht.cool.", dns.TypeCAA, `0 issue "letsencrypt.org"`},
+		{"records.ist.nicht.cool.", dns.TypePTR, "host.ist.nicht.cool."},
+		{"records.ist.nicht.cool.", dns.TypeSSHFP, "4 2 0123456789ABCDEF0123456789ABCDEF0123456789ABCDEF0123456789ABCDEF"},
+		{"_443._tcp.records.ist.nicht.cool.", dns.TypeTLSA, "3 1 1 0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"},
+		{"records.ist.nicht.cool.", dns.TypeHTTPS, `1 . alpn="h2,h3"`},
+		{"_dns.records.ist.nicht.cool.", dns.TypeSVCB, `1 . alpn="dot"`},
+	}
+	for _, test := range tests {
+		in, err := dnsQuery(port, test.name, test.qtype)
+		if err != nil {
+			t.Fatal("Failed:", err)
+		}
+		if len(in.Answer) != 1 {
+			t.Errorf("%s %s: unexpected answer: %v", test.name, dns.TypeToString[test.qtype], in)
+			continue
+		}
+		hdr := in.Answer[0].Header()
+		data := strings.TrimPrefix(in.Answer[0].String(), hdr.String())
+		if hdr.Name != test.name || hdr.Ttl != 300 || data != test.answer {
+			t.Errorf("%s %s: got %s", test.name, dns.TypeToString[test.qtype], in.Answer[0])
+		}
+	}
+
+	// Records below the hostname are not answered for the hostname itself
+	in, err := dnsQuery(port, "records.ist.nicht.cool.", dns.TypeSRV)
+	if err != nil {
+		t.Fatal("Failed:", err)
+	}
+	if in.Rcode != dns.RcodeSuccess || len(in.Answer) != 0 {
+		t.Error("Expected NODATA:", in)
+	}
+	// _udp only has names below it
+	in, err = dnsQuery(port, "_udp.records.ist.nicht.cool.", dns.TypeSRV)
+	if err != nil {
+		t.Fatal("Failed:", err)
+	}
+	if in.Rcode != dns.RcodeSuccess || len(in.Answer) != 0 {
+		t.Error("Expected NODATA for empty non-terminal:", in)
+	}
+	in, err = dnsQuery(port, "_sip._tcp.records.ist.nicht.cool.", dns.TypeSRV)
+	if err != nil {
+		t.Fatal("Failed:", err)
+	}
+	if in.Rcode != dns.RcodeNameError {
+		t.Error("Expected NXDOMAIN:", in)
+	}
+}
+
+type conformanceTest struct {
+	Name   string
+	Query  func(m *dns.Msg) // sets the question of the query
+	Rcode  int
+	Answer []uint16 // types of the answer records in order
+	Ns     []uint16
+}
+
+func question(name string, qtype uint16) func(m *dns.Msg) {
+	return func(m *dns.Msg) {
+		m.SetQuestion(name, qtype)
+	}
+}
+
+// Entries: host (A), alias (CNAME to host), external (CNAME out of the
+// zone), dangling (CNAME to a missing name), loop1 and loop2 (CNAMEs to
+// each other)
+var conformancetests = []conformanceTest{
+	{"Address", question("host.ist.nicht.cool.", dns.TypeA),
+		dns.RcodeSuccess, []uint16{dns.TypeA}, nil},
+	{"Mixed case", question("HoSt.Ist.Nicht.Cool.", dns.TypeA),
+		dns.RcodeSuccess, []uint16{dns.TypeA}, nil},
+	{"Unknown type", question("host.ist.nicht.cool.", 65280),
+		dns.RcodeSuccess, nil, []uint16{dns.TypeSOA}},
+	{"ANY", question("host.ist.nicht.cool.", dns.TypeANY),
+		dns.RcodeSuccess, []uint16{dns.TypeHINFO}, nil},
+	{"ANY at apex", question("ist.nicht.cool.", dns.TypeANY),
+		dns.RcodeSuccess, []uint16{dns.TypeHINFO}, nil},
+	{"ANY for alias", question("alias.ist.nicht.cool.", dns.TypeANY),
+		dns.RcodeSuccess, []uint16{dns.TypeCNAME}, nil},
+	{"ANY for missing name", question("missing.ist.nicht.cool.", dns.TypeANY),
+		dns.RcodeNameError, nil, []uint16{dns.TypeSOA}},
+	{"Alias", question("alias.ist.nicht.cool.", dns.TypeA),
+		dns.RcodeSuccess, []uint16{dns.TypeCNAME, dns.TypeA}, nil},
+	{"Alias without data", question("alias.ist.nicht.cool.", dns.TypeMX),
+		dns.RcodeSuccess, []uint16{dns.TypeCNAME}, []uint16{dns.TypeSOA}},
+	{"Alias itself", question("alias.ist.nicht.cool.", dns.TypeCNAME),
+		dns.RcodeSuccess, []uint16{dns.TypeCNAME}, nil},
+	{"Alias out of zone", question("external.ist.nicht.cool.", dns.TypeA),
+		dns.RcodeSuccess, []uint16{dns.TypeCNAME}, nil},
+	{"Dangling alias", question("dangling.ist.nicht.cool.", dns.TypeA),
+		dns.RcodeNameError, []uint16{dns.TypeCNAME}, []uint16{dns.TypeSOA}},
+	{"Alias loop", question("loop1.ist.nicht.cool.", dns.TypeA),
+		dns.RcodeSuccess, []uint16{dns.TypeCNAME, dns.TypeCNAME}, nil},
+	{"Out of zone", question("example.com.", dns.TypeA),
+		dns.RcodeRefused, nil, nil},
+	{"Parent zone", question("nicht.cool.", dns.TypeSOA),
+		dns.RcodeRefused, nil, nil},
+	{"Chaos class", func(m *dns.Msg) {
+		m.SetQuestion("host.ist.nicht.cool.", dns.TypeTXT)
+		m.Question[0].Qclass = dns.ClassCHAOS
+	}, dns.RcodeRefused, nil, nil},
+	{"Meta type", question("host.ist.nicht.cool.", dns.TypeMAILB),
+		dns.RcodeNotImplemented, nil, nil},
+	{"OPT as question", question("host.ist.nicht.cool.", dns.TypeOPT),
+		dns.RcodeFormatError, nil, nil},
+	{"No question", func(m *dns.Msg) {
+		m.Id = dns.Id()
+	}, dns.RcodeFormatError, nil, nil},
+	{"Two questions", func(m *dns.Msg) {
+		m.SetQuestion("host.ist.nicht.cool.", dns.TypeA)
+		m.Question = append(m.Question, dns.Question{Name: "alias.ist.nicht.cool.", Qtype: dns.TypeA, Qclass: dns.ClassINET})
+	}, dns.RcodeFormatError, nil, nil},
+	{"Status opcode", func(m *dns.Msg) {
+		m.SetQuestion("host.ist.nicht.cool.", dns.TypeA)
+		m.Opcode = dns.OpcodeStatus
+	}, dns.RcodeNotImplemented, nil, nil},
+	{"Notify opcode", func(m *dns.Msg) {
+		m.SetNotify("ist.nicht.cool.")
+	}, dns.RcodeNotImplemented, nil, nil},
+}
+
+func rrTypes(rrs []dns.RR) []uint16 {
+	var types []uint16
+	for _, rr := range rrs {
+		types = append(types, rr.Header().Rrtype)
+	}
+	return types
+}
+
+func TestDnsConformance(t *testing.T) {
+	db, err := getTmpDB()
+	if err != nil {
+		t.Fatal("Failed to create temporary DB")
+	}
+	port := startDnsServer(db, "")
+	for _, e := range []*Entry{
+		{Hostname: "host.ist.nicht.cool.", Ip4s: []net.IP{net.ParseIP("192.168.0.1")}},
+		{Hostname: "alias.ist.nicht.cool.", Cname: "host.ist.nicht.cool."},
+		{Hostname: "external.ist.nicht.cool.", Cname: "example.com."},
+		{Hostname: "dangling.ist.nicht.cool.", Cname: "missing.ist.nicht.cool."},
+		{Hostname: "loop1.ist.nicht.cool.", Cname: "loop2.ist.nicht.cool."},
+		{Hostname: "loop2.ist.nicht.cool.", Cname: "loop1.ist.nicht.cool."},
+	} {
+		db.SaveEntry(e)
+	}
+
+	for _, test := range conformancetests {
+		m := new(dns.Msg)
+		test.Query(m)
+		in, err := dnsExchange(port, m)
+		if err != nil {
+			t.Errorf("%s: Query failed: %s", test.Name, err)
+			continue
+		}
+		if in.Rcode != test.Rcode {
+			t.Errorf("%s: Got %s, expected %s", test.Name,
+				dns.RcodeToString[in.Rcode], dns.RcodeToString[test.Rcode])
+		}
+		if !reflect.DeepEqual(rrTypes(in.Answer), test.Answer) {
+			t.Errorf("%s: Unexpected answer: %v", test.Name, in.Answer)
+		}
+		if !reflect.DeepEqual(rrTypes(in.Ns), test.Ns) {
+			t.Errorf("%s: Unexpected authority: %v", test.Name, in.Ns)
+		}
+	}
+}
+
+func TestDnsEdns(t *testing.T) {
+	db, err := getTmpDB()
+	if err != nil {
+		t.Fatal("Failed to create temporary DB")
+	}
+	port := startDnsServer(db, "")
+	// 30 addresses do not fit into 512 bytes, but into the EDNS0 size
+	big := &Entry{Hostname: "big.ist.nicht.cool."}
+	for i := 0; i < 30; i++ {
+		big.Ip6s = append(big.Ip6s, net.ParseIP(fmt.Sprintf("2001:db8::%x", i)))
+	}
+	db.SaveEntry(big)
+	// 120 addresses do not fit into any UDP answer
+	huge := &Entry{Hostname: "huge.ist.nicht.cool."}
+	for i := 0; i < 120; i++ {
+		huge.Ip6s = append(huge.Ip6s, net.ParseIP(fmt.Sprintf("2001:db8::%x", i)))
+	}
+	db.SaveEntry(huge)
+
+	// Without EDNS0 the answer is truncated to 512 bytes
+	in, err := dnsQuery(port, "big.ist.nicht.cool.", dns.TypeAAAA)
+	if err != nil {
+		t.Fatal("Failed:", err)
+	}
+	in.Compress = true
+	if !in.Truncated || len(in.Answer) >= 30 || in.Len() > dns.MinMsgSize {
+		t.Errorf("Answer was not truncated: TC=%v, %d records, %d bytes",
+			in.Truncated, len(in.Answer), in.Len())
+	}
+	if in.IsEdns0() != nil {
+		t.Error("OPT record without EDNS0 query")
+	}
+
+	// The OPT record is echoed and the advertised size is respected
+	m := new(dns.Msg)
+	m.SetQuestion("big.ist.nicht.cool.", dns.TypeAAAA)
+	m.SetEdns0(4096, false)
+	in, err = dnsExchange(port, m)
+	if err != nil {
+		t.Fatal("Failed:", err)
+	}
+	if in.Truncated || len(in.Answer) != 30 {
+		t.Errorf("Answer does not fit: TC=%v, %d records", in.Truncated, len(in.Answer))
+	}
+	opt := in.IsEdns0()
+	if opt == nil || opt.UDPSize() != ednsSize || opt.Version() != 0 {
+		t.Error("OPT record was not echoed:", in.Extra)
+	}
+
+	m.SetQuestion("huge.ist.nicht.cool.", dns.TypeAAAA)
+	in, err = dnsExchange(port, m)
+	if err != nil {
+		t.Fatal("Failed:", err)
+	}
+	in.Compress = true
+	if !in.Truncated || in.Len() > int(ednsSize) || in.IsEdns0() == nil {
+		t.Errorf("Answer was not truncated: TC=%v, %d bytes", in.Truncated, in.Len())
+	}
+	// TCP fallback gets the full answer
+	c := &dns.Client{Net: "tcp"}
+	in, _, err = c.Exchange(m, "127.0.0.1:"+port)
+	if err != nil {
+		t.Fatal("Failed:", err)
+	}
+	if in.Truncated || len(in.Answer) != 120 {
+		t.Errorf("TCP answer is incomplete: TC=%v, %d records", in.Truncated, len(in.Answer))
+	}
+
+	// Unknown EDNS versions
+	m.SetQuestion("big.ist.nicht.cool.", dns.TypeAAAA)
+	m.IsEdns0().SetVersion(1)
+	in, err = dnsExchange(port, m)
+	if err != nil {
+		t.Fatal("Failed:", err)
+	}
+	if in.Rcode != dns.RcodeBadVers || len(in.Answer) != 0 || in.IsEdns0() == nil {
+		t.Error("Expected BADVERS:", in)
+	}
+}
+
+func TestDnsOffline(t *testing.T) {
+	db, err := getTmpDB()
+	if err != nil {
+		t.Fatal("Failed to create temporary DB")
+	}
+	port := startDnsServerConfig(db, &DnsServerConfig{
+		Domain:  "ist.nicht.cool.",
+		Parking: []string{"192.168.100.1", "2001:db8::100"},
+	})
+	for _, mode := range []string{"", OfflineNxdomain, OfflineParking, OfflineLast} {
+		db.SaveEntry(&Entry{
+			Hostname:    "offline" + mode + ".ist.nicht.cool.",
+			Ip4s:        []net.IP{net.ParseIP("192.168.0.1")},
+			Txts:        []string{"Hallo Welt"},
+			Offline:     true,
+			OfflineMode: mode,
+		})
+	}
+
+	for _, name := range []string{"offline.ist.nicht.cool.", "offlinenxdomain.ist.nicht.cool."} {
+		in, err := dnsQuery(port, name, dns.TypeA)
+		if err != nil {
+			t.Fatal("Failed:", err)
+		}
+		if in.Rcode != dns.RcodeNameError {
+			t.Error("Expected NXDOMAIN:", in)
+		}
+	}
+
+	in, err := dnsQuery(port, "offlineparking.ist.nicht.cool.", dns.TypeA)
+	if err != nil {
+		t.Fatal("Failed:", err)
+	}
+	if len(in.Answer) != 1 || in.Answer[0].(*dns.A).A.String() != "192.168.100.1" {
+		t.Error("Expected parking address:", in)
+	}
+	in, err = dnsQuery(port, "offlineparking.ist.nicht.cool.", dns.TypeTXT)
+	if err != nil {
+		t.Fatal("Failed:", err)
+	}
+	if in.Rcode != dns.RcodeSuccess || len(in.Answer) != 0 {
+		t.Error("Parked entry still has its records:", in)
+	}
+
+	in, err = dnsQuery(port, "offlinelast.ist.nicht.cool.", dns.TypeA)
+	if err != nil {
+		t.Fatal("Failed:", err)
+	}
+	if len(in.Answer) != 1 || in.Answer[0].(*dns.A).A.String() != "192.168.0.1" {
+		t.Error("Expected last address:", in)
+	}
+	in, err = dnsQuery(port, "offlinelast.ist.nicht.cool.", dns.TypeTXT)
+	if err != nil {
+		t.Fatal("Failed:", err)
+	}
+	if len(in.Answer) != 1 || !stringArrayCompare(in.Answer[0].(*dns.TXT).Txt,
+		[]string{"Hallo Welt", offlineMarker}) {
+		t.Error("Expected offline marker:", in)
+	}
+
+	// Back online
+	db.SaveEntry(&Entry{
+		Hostname: "offline.ist.nicht.cool.",
+		Ip4s:     []net.IP{net.ParseIP("192.168.0.2")},
+	})
+	in, err = dnsQuery(port, "offline.ist.nicht.cool.", dns.TypeA)
+	if err != nil {
+		t.Fatal("Failed:", err)
+	}
+	if len(in.Answer) != 1 || in.Answer[0].(*dns.A).A.String() != "192.168.0.2" {
+		t.Error("Entry is not online again:", in)
+	}
+}
+
+type reverseZoneTest struct {
+	Prefix string
+	Zone   string // empty if the prefix is rejected
+}
+
+var reversezonetests = []reverseZoneTest{
+	{"192.168.0.0/16", "168.192.in-addr.arpa."},
+	{"10.1.2.0/24", "2.1.10.in-addr.arpa."},
+	{"10.1.2.3/24", "2.1.10.in-addr.arpa."},
+	{"2001:db8::/32", "8.b.d.0.1.0.0.2.ip6.arpa."},
+	{"2001:db8:ab00::/44", "0.b.a.8.b.d.0.1.0.0.2.ip6.arpa."},
+	{"192.168.0.0/20", ""},
+	{"2001:db8::/30", ""},
+	{"0.0.0.0/0", ""},
+	{"192.168.0.0", ""},
+}
+
+func TestReverseZone(t *testing.T) {
+	for _, test := range reversezonetests {
+		zone, err := reverseZone(test.Prefix)
+		if test.Zone == "" && err == nil {
+			t.Errorf("%s should be rejected, got %s", test.Prefix, zone)
+		} else if test.Zone != "" && zone != test.Zone {
+			t.Errorf("%s: got %q, expected %q (%v)", test.Prefix, zone, test.Zone, err)
+		}
+	}
+}
+
+func TestDnsReverse(t *testing.T) {
+	db, err := getTmpDB()
+	if err != nil {
+		t.Fatal("Failed to create temporary DB")
+	}
+	port := startDnsServerConfig(db, &DnsServerConfig{
+		Domain:          "ist.nicht.cool.",
+		ReversePrefixes: []string{"192.168.0.0/16", "2001:db8::/32"},
+	})
+	db.SaveEntry(&Entry{
+		Hostname: "rev.ist.nicht.cool.",
+		Ip4s:     []net.IP{net.ParseIP("192.168.0.1")},
+		Ip6s:     []net.IP{net.ParseIP("2001:db8::1")},
+		Ttl:      300,
+		Reverse:  true,
+	})
+	db.SaveEntry(&Entry{
+		Hostname: "private.ist.nicht.cool.",
+		Ip4s:     []net.IP{net.ParseIP("192.168.0.2")},
+	})
+
+	ip6, _ := dns.ReverseAddr("2001:db8::1")
+	for _, name := range []string{"1.0.168.192.in-addr.arpa.", ip6} {
+		in, err := dnsQuery(port, name, dns.TypePTR)
+		if err != nil {
+			t.Fatal("Failed:", err)
+		}
+		if len(in.Answer) != 1 || in.Answer[0].(*dns.PTR).Ptr != "rev.ist.nicht.cool." ||
+			in.Answer[0].Header().Ttl != 300 || !in.Authoritative {
+			t.Error("Unexpected answer:", in)
+		}
+	}
+
+	in, err := dnsQuery(port, "168.192.in-addr.arpa.", dns.TypeSOA)
+	if err != nil {
+		t.Fatal("Failed:", err)
+	}
+	if len(in.Answer) != 1 || in.Answer[0].Header().Name != "168.192.in-addr.arpa." {
+		t.Error("Unexpected SOA:", in)
+	}
+	// Names above addresses are empty non-terminals
+	in, err = dnsQuery(port, "0.168.192.in-addr.arpa.", dns.TypePTR)
+	if err != nil {
+		t.Fatal("Failed:", err)
+	}
+	if in.Rcode != dns.RcodeSuccess || len(in.Answer) != 0 || len(in.Ns) != 1 ||
+		in.Ns[0].Header().Name != "168.192.in-addr.arpa." {
+		t.Error("Expected NODATA:", in)
+	}
+	// Entries without reverse names
+	in, err = dnsQuery(port, "2.0.168.192.in-addr.arpa.", dns.TypePTR)
+	if err != nil {
+		t.Fatal("Failed:", err)
+	}
+	if in.Rcode != dns.RcodeNameError {
+		t.Error("Expected NXDOMAIN:", in)
+	}
+	// Addresses outside of the prefixes
+	in, err = dnsQuery(port, "1.0.0.10.in-addr.arpa.", dns.TypePTR)
+	if err != nil {
+		t.Fatal("Failed:", err)
+	}
+	if in.Rcode != dns.RcodeRefused {
+		t.Error("Expected REFUSED:", in)
+	}
+
+	// New addresses replace the old PTR records
+	db.SaveEntry(&Entry{
+		Hostname: "rev.ist.nicht.cool.",
+		Ip4s:     []net.IP{net.ParseIP("192.168.0.3")},
+		Reverse:  true,
+	})
+	in, err = dnsQuery(port, "1.0.168.192.in-addr.arpa.", dns.TypePTR)
+	if err != nil {
+		t.Fatal("Failed:", err)
+	}
+	if in.Rcode != dns.RcodeNameError {
+		t.Error("Old address still has a PTR record:", in)
+	}
+	in, err = dnsQuery(port, "3.0.168.192.in-addr.arpa.", dns.TypePTR)
+	if err != nil {
+		t.Fatal("Failed:", err)
+	}
+	if len(in.Answer) != 1 {
+		t.Error("New address has no PTR record:", in)
+	}
+}
+
+// Write a self-signed certificate for localhost and its key to a temporary
+// directory
+func getTmpCert(t *testing.T) (string, string) {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal("Failed to generate key:", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &priv.PublicKey, priv)
+	if err != nil {
+		t.Fatal("Failed to create certificate:", err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(priv)
+	if err != nil {
+		t.Fatal("Failed to marshal key:", err)
+	}
+	dir, err := ioutil.TempDir("", "cooldns-tls")
+	if err != nil {
+		t.Fatal("Failed to create directory:", err)
+	}
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	return certFile, keyFile
+}
+
+func TestDnsTls(t *testing.T) {
+	db, err := getTmpDB()
+	if err != nil {
+		t.Fatal("Failed to create temporary DB")
+	}
+	certFile, keyFile := getTmpCert(t)
+	tlstest, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Failed to find a free port:", err)
+	}
+	tlsListen := tlstest.Addr().String()
+	tlstest.Close()
+	startDnsServerConfig(db, &DnsServerConfig{
+		Domain:    "ist.nicht.cool.",
+		TlsCert:   certFile,
+		TlsKey:    keyFile,
+		TlsListen: tlsListen,
+	})
+	db.SaveEntry(&Entry{
+		Hostname: "tls.ist.nicht.cool.",
+		Ip4s:     []net.IP{net.ParseIP("192.168.0.1")},
+	})
+
+	pemCert, _ := ioutil.ReadFile(certFile)
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(pemCert)
+	c := &dns.Client{
+		Net:       "tcp-tls",
+		TLSConfig: &tls.Config{RootCAs: roots},
+	}
+	m := new(dns.Msg)
+	m.SetQuestion("tls.ist.nicht.cool.", dns.TypeA)
+	var in *dns.Msg
+	for i := 0; i < 10; i++ {
+		in, _, err = c.Exchange(m, tlsListen)
+		if err == nil {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal("DNS over TLS query failed:", err)
+	}
+	if len(in.Answer) != 1 || in.Answer[0].(*dns.A).A.String() != "192.168.0.1" {
+		t.Error("Unexpected answer:", in.Answer)
+	}
+}
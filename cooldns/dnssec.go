@@ -0,0 +1,466 @@
+// The CoolDNS Project. The simple dynamic dns server and update service.
+// Copyright (C) 2014 The CoolDNS Authors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.package main
+
+package cooldns
+
+import (
+	"crypto"
+	"errors"
+	"fmt"
+	"github.com/miekg/dns"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Signatures are valid for sigValidity and renewed once they expire within
+// sigRefresh. The inception lies in the past to allow for clock skew.
+const (
+	sigValidity  = 7 * 24 * time.Hour
+	sigRefresh   = 2 * 24 * time.Hour
+	sigInception = time.Hour
+	// Maximum number of cached signatures
+	sigCacheSize = 10000
+	// Interval to reread the key directory
+	keyReload = time.Minute
+)
+
+// Timing of key rollovers. A new key is published rolloverDelay before it
+// becomes active so resolvers know it in time. The old key stays published
+// for keyRetireDelay after it signed for the last time, which has to be
+// longer than the maximum TTL of the zone.
+const (
+	rolloverDelay  = time.Duration(2*apexTtl) * time.Second
+	keyRetireDelay = 2 * 24 * time.Hour
+)
+
+// Format of the timing metadata in BIND key files
+const keyTimeFormat = "20060102150405"
+
+// A key of the zone with the timing metadata of its key files. Zero times
+// are unset.
+type dnssecKey struct {
+	key      *dns.DNSKEY
+	priv     crypto.Signer
+	file     string // key file without extension
+	publish  time.Time
+	activate time.Time
+	inactive time.Time
+	delete   time.Time
+}
+
+// Key signing keys have the SEP flag set
+func (k *dnssecKey) ksk() bool {
+	return k.key.Flags&dns.SEP != 0
+}
+
+// The key is in the DNSKEY set
+func (k *dnssecKey) published(now time.Time) bool {
+	return !k.publish.After(now) && (k.delete.IsZero() || now.Before(k.delete))
+}
+
+// The key is used for signing
+func (k *dnssecKey) active(now time.Time) bool {
+	return k.published(now) && !k.activate.After(now) &&
+		(k.inactive.IsZero() || now.Before(k.inactive))
+}
+
+// Load all keys of the domain from BIND style key files
+// K<domain>+<algorithm>+<tag>.key and .private in dir
+func loadKeys(dir, domain string) ([]*dnssecKey, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "K"+domain+"+*.key"))
+	if err != nil {
+		return nil, err
+	}
+	var keys []*dnssecKey
+	for _, file := range files {
+		k, err := loadKey(strings.TrimSuffix(file, ".key"))
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, k)
+	}
+	return keys, nil
+}
+
+func loadKey(file string) (*dnssecKey, error) {
+	pub, err := os.Open(file + ".key")
+	if err != nil {
+		return nil, err
+	}
+	defer pub.Close()
+	rr, err := dns.ReadRR(pub, file+".key")
+	if err != nil {
+		return nil, err
+	}
+	key, ok := rr.(*dns.DNSKEY)
+	if !ok {
+		return nil, errors.New("No DNSKEY in " + file + ".key")
+	}
+
+	data, err := ioutil.ReadFile(file + ".private")
+	if err != nil {
+		return nil, err
+	}
+	priv, err := key.ReadPrivateKey(strings.NewReader(string(data)), file+".private")
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := priv.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("Unsupported private key in " + file + ".private")
+	}
+	k := &dnssecKey{key: key, priv: signer, file: file}
+
+	// Timing metadata as written by dnssec-keygen
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+		var t *time.Time
+		switch strings.ToLower(fields[0]) {
+		case "publish:":
+			t = &k.publish
+		case "activate:":
+			t = &k.activate
+		case "inactive:":
+			t = &k.inactive
+		case "delete:":
+			t = &k.delete
+		default:
+			continue
+		}
+		*t, err = time.Parse(keyTimeFormat, fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("Malformatted %s in %s.private", fields[0], file)
+		}
+	}
+	return k, nil
+}
+
+// Write the key files, the private key file includes the timing metadata
+func (k *dnssecKey) save() error {
+	err := ioutil.WriteFile(k.file+".key", []byte(k.key.String()+"\n"), 0644)
+	if err != nil {
+		return err
+	}
+	data := k.key.PrivateKeyString(k.priv)
+	for _, timing := range []struct {
+		name string
+		t    time.Time
+	}{
+		{"Publish", k.publish},
+		{"Activate", k.activate},
+		{"Inactive", k.inactive},
+		{"Delete", k.delete},
+	} {
+		if !timing.t.IsZero() {
+			data += timing.name + ": " + timing.t.UTC().Format(keyTimeFormat) + "\n"
+		}
+	}
+	return ioutil.WriteFile(k.file+".private", []byte(data), 0600)
+}
+
+// Start a rollover of the zone signing ("zsk") or key signing ("ksk") key.
+// A new ZSK is published right away and takes over after rolloverDelay, the
+// first key of a kind is active immediately. A new KSK signs the DNSKEY set
+// together with the old one until the rollover is finished with "ksk-finish"
+// once the parent zone has the new DS record. Keys that are past their
+// deletion date are removed.
+func rolloverKey(dir, domain, kind string) (*dns.DNSKEY, error) {
+	var flags uint16
+	switch kind {
+	case "zsk":
+		flags = dns.ZONE
+	case "ksk":
+		flags = dns.ZONE | dns.SEP
+	case "ksk-finish":
+		return finishKskRollover(dir, domain)
+	default:
+		return nil, errors.New("Unknown key type " + kind + ", use zsk, ksk or ksk-finish")
+	}
+	keys, err := loadKeys(dir, domain)
+	if err != nil {
+		return nil, err
+	}
+
+	key := &dns.DNSKEY{
+		Hdr: dns.RR_Header{Name: domain,
+			Rrtype: dns.TypeDNSKEY,
+			Class:  dns.ClassINET,
+			Ttl:    apexTtl},
+		Flags:     flags,
+		Protocol:  3,
+		Algorithm: dns.ECDSAP256SHA256,
+	}
+	priv, err := key.Generate(256)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC().Truncate(time.Second)
+	k := &dnssecKey{
+		key:      key,
+		priv:     priv.(crypto.Signer),
+		file:     filepath.Join(dir, fmt.Sprintf("K%s+%03d+%05d", domain, key.Algorithm, key.KeyTag())),
+		publish:  now,
+		activate: now,
+	}
+
+	var retiring []*dnssecKey
+	for _, old := range keys {
+		if !old.delete.IsZero() && !now.Before(old.delete) {
+			log.Println("DNSSEC: Removing retired key", old.file)
+			os.Remove(old.file + ".key")
+			os.Remove(old.file + ".private")
+			continue
+		}
+		if old.ksk() == k.ksk() && old.inactive.IsZero() {
+			retiring = append(retiring, old)
+		}
+	}
+	// The parent zone only knows the old KSK, it keeps signing until the
+	// rollover is finished
+	if len(retiring) != 0 && !k.ksk() {
+		k.activate = now.Add(rolloverDelay)
+		for _, old := range retiring {
+			old.inactive = k.activate
+			old.delete = k.activate.Add(keyRetireDelay)
+			err = old.save()
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return key, k.save()
+}
+
+// Finish a rollover of the key signing key after the parent zone got the DS
+// record of the new key. The older key signing keys stop signing now and are
+// removed after keyRetireDelay. Returns the remaining key signing key.
+func finishKskRollover(dir, domain string) (*dns.DNSKEY, error) {
+	keys, err := loadKeys(dir, domain)
+	if err != nil {
+		return nil, err
+	}
+	var ksks []*dnssecKey
+	var newest *dnssecKey
+	for _, k := range keys {
+		if !k.ksk() || !k.inactive.IsZero() {
+			continue
+		}
+		ksks = append(ksks, k)
+		if newest == nil || k.publish.After(newest.publish) {
+			newest = k
+		}
+	}
+	if len(ksks) < 2 {
+		return nil, errors.New("No KSK rollover of " + domain + " in progress")
+	}
+	now := time.Now().UTC().Truncate(time.Second)
+	for _, old := range ksks {
+		if old == newest {
+			continue
+		}
+		old.inactive = now
+		old.delete = now.Add(keyRetireDelay)
+		err = old.save()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return newest.key, nil
+}
+
+// Online signer of the zone, the signatures are cached until they have to
+// be refreshed.
+type dnssecSigner struct {
+	sync.RWMutex
+	dir, domain string
+	keys        []*dnssecKey
+	sigs        map[string]*dns.RRSIG
+}
+
+func newDnssecSigner(dir, domain string) (*dnssecSigner, error) {
+	s := &dnssecSigner{dir: dir, domain: domain}
+	err := s.reload()
+	if err != nil {
+		return nil, err
+	}
+	if len(s.keys) == 0 {
+		return nil, errors.New("No DNSSEC keys for " + domain + " in " + dir)
+	}
+	// Pick up rollovers without a restart
+	go func() {
+		for _ = range time.Tick(keyReload) {
+			err := s.reload()
+			if err != nil {
+				log.Println("DNSSEC: Failed to reload keys:", err)
+			}
+		}
+	}()
+	return s, nil
+}
+
+func (s *dnssecSigner) reload() error {
+	keys, err := loadKeys(s.dir, s.domain)
+	if err != nil {
+		return err
+	}
+	s.Lock()
+	defer s.Unlock()
+	s.keys = keys
+	if s.sigs == nil {
+		s.sigs = make(map[string]*dns.RRSIG)
+	}
+	return nil
+}
+
+// The DNSKEY set of the zone apex
+func (s *dnssecSigner) dnskeys() []dns.RR {
+	s.RLock()
+	defer s.RUnlock()
+	now := time.Now()
+	var rrs []dns.RR
+	for _, k := range s.keys {
+		if k.published(now) {
+			key := *k.key
+			key.Hdr.Ttl = apexTtl
+			rrs = append(rrs, &key)
+		}
+	}
+	return rrs
+}
+
+// Keys that sign an RRset of the given type. The DNSKEY set is signed by the
+// key signing keys, everything else by the zone signing keys. Without an
+// active zone signing key the key signing keys sign everything.
+func (s *dnssecSigner) signers(rrtype uint16) []*dnssecKey {
+	s.RLock()
+	defer s.RUnlock()
+	now := time.Now()
+	var ksks, zsks []*dnssecKey
+	for _, k := range s.keys {
+		if !k.active(now) {
+			continue
+		}
+		if k.ksk() {
+			ksks = append(ksks, k)
+		} else {
+			zsks = append(zsks, k)
+		}
+	}
+	if rrtype == dns.TypeDNSKEY || len(zsks) == 0 {
+		return ksks
+	}
+	return zsks
+}
+
+// Signatures of an RRset
+func (s *dnssecSigner) sign(rrset []dns.RR) []dns.RR {
+	var rrStrings []string
+	for _, rr := range rrset {
+		rrStrings = append(rrStrings, strings.ToLower(rr.String()))
+	}
+	rrsetKey := strings.Join(rrStrings, "\n")
+
+	now := time.Now()
+	var sigs []dns.RR
+	for _, k := range s.signers(rrset[0].Header().Rrtype) {
+		cacheKey := fmt.Sprintf("%d\n%s", k.key.KeyTag(), rrsetKey)
+		s.RLock()
+		sig := s.sigs[cacheKey]
+		s.RUnlock()
+		if sig != nil && time.Unix(int64(sig.Expiration), 0).Sub(now) > sigRefresh {
+			sigs = append(sigs, sig)
+			continue
+		}
+
+		hdr := rrset[0].Header()
+		sig = &dns.RRSIG{
+			Hdr: dns.RR_Header{Name: hdr.Name,
+				Rrtype: dns.TypeRRSIG,
+				Class:  dns.ClassINET,
+				Ttl:    hdr.Ttl},
+			KeyTag:     k.key.KeyTag(),
+			SignerName: s.domain,
+			Algorithm:  k.key.Algorithm,
+			Inception:  uint32(now.Add(-sigInception).Unix()),
+			Expiration: uint32(now.Add(sigValidity).Unix()),
+		}
+		err := sig.Sign(k.priv, rrset)
+		if err != nil {
+			log.Println("DNSSEC: Failed to sign:", err)
+			continue
+		}
+		s.Lock()
+		if len(s.sigs) >= sigCacheSize {
+			s.sigs = make(map[string]*dns.RRSIG)
+		}
+		s.sigs[cacheKey] = sig
+		s.Unlock()
+		sigs = append(sigs, sig)
+	}
+	return sigs
+}
+
+// Add the signatures after every RRset of a message section
+func (s *dnssecSigner) signSection(rrs []dns.RR) []dns.RR {
+	var signed, rrset []dns.RR
+	for i, rr := range rrs {
+		rrset = append(rrset, rr)
+		if i+1 < len(rrs) && rrs[i+1].Header().Rrtype == rr.Header().Rrtype &&
+			strings.ToLower(rrs[i+1].Header().Name) == strings.ToLower(rr.Header().Name) {
+			continue
+		}
+		signed = append(signed, rrset...)
+		// The NS sets of delegations belong to the child and are not signed
+		delegation := rr.Header().Rrtype == dns.TypeNS &&
+			strings.ToLower(rr.Header().Name) != s.domain
+		if rr.Header().Rrtype != dns.TypeRRSIG && !delegation {
+			signed = append(signed, s.sign(rrset)...)
+		}
+		rrset = nil
+	}
+	return signed
+}
+
+// NSEC record for compact denial of existence: it covers only the name
+// itself, so it can be generated for every name on the fly. Names that do
+// not exist carry the NXNAME type.
+func nsecCompact(name string, types []uint16) *dns.NSEC {
+	types = append(types, dns.TypeRRSIG, dns.TypeNSEC)
+	sort.Sort(typeList(types))
+	return &dns.NSEC{
+		Hdr: dns.RR_Header{Name: name,
+			Rrtype: dns.TypeNSEC,
+			Class:  dns.ClassINET,
+			Ttl:    soaMinttl},
+		NextDomain: `\000.` + name,
+		TypeBitMap: types,
+	}
+}
+
+type typeList []uint16
+
+func (l typeList) Len() int           { return len(l) }
+func (l typeList) Less(i, j int) bool { return l[i] < l[j] }
+func (l typeList) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
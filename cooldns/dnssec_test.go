@@ -0,0 +1,277 @@
+// The CoolDNS Project. The simple dynamic dns server and update service.
+// Copyright (C) 2014 The CoolDNS Authors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.package main
+
+package cooldns
+
+import (
+	"github.com/miekg/dns"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+// Create a key directory with an active KSK and ZSK
+func getTmpKeys(t *testing.T) (string, *dns.DNSKEY, *dns.DNSKEY) {
+	dir, err := ioutil.TempDir("", "cooldns-keys")
+	if err != nil {
+		t.Fatal("Failed to create key directory:", err)
+	}
+	ksk, err := rolloverKey(dir, "ist.nicht.cool.", "ksk")
+	if err != nil {
+		t.Fatal("Failed to create KSK:", err)
+	}
+	zsk, err := rolloverKey(dir, "ist.nicht.cool.", "zsk")
+	if err != nil {
+		t.Fatal("Failed to create ZSK:", err)
+	}
+	return dir, ksk, zsk
+}
+
+func dnssecQuery(port, name string, qtype uint16) (*dns.Msg, error) {
+	m := new(dns.Msg)
+	m.SetQuestion(name, qtype)
+	m.SetEdns0(4096, true)
+	return dnsExchange(port, m)
+}
+
+// Split a section into RRsets and verify the signature of each RRset
+func verifySection(t *testing.T, rrs []dns.RR, keys map[uint16]*dns.DNSKEY) {
+	rrsets := make(map[uint16][]dns.RR)
+	var sigs []*dns.RRSIG
+	for _, rr := range rrs {
+		if sig, ok := rr.(*dns.RRSIG); ok {
+			sigs = append(sigs, sig)
+		} else {
+			rrsets[rr.Header().Rrtype] = append(rrsets[rr.Header().Rrtype], rr)
+		}
+	}
+	for rrtype, rrset := range rrsets {
+		signed := false
+		for _, sig := range sigs {
+			if sig.TypeCovered != rrtype {
+				continue
+			}
+			key := keys[sig.KeyTag]
+			if key == nil {
+				t.Errorf("%s signed with unknown key %d", dns.TypeToString[rrtype], sig.KeyTag)
+				continue
+			}
+			if err := sig.Verify(key, rrset); err != nil {
+				t.Errorf("Signature of %s does not verify: %s", dns.TypeToString[rrtype], err)
+			}
+			if !sig.ValidityPeriod(time.Now()) {
+				t.Errorf("Signature of %s is not valid now", dns.TypeToString[rrtype])
+			}
+			signed = true
+		}
+		if !signed {
+			t.Errorf("%s is not signed", dns.TypeToString[rrtype])
+		}
+	}
+}
+
+func TestDnssec(t *testing.T) {
+	db, err := getTmpDB()
+	if err != nil {
+		t.Fatal("Failed to create temporary DB")
+	}
+	dir, ksk, zsk := getTmpKeys(t)
+	port := startDnsServerConfig(db, &DnsServerConfig{
+		Domain:     "ist.nicht.cool.",
+		DnssecKeys: dir,
+	})
+	db.SaveEntry(&Entry{
+		Hostname: "signed.ist.nicht.cool.",
+		Ip4s:     []net.IP{net.ParseIP("192.168.0.1"), net.ParseIP("192.168.0.2")},
+		Txts:     []string{"signiert"},
+	})
+
+	// The DNSKEY set is signed by the KSK only
+	in, err := dnssecQuery(port, "ist.nicht.cool.", dns.TypeDNSKEY)
+	if err != nil {
+		t.Fatal("Query failed:", err)
+	}
+	if len(in.Answer) != 3 {
+		t.Fatal("Expected two keys and a signature:", in.Answer)
+	}
+	verifySection(t, in.Answer, map[uint16]*dns.DNSKEY{ksk.KeyTag(): ksk})
+
+	keys := map[uint16]*dns.DNSKEY{zsk.KeyTag(): zsk}
+	in, err = dnssecQuery(port, "signed.ist.nicht.cool.", dns.TypeA)
+	if err != nil {
+		t.Fatal("Query failed:", err)
+	}
+	if len(in.Answer) != 3 {
+		t.Fatal("Expected two addresses and a signature:", in.Answer)
+	}
+	verifySection(t, in.Answer, keys)
+
+	in, err = dnssecQuery(port, "ist.nicht.cool.", dns.TypeSOA)
+	if err != nil {
+		t.Fatal("Query failed:", err)
+	}
+	verifySection(t, in.Answer, keys)
+
+	// Compact denial for missing names and types
+	in, err = dnssecQuery(port, "missing.ist.nicht.cool.", dns.TypeA)
+	if err != nil {
+		t.Fatal("Query failed:", err)
+	}
+	if in.Rcode != dns.RcodeSuccess {
+		t.Errorf("Expected NOERROR, got %s", dns.RcodeToString[in.Rcode])
+	}
+	verifySection(t, in.Ns, keys)
+	nsec := nsecOf(in.Ns)
+	if nsec == nil || !hasType(nsec.TypeBitMap, dns.TypeNXNAME) {
+		t.Error("No NXNAME in denial:", in.Ns)
+	}
+
+	in, err = dnssecQuery(port, "signed.ist.nicht.cool.", dns.TypeMX)
+	if err != nil {
+		t.Fatal("Query failed:", err)
+	}
+	verifySection(t, in.Ns, keys)
+	nsec = nsecOf(in.Ns)
+	if nsec == nil || !hasType(nsec.TypeBitMap, dns.TypeA) ||
+		!hasType(nsec.TypeBitMap, dns.TypeTXT) || hasType(nsec.TypeBitMap, dns.TypeMX) {
+		t.Error("Wrong types in NODATA denial:", in.Ns)
+	}
+
+	// Without the DO bit nothing changes
+	in, err = dnsQuery(port, "missing.ist.nicht.cool.", dns.TypeA)
+	if err != nil {
+		t.Fatal("Query failed:", err)
+	}
+	if in.Rcode != dns.RcodeNameError || len(in.Ns) != 1 {
+		t.Error("Expected plain NXDOMAIN:", in)
+	}
+}
+
+func nsecOf(rrs []dns.RR) *dns.NSEC {
+	for _, rr := range rrs {
+		if nsec, ok := rr.(*dns.NSEC); ok {
+			return nsec
+		}
+	}
+	return nil
+}
+
+func hasType(types []uint16, rrtype uint16) bool {
+	for _, t := range types {
+		if t == rrtype {
+			return true
+		}
+	}
+	return false
+}
+
+func TestDnssecRollover(t *testing.T) {
+	dir, ksk, zsk := getTmpKeys(t)
+	newZsk, err := rolloverKey(dir, "ist.nicht.cool.", "zsk")
+	if err != nil {
+		t.Fatal("Rollover failed:", err)
+	}
+	s, err := newDnssecSigner(dir, "ist.nicht.cool.")
+	if err != nil {
+		t.Fatal("Failed to load keys:", err)
+	}
+	// The new key is published but the old one still signs
+	if len(s.dnskeys()) != 3 {
+		t.Error("Expected three published keys:", s.dnskeys())
+	}
+	signers := s.signers(dns.TypeA)
+	if len(signers) != 1 || signers[0].key.KeyTag() != zsk.KeyTag() {
+		t.Error("Old ZSK does not sign anymore")
+	}
+	signers = s.signers(dns.TypeDNSKEY)
+	if len(signers) != 1 || signers[0].key.KeyTag() != ksk.KeyTag() {
+		t.Error("KSK does not sign the DNSKEY set")
+	}
+
+	// After the rollover delay the new key takes over
+	later := time.Now().Add(rolloverDelay + time.Minute)
+	for _, k := range s.keys {
+		switch k.key.KeyTag() {
+		case zsk.KeyTag():
+			if k.active(later) || !k.published(later) {
+				t.Error("Old ZSK has wrong timing after rollover")
+			}
+			if k.published(later.Add(keyRetireDelay)) {
+				t.Error("Old ZSK is never removed")
+			}
+		case newZsk.KeyTag():
+			if k.active(time.Now()) || !k.active(later) {
+				t.Error("New ZSK has wrong timing")
+			}
+		}
+	}
+}
+
+func TestDnssecKskRollover(t *testing.T) {
+	dir, ksk, _ := getTmpKeys(t)
+	if _, err := rolloverKey(dir, "ist.nicht.cool.", "ksk-finish"); err == nil {
+		t.Error("Finished a KSK rollover that was never started")
+	}
+	// The first KSK is older than the next one
+	keys, err := loadKeys(dir, "ist.nicht.cool.")
+	if err != nil {
+		t.Fatal("Failed to load keys:", err)
+	}
+	for _, k := range keys {
+		if k.ksk() {
+			k.publish = k.publish.Add(-time.Hour)
+			k.activate = k.publish
+			k.save()
+		}
+	}
+	newKsk, err := rolloverKey(dir, "ist.nicht.cool.", "ksk")
+	if err != nil {
+		t.Fatal("Rollover failed:", err)
+	}
+	s, err := newDnssecSigner(dir, "ist.nicht.cool.")
+	if err != nil {
+		t.Fatal("Failed to load keys:", err)
+	}
+	// Both keys sign the DNSKEY set until the rollover is finished
+	later := time.Now().Add(keyRetireDelay)
+	for _, k := range s.keys {
+		if k.ksk() && !k.active(later) {
+			t.Error("KSK stops signing without finishing the rollover:", k.key.KeyTag())
+		}
+	}
+	if len(s.signers(dns.TypeDNSKEY)) != 2 {
+		t.Error("Old and new KSK do not both sign the DNSKEY set")
+	}
+
+	remaining, err := rolloverKey(dir, "ist.nicht.cool.", "ksk-finish")
+	if err != nil {
+		t.Fatal("Finishing the rollover failed:", err)
+	}
+	if remaining.KeyTag() != newKsk.KeyTag() {
+		t.Error("Finishing the rollover kept the old KSK")
+	}
+	s.reload()
+	signers := s.signers(dns.TypeDNSKEY)
+	if len(signers) != 1 || signers[0].key.KeyTag() != newKsk.KeyTag() {
+		t.Error("Old KSK still signs after the rollover:", signers)
+	}
+	for _, k := range s.keys {
+		if k.key.KeyTag() == ksk.KeyTag() && k.published(later.Add(time.Minute)) {
+			t.Error("Old KSK is never removed")
+		}
+	}
+}
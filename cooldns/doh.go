@@ -0,0 +1,315 @@
+// The CoolDNS Project. The simple dynamic dns server and update service.
+// Copyright (C) 2014 The CoolDNS Authors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.package main
+
+package cooldns
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/miekg/dns"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Answers DNS messages that did not arrive on one of the DNS listeners.
+// Query and answer are in wire format.
+type Resolver interface {
+	Resolve(query []byte, remote string) ([]byte, error)
+}
+
+// Address of clients that do not use a DNS listener
+type resolverAddr string
+
+func (a resolverAddr) Network() string { return "https" }
+func (a resolverAddr) String() string  { return string(a) }
+
+// Collects the answer of the dnsHandler, TSIG is handled like the DNS
+// listeners do.
+type resolverWriter struct {
+	h          *dnsHandler
+	remote     net.Addr
+	tsigStatus error
+	requestMAC string
+	answer     []byte
+}
+
+func (w *resolverWriter) LocalAddr() net.Addr  { return resolverAddr("") }
+func (w *resolverWriter) RemoteAddr() net.Addr { return w.remote }
+func (w *resolverWriter) TsigStatus() error    { return w.tsigStatus }
+func (w *resolverWriter) TsigTimersOnly(bool)  {}
+func (w *resolverWriter) Hijack()              {}
+func (w *resolverWriter) Close() error         { return nil }
+
+func (w *resolverWriter) WriteMsg(m *dns.Msg) error {
+	if m.IsTsig() != nil {
+		data, _, err := dns.TsigGenerateWithProvider(m, w.h.keyring, w.requestMAC, false)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(data)
+		return err
+	}
+	data, err := m.Pack()
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+func (w *resolverWriter) Write(data []byte) (int, error) {
+	if w.answer != nil {
+		return 0, errors.New("Only a single answer is supported")
+	}
+	w.answer = data
+	return len(data), nil
+}
+
+// Resolve a query with the same logic as the DNS listeners
+func (h *dnsHandler) Resolve(query []byte, remote string) ([]byte, error) {
+	if len(query) < 12 {
+		return nil, errors.New("Message too short")
+	}
+	r := new(dns.Msg)
+	err := r.Unpack(query)
+	if err != nil {
+		return nil, err
+	}
+	dh := dns.Header{
+		Id:      binary.BigEndian.Uint16(query[0:]),
+		Bits:    binary.BigEndian.Uint16(query[2:]),
+		Qdcount: binary.BigEndian.Uint16(query[4:]),
+		Ancount: binary.BigEndian.Uint16(query[6:]),
+		Nscount: binary.BigEndian.Uint16(query[8:]),
+		Arcount: binary.BigEndian.Uint16(query[10:]),
+	}
+	switch acceptMsg(dh) {
+	case dns.MsgIgnore:
+		return nil, errors.New("Message ignored")
+	case dns.MsgReject:
+		m := new(dns.Msg)
+		m.SetRcode(r, dns.RcodeFormatError)
+		return m.Pack()
+	case dns.MsgRejectNotImplemented:
+		m := new(dns.Msg)
+		m.SetRcode(r, dns.RcodeNotImplemented)
+		return m.Pack()
+	}
+
+	w := &resolverWriter{h: h, remote: resolverAddr(remote)}
+	if tsig := r.IsTsig(); tsig != nil {
+		w.tsigStatus = dns.TsigVerifyWithProvider(query, h.keyring, "", false)
+		w.requestMAC = tsig.MAC
+	}
+	h.handler("https")(w, r)
+	if w.answer == nil {
+		return nil, errors.New("No answer")
+	}
+	return w.answer, nil
+}
+
+// Address of the client of a request as host:port, see requestIp. Addresses
+// forwarded by proxies have port 0.
+func dohRemote(req *http.Request, proxies []*net.IPNet) string {
+	ip := requestIp(req, proxies)
+	if ip == nil {
+		return req.RemoteAddr
+	}
+	host, port, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil || !ip.Equal(net.ParseIP(host)) {
+		port = "0"
+	}
+	return net.JoinHostPort(ip.String(), port)
+}
+
+// Maximum size of a DNS message in a POST request
+const dohMaxSize = 65535
+
+// DNS over HTTPS according to RFC 8484. Queries are sent as base64url
+// encoded dns parameter of a GET request or as body of a POST request.
+// GET requests with a name parameter get the JSON format instead. Behind
+// trusted proxies the forwarded address is the client.
+func dohHandler(resolver Resolver, proxies []*net.IPNet) http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		var (
+			query []byte
+			err   error
+		)
+		switch {
+		case req.Method == "POST":
+			if req.Header.Get("Content-Type") != "application/dns-message" {
+				http.Error(res, "Unsupported content type", http.StatusUnsupportedMediaType)
+				return
+			}
+			query, err = ioutil.ReadAll(io.LimitReader(req.Body, dohMaxSize+1))
+			if err == nil && len(query) > dohMaxSize {
+				http.Error(res, "Message too large", http.StatusRequestEntityTooLarge)
+				return
+			}
+		case req.FormValue("dns") != "":
+			// Padding is not allowed, but accept it anyway
+			query, err = base64.RawURLEncoding.DecodeString(
+				strings.TrimRight(req.FormValue("dns"), "="))
+		case req.FormValue("name") != "":
+			dohJson(resolver, res, req, proxies)
+			return
+		default:
+			http.Error(res, "Missing query", http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			http.Error(res, "Malformatted query", http.StatusBadRequest)
+			return
+		}
+
+		answer, err := resolver.Resolve(query, dohRemote(req, proxies))
+		if err != nil {
+			http.Error(res, "Malformatted query", http.StatusBadRequest)
+			return
+		}
+		m := new(dns.Msg)
+		if err = m.Unpack(answer); err == nil {
+			res.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", minTtl(m)))
+		}
+		res.Header().Set("Content-Type", "application/dns-message")
+		res.Write(answer)
+	}
+}
+
+// Lowest TTL of an answer, used as lifetime of HTTP caches
+func minTtl(m *dns.Msg) uint32 {
+	var ttl uint32
+	first := true
+	for _, section := range [][]dns.RR{m.Answer, m.Ns} {
+		for _, rr := range section {
+			if first || rr.Header().Ttl < ttl {
+				ttl = rr.Header().Ttl
+				first = false
+			}
+		}
+	}
+	return ttl
+}
+
+// Question and records in the JSON format of DNS over HTTPS
+type dohJsonQuestion struct {
+	Name string `json:"name"`
+	Type uint16 `json:"type"`
+}
+
+type dohJsonRR struct {
+	Name string `json:"name"`
+	Type uint16 `json:"type"`
+	TTL  uint32 `json:"TTL"`
+	Data string `json:"data"`
+}
+
+type dohJsonMsg struct {
+	Status    int
+	TC        bool
+	RD        bool
+	RA        bool
+	AD        bool
+	CD        bool
+	Question  []dohJsonQuestion
+	Answer    []dohJsonRR `json:",omitempty"`
+	Authority []dohJsonRR `json:",omitempty"`
+}
+
+func dohJsonRRs(rrs []dns.RR) []dohJsonRR {
+	var jrrs []dohJsonRR
+	for _, rr := range rrs {
+		hdr := rr.Header()
+		jrrs = append(jrrs, dohJsonRR{
+			Name: hdr.Name,
+			Type: hdr.Rrtype,
+			TTL:  hdr.Ttl,
+			Data: strings.TrimPrefix(rr.String(), hdr.String()),
+		})
+	}
+	return jrrs
+}
+
+// The application/dns-json variant, the query is given by the name and type
+// (number or mnemonic, default A) parameters. The do and cd parameters set
+// the corresponding flags.
+func dohJson(resolver Resolver, res http.ResponseWriter, req *http.Request, proxies []*net.IPNet) {
+	qtype := dns.TypeA
+	if t := req.FormValue("type"); t != "" {
+		if n, err := strconv.ParseUint(t, 10, 16); err == nil {
+			qtype = uint16(n)
+		} else if n, ok := dns.StringToType[strings.ToUpper(t)]; ok {
+			qtype = n
+		} else {
+			http.Error(res, "Unknown type", http.StatusBadRequest)
+			return
+		}
+	}
+	q := new(dns.Msg)
+	q.SetQuestion(dns.Fqdn(req.FormValue("name")), qtype)
+	q.CheckingDisabled = isTrue(req.FormValue("cd"))
+	if isTrue(req.FormValue("do")) {
+		q.SetEdns0(dns.DefaultMsgSize, true)
+	}
+	query, err := q.Pack()
+	if err != nil {
+		http.Error(res, "Malformatted name", http.StatusBadRequest)
+		return
+	}
+	answer, err := resolver.Resolve(query, dohRemote(req, proxies))
+	m := new(dns.Msg)
+	if err == nil {
+		err = m.Unpack(answer)
+	}
+	if err != nil {
+		log.Println("DoH: Failed to resolve:", err)
+		http.Error(res, "Failed to resolve", http.StatusInternalServerError)
+		return
+	}
+	msg := &dohJsonMsg{
+		Status:    m.Rcode,
+		TC:        m.Truncated,
+		RD:        m.RecursionDesired,
+		RA:        m.RecursionAvailable,
+		AD:        m.AuthenticatedData,
+		CD:        m.CheckingDisabled,
+		Answer:    dohJsonRRs(m.Answer),
+		Authority: dohJsonRRs(m.Ns),
+	}
+	for _, question := range m.Question {
+		msg.Question = append(msg.Question, dohJsonQuestion{question.Name, question.Qtype})
+	}
+	data, err := json.Marshal(msg)
+	if err != nil {
+		http.Error(res, "Failed to encode answer", http.StatusInternalServerError)
+		return
+	}
+	res.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", minTtl(m)))
+	res.Header().Set("Content-Type", "application/dns-json")
+	res.Write(data)
+}
+
+func isTrue(s string) bool {
+	return s == "1" || strings.ToLower(s) == "true"
+}
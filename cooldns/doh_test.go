@@ -0,0 +1,165 @@
+// The CoolDNS Project. The simple dynamic dns server and update service.
+// Copyright (C) 2014 The CoolDNS Authors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.package main
+
+package cooldns
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/miekg/dns"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func createDohServer(t *testing.T, key string) (*httptest.Server, CoolDB) {
+	db, err := getTmpDB()
+	if err != nil {
+		t.Fatal("Failed to create temporary DB")
+	}
+	resolver := RunDns(&DnsServerConfig{
+		Domain:  "ist.nicht.cool.",
+		Listen:  "127.0.0.1:0",
+		TsigKey: key,
+	}, db, nil)
+	db.SaveEntry(&Entry{
+		Hostname: "doh.ist.nicht.cool.",
+		Ip4s:     []net.IP{net.ParseIP("192.168.0.1")},
+		Ttl:      300,
+	})
+	return httptest.NewServer(dohHandler(resolver, nil)), db
+}
+
+// Read a DNS message from a response
+func dohAnswer(t *testing.T, resp *http.Response) *dns.Msg {
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		t.Fatal("Unexpected status:", resp.Status)
+	}
+	if resp.Header.Get("Content-Type") != "application/dns-message" {
+		t.Error("Wrong content type:", resp.Header.Get("Content-Type"))
+	}
+	data, _ := ioutil.ReadAll(resp.Body)
+	m := new(dns.Msg)
+	if err := m.Unpack(data); err != nil {
+		t.Fatal("Malformatted answer:", err)
+	}
+	return m
+}
+
+func TestDohGet(t *testing.T) {
+	server, _ := createDohServer(t, "")
+	defer server.Close()
+
+	m := new(dns.Msg)
+	m.SetQuestion("doh.ist.nicht.cool.", dns.TypeA)
+	m.Id = 0
+	query, _ := m.Pack()
+	resp, err := http.Get(server.URL + "/dns-query?dns=" + base64.RawURLEncoding.EncodeToString(query))
+	if err != nil {
+		t.Fatal("Request failed:", err)
+	}
+	if resp.Header.Get("Cache-Control") != "max-age=300" {
+		t.Error("Wrong cache control:", resp.Header.Get("Cache-Control"))
+	}
+	in := dohAnswer(t, resp)
+	if len(in.Answer) != 1 || in.Answer[0].(*dns.A).A.String() != "192.168.0.1" {
+		t.Error("Unexpected answer:", in.Answer)
+	}
+
+	resp, err = http.Get(server.URL + "/dns-query?dns=nicht%20base64")
+	if err != nil {
+		t.Fatal("Request failed:", err)
+	}
+	if resp.StatusCode != 400 {
+		t.Error("Malformatted query was not rejected:", resp.Status)
+	}
+}
+
+func TestDohPost(t *testing.T) {
+	key, _ := NewTsigKey()
+	server, _ := createDohServer(t, key)
+	defer server.Close()
+
+	m := new(dns.Msg)
+	m.SetQuestion("missing.ist.nicht.cool.", dns.TypeA)
+	query, _ := m.Pack()
+	resp, err := http.Post(server.URL+"/dns-query", "application/dns-message", bytes.NewReader(query))
+	if err != nil {
+		t.Fatal("Request failed:", err)
+	}
+	if in := dohAnswer(t, resp); in.Rcode != dns.RcodeNameError {
+		t.Error("Expected NXDOMAIN:", in)
+	}
+
+	// TSIG signed messages are verified and the answer is signed
+	m = new(dns.Msg)
+	m.SetQuestion("doh.ist.nicht.cool.", dns.TypeA)
+	m.SetTsig("ist.nicht.cool.", dns.HmacSHA256, 300, time.Now().Unix())
+	query, mac, err := dns.TsigGenerate(m, key, "", false)
+	if err != nil {
+		t.Fatal("Failed to sign query:", err)
+	}
+	resp, err = http.Post(server.URL+"/dns-query", "application/dns-message", bytes.NewReader(query))
+	if err != nil {
+		t.Fatal("Request failed:", err)
+	}
+	defer resp.Body.Close()
+	answer, _ := ioutil.ReadAll(resp.Body)
+	if err := dns.TsigVerify(answer, key, mac, false); err != nil {
+		t.Error("Answer is not signed:", err)
+	}
+
+	resp, err = http.Post(server.URL+"/dns-query", "text/plain", bytes.NewReader(query))
+	if err != nil {
+		t.Fatal("Request failed:", err)
+	}
+	if resp.StatusCode != http.StatusUnsupportedMediaType {
+		t.Error("Wrong content type was accepted:", resp.Status)
+	}
+}
+
+func TestDohJson(t *testing.T) {
+	server, _ := createDohServer(t, "")
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/dns-query?" + url.Values{
+		"name": {"doh.ist.nicht.cool"},
+		"type": {"A"},
+	}.Encode())
+	if err != nil {
+		t.Fatal("Request failed:", err)
+	}
+	defer resp.Body.Close()
+	if resp.Header.Get("Content-Type") != "application/dns-json" {
+		t.Error("Wrong content type:", resp.Header.Get("Content-Type"))
+	}
+	var msg dohJsonMsg
+	err = json.NewDecoder(resp.Body).Decode(&msg)
+	if err != nil {
+		t.Fatal("Malformatted JSON:", err)
+	}
+	if msg.Status != dns.RcodeSuccess || len(msg.Answer) != 1 ||
+		msg.Answer[0].Data != "192.168.0.1" || msg.Answer[0].TTL != 300 ||
+		msg.Question[0].Type != dns.TypeA {
+		t.Errorf("Unexpected answer: %+v", msg)
+	}
+}
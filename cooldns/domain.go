@@ -31,6 +31,8 @@ import (
 // not recover
 //  - URL to short (below 2 characters)
 //  - contains illeageal characters.
+//  - is one of the names with an embedded address (ip.<domain> and below)
+//  - is the name answering the address of the client (myip.<domain>)
 func ValidateDomain(subdomain, domain string) (fqdn string, valid bool) {
 	domain = strings.ToLower(domain)
 	// To lower case
@@ -46,6 +48,10 @@ func ValidateDomain(subdomain, domain string) (fqdn string, valid bool) {
 	if !dns.IsSubDomain(domain, subdomain) {
 		return "", false
 	}
+	if isIpName(domain, subdomain) || isMyIpName(domain, subdomain) ||
+		isHealthName(domain, subdomain) {
+		return "", false
+	}
 
 	// Check for domain length constraint is met (length greater then 2)
 	subLabels := dns.SplitDomainName(subdomain)
@@ -58,6 +64,56 @@ func ValidateDomain(subdomain, domain string) (fqdn string, valid bool) {
 	return subdomain, isDomain
 }
 
+// Validate checks an entry before it is saved, no matter which API it came
+// in through. All problems found are returned as error messages.
+func (e *Entry) Validate(domain string) (errors []string) {
+	fqdn, ok := ValidateDomain(e.Hostname, domain)
+	if !ok || fqdn != e.Hostname {
+		errors = append(errors, "Hostname not Valid")
+	}
+	if e.Cname != "" && !isFqdn(e.Cname) {
+		errors = append(errors, "Malformatted CNAME")
+	}
+	for _, ip := range e.Ip4s {
+		if ip.To4() == nil {
+			errors = append(errors, "Malformatted Ip Address")
+		}
+	}
+	for _, ip := range e.Ip6s {
+		if ip.To16() == nil {
+			errors = append(errors, "Malformatted Ip Address")
+		}
+	}
+	for _, mx := range e.Mxs {
+		if !isFqdn(mx.ip) || mx.priority < 0 || mx.priority > 0xffff {
+			errors = append(errors, "Malformatted MX Entry")
+		}
+	}
+	for _, txt := range e.Txts {
+		// A single character string holds at most 255 bytes
+		if len(txt) > 255 {
+			errors = append(errors, "TXT record too long")
+		}
+	}
+	if e.Ttl > 1<<31-1 {
+		errors = append(errors, "Malformatted TTL")
+	}
+	if !isOfflineMode(e.OfflineMode) {
+		errors = append(errors, "Unknown offline mode")
+	}
+	errors = append(errors, e.validateRdata()...)
+	errors = append(errors, e.validateDelegation()...)
+	errors = append(errors, e.validateViews()...)
+	errors = append(errors, e.validateWeights()...)
+	return errors
+}
+
+// Checks if s is a syntactically valid fully qualified domain name
+func isFqdn(s string) bool {
+	_, ok := dns.IsDomainName(s)
+	return ok && dns.IsFqdn(s)
+}
+
 func trimDots(h string) string {
 	for {
 		hnew := strings.Replace(h, "..", ".", -1)
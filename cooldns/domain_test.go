@@ -34,6 +34,13 @@ var domainvalidationtests = []domainValidationTest{
 	domainValidationTest{"h", "h.domain.name.", false},
 	domainValidationTest{"g.hello.", "g.hello.domain.name.", true},
 	domainValidationTest{"hello..", "hello.domain.name.", true},
+	domainValidationTest{"ip", "ip.domain.name.", false},
+	domainValidationTest{"10-0-0-5.ip", "10-0-0-5.ip.domain.name.", false},
+	domainValidationTest{"ip.hello", "ip.hello.domain.name.", true},
+	domainValidationTest{"myip", "myip.domain.name.", false},
+	domainValidationTest{"myip.hello", "myip.hello.domain.name.", true},
+	domainValidationTest{"_health", "_health.domain.name.", false},
+	domainValidationTest{"_HEALTH", "_health.domain.name.", false},
 }
 
 func TestDomainValidation(t *testing.T) {
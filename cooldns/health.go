@@ -0,0 +1,94 @@
+// The CoolDNS Project. The simple dynamic dns server and update service.
+// Copyright (C) 2014 The CoolDNS Authors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.package main
+
+package cooldns
+
+import (
+	"errors"
+	"fmt"
+	"github.com/miekg/dns"
+	"log"
+	"strings"
+)
+
+// Label of the name in every zone that answers with the health of the
+// server. Monitors probe it to check the DNS path end to end.
+const healthLabel = "_health"
+
+// Databases that can check themselves, the health name fails if they do
+type HealthChecker interface {
+	Health() error
+}
+
+// Whether a name is the health name of a zone
+func isHealthName(zone, name string) bool {
+	return strings.ToLower(name) == healthLabel+"."+zone
+}
+
+// Nil if the database and its cache are in order
+func (h *dnsHandler) health() error {
+	if checker, ok := h.db.(HealthChecker); ok {
+		return checker.Health()
+	}
+	return nil
+}
+
+// Rcode of queries for the health name, SERVFAIL if the server is not
+// healthy
+func (h *dnsHandler) healthRcode() int {
+	if err := h.health(); err != nil {
+		log.Println("Health check failed:", err)
+		return dns.RcodeServerFailure
+	}
+	return dns.RcodeSuccess
+}
+
+// Record of the health name of a healthy server. It must not be cached.
+func (h *dnsHandler) healthRecord(zone string) dns.RR {
+	return &dns.TXT{
+		Hdr: dns.RR_Header{Name: healthLabel + "." + zone,
+			Rrtype: dns.TypeTXT,
+			Class:  dns.ClassINET,
+			Ttl:    0},
+		Txt: []string{"ok", fmt.Sprintf("serial=%d", h.db.Serial())},
+	}
+}
+
+// The database answers and the cache has the serial of the database
+func (db *SqliteCoolDB) Health() error {
+	db.Lock()
+	defer db.Unlock()
+	var serial uint32
+	err := db.c.QueryRow("SELECT serial FROM zone").Scan(&serial)
+	if err != nil {
+		return err
+	}
+	if serial != db.Serial() {
+		return fmt.Errorf("Cache has serial %d, database %d", db.Serial(), serial)
+	}
+	return nil
+}
+
+// Secondaries are healthy once they have a zone. Expired zones are not
+// answered at all.
+func (db *SecondaryCoolDB) Health() error {
+	db.Lock()
+	defer db.Unlock()
+	if len(db.soas) == 0 {
+		return errors.New("No zone transferred yet")
+	}
+	return nil
+}
@@ -0,0 +1,63 @@
+// The CoolDNS Project. The simple dynamic dns server and update service.
+// Copyright (C) 2014 The CoolDNS Authors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.package main
+
+package cooldns
+
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	"testing"
+)
+
+func TestDnsHealth(t *testing.T) {
+	db, err := getTmpDB()
+	if err != nil {
+		t.Fatal("Failed to create temporary DB")
+	}
+	port := startDnsServerConfig(db, &DnsServerConfig{Domain: "ist.nicht.cool."})
+
+	in, err := dnsQuery(port, "_health.ist.nicht.cool.", dns.TypeTXT)
+	if err != nil {
+		t.Fatal("Query failed:", err)
+	}
+	if in.Rcode != dns.RcodeSuccess || len(in.Answer) != 1 {
+		t.Fatal("Unexpected answer:", in)
+	}
+	txt := in.Answer[0].(*dns.TXT)
+	serial := fmt.Sprintf("serial=%d", db.Serial())
+	if txt.Hdr.Ttl != 0 || len(txt.Txt) != 2 || txt.Txt[0] != "ok" || txt.Txt[1] != serial {
+		t.Error("Unexpected health record:", txt)
+	}
+
+	// The name exists without other data
+	in, err = dnsQuery(port, "_health.ist.nicht.cool.", dns.TypeA)
+	if err != nil {
+		t.Fatal("Query failed:", err)
+	}
+	if in.Rcode != dns.RcodeSuccess || len(in.Answer) != 0 || len(in.Ns) != 1 {
+		t.Error("Unexpected answer for type A:", in)
+	}
+
+	// A database that does not answer fails the check
+	db.Close()
+	in, err = dnsQuery(port, "_health.ist.nicht.cool.", dns.TypeTXT)
+	if err != nil {
+		t.Fatal("Query failed:", err)
+	}
+	if in.Rcode != dns.RcodeServerFailure {
+		t.Error("Broken database answered", dns.RcodeToString[in.Rcode])
+	}
+}
@@ -0,0 +1,97 @@
+// The CoolDNS Project. The simple dynamic dns server and update service.
+// Copyright (C) 2014 The CoolDNS Authors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.package main
+
+package cooldns
+
+import (
+	"github.com/miekg/dns"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Label below every zone that holds names with an embedded address, like
+// 10-0-0-5.ip.<zone>. The names can not be registered, even if they are not
+// answered.
+const ipNamesLabel = "ip"
+
+// Whether a name is ip.<zone> or below it
+func isIpName(zone, name string) bool {
+	return dns.IsSubDomain(ipNamesLabel+"."+strings.ToLower(zone), strings.ToLower(name))
+}
+
+// Entry with the address embedded in a name below ip.<zone>, nil if the
+// name has none. The label right above ip is the address, labels in front
+// of it are ignored, e.g. app.10-0-0-5.ip.<zone>.
+func ipNameEntry(zone, name string) *Entry {
+	base := ipNamesLabel + "." + zone
+	name = strings.ToLower(name)
+	if name == base || !dns.IsSubDomain(base, name) {
+		return nil
+	}
+	labels := dns.SplitDomainName(name)
+	ip := parseIpLabel(labels[len(labels)-dns.CountLabel(base)-1])
+	switch {
+	case ip == nil:
+		return nil
+	case ip.To4() != nil:
+		return &Entry{Hostname: name, Ip4s: []net.IP{ip}}
+	default:
+		return &Entry{Hostname: name, Ip6s: []net.IP{ip}}
+	}
+}
+
+// Address of a label, nil if it is none. IPv4 addresses are written with
+// dashes (10-0-0-5) or as 8 hex digits (0a000005), IPv6 addresses with
+// dashes instead of colons (2001-db8--1). Only the canonical forms are
+// accepted: no leading zeros in IPv4 octets and no IPv4 in IPv6 addresses.
+func parseIpLabel(label string) net.IP {
+	if !strings.Contains(label, "-") {
+		if len(label) != 2*net.IPv4len {
+			return nil
+		}
+		n, err := strconv.ParseUint(label, 16, 32)
+		if err != nil {
+			return nil
+		}
+		return net.IPv4(byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+	}
+	if ip := parseIp4Label(label); ip != nil {
+		return ip
+	}
+	ip := net.ParseIP(strings.Replace(label, "-", ":", -1))
+	if ip == nil || ip.To4() != nil {
+		return nil
+	}
+	return ip
+}
+
+// IPv4 address written with dashes, nil if the label is none
+func parseIp4Label(label string) net.IP {
+	octets := strings.Split(label, "-")
+	if len(octets) != net.IPv4len {
+		return nil
+	}
+	ip := make(net.IP, net.IPv4len)
+	for i, octet := range octets {
+		n, err := strconv.ParseUint(octet, 10, 8)
+		if err != nil || strconv.FormatUint(n, 10) != octet {
+			return nil
+		}
+		ip[i] = byte(n)
+	}
+	return ip.To16()
+}
@@ -0,0 +1,127 @@
+// The CoolDNS Project. The simple dynamic dns server and update service.
+// Copyright (C) 2014 The CoolDNS Authors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.package main
+
+package cooldns
+
+import (
+	"github.com/miekg/dns"
+	"testing"
+)
+
+var ipLabelTests = []struct {
+	label, ip string
+}{
+	{"10-0-0-5", "10.0.0.5"},
+	{"255-255-255-255", "255.255.255.255"},
+	{"0a000005", "10.0.0.5"},
+	{"2001-db8--1", "2001:db8::1"},
+	{"--1", "::1"},
+	{"1-2--3", "1:2::3"},
+	// Not canonical or no address at all
+	{"10-0-0-05", ""},
+	{"10-0-0-256", ""},
+	{"10-0-0", ""},
+	{"10-0-0-5-6", ""},
+	{"0a00005", ""},
+	{"0a00000g", ""},
+	{"--ffff-a00-5", ""},
+	{"2001-db8-1", ""},
+	{"www", ""},
+	{"", ""},
+}
+
+func TestParseIpLabel(t *testing.T) {
+	for _, test := range ipLabelTests {
+		ip := parseIpLabel(test.label)
+		if test.ip == "" {
+			if ip != nil {
+				t.Errorf("%s parsed as %s", test.label, ip)
+			}
+			continue
+		}
+		if ip == nil || ip.String() != test.ip {
+			t.Errorf("%s parsed as %s, expected %s", test.label, ip, test.ip)
+		}
+	}
+}
+
+func TestDnsIpNames(t *testing.T) {
+	db, err := getTmpDB()
+	if err != nil {
+		t.Fatal("Failed to create temporary DB")
+	}
+	port := startDnsServerConfig(db, &DnsServerConfig{
+		Domain:  "ist.nicht.cool.",
+		IpNames: true,
+	})
+
+	tests := []struct {
+		name   string
+		qtype  uint16
+		rcode  int
+		answer string
+	}{
+		{"10-0-0-5.ip.ist.nicht.cool.", dns.TypeA, dns.RcodeSuccess, "10.0.0.5"},
+		{"app.0a000005.IP.ist.nicht.cool.", dns.TypeA, dns.RcodeSuccess, "10.0.0.5"},
+		{"2001-db8--1.ip.ist.nicht.cool.", dns.TypeAAAA, dns.RcodeSuccess, "2001:db8::1"},
+		// No data for the other family, the names in between exist
+		{"10-0-0-5.ip.ist.nicht.cool.", dns.TypeAAAA, dns.RcodeSuccess, ""},
+		{"ip.ist.nicht.cool.", dns.TypeA, dns.RcodeSuccess, ""},
+		{"10-0-0-05.ip.ist.nicht.cool.", dns.TypeA, dns.RcodeNameError, ""},
+		{"www.ip.ist.nicht.cool.", dns.TypeA, dns.RcodeNameError, ""},
+	}
+	for _, test := range tests {
+		in, err := dnsQuery(port, test.name, test.qtype)
+		if err != nil {
+			t.Fatal("Query failed:", err)
+		}
+		if in.Rcode != test.rcode {
+			t.Errorf("%s answered %s, expected %s", test.name,
+				dns.RcodeToString[in.Rcode], dns.RcodeToString[test.rcode])
+			continue
+		}
+		if test.answer == "" {
+			if len(in.Answer) != 0 {
+				t.Errorf("%s has unexpected answer %s", test.name, in.Answer)
+			}
+			continue
+		}
+		if len(in.Answer) != 1 {
+			t.Errorf("%s has answer %s, expected %s", test.name, in.Answer, test.answer)
+			continue
+		}
+		var ip string
+		switch rr := in.Answer[0].(type) {
+		case *dns.A:
+			ip = rr.A.String()
+		case *dns.AAAA:
+			ip = rr.AAAA.String()
+		}
+		if ip != test.answer || in.Answer[0].Header().Name != test.name {
+			t.Errorf("%s has answer %s, expected %s", test.name, in.Answer[0], test.answer)
+		}
+	}
+
+	// Without the switch the names do not exist
+	port = startDnsServerConfig(db, &DnsServerConfig{Domain: "ist.nicht.cool."})
+	in, err := dnsQuery(port, "10-0-0-5.ip.ist.nicht.cool.", dns.TypeA)
+	if err != nil {
+		t.Fatal("Query failed:", err)
+	}
+	if in.Rcode != dns.RcodeNameError {
+		t.Error("Disabled names answered", dns.RcodeToString[in.Rcode])
+	}
+}
@@ -26,6 +26,9 @@ type MetricsHandle interface {
 	DatabaseEvent()
 	HttpEvent()
 	HttpTime(func())
+	// Responses dropped or truncated by the response rate limit
+	RrlDropEvent()
+	RrlSlipEvent()
 }
 
 // Configuration of the InfluxDB host where all metrics are stored in
@@ -41,6 +44,8 @@ type InfluxMHandle struct {
 	db      metrics.Meter
 	http    metrics.Meter
 	httpLat metrics.Timer
+	rrlDrop metrics.Meter
+	rrlSlip metrics.Meter
 }
 
 func NewInfluxMetrics(config *InfluxConfig) *InfluxMHandle {
@@ -56,6 +61,12 @@ func NewInfluxMetrics(config *InfluxConfig) *InfluxMHandle {
 	httpLat := metrics.NewTimer()
 	metrics.Register("httpTime", httpLat)
 
+	rrlDrop := metrics.NewMeter()
+	metrics.Register("rrlDrop", rrlDrop)
+
+	rrlSlip := metrics.NewMeter()
+	metrics.Register("rrlSlip", rrlSlip)
+
 	go influxdb.Influxdb(metrics.DefaultRegistry, 10e9, &influxdb.Config{
 		Host:     config.Host,
 		Database: config.Database,
@@ -67,6 +78,8 @@ func NewInfluxMetrics(config *InfluxConfig) *InfluxMHandle {
 		db:      databaseLoad,
 		http:    httpLoad,
 		httpLat: httpLat,
+		rrlDrop: rrlDrop,
+		rrlSlip: rrlSlip,
 	}
 }
 
@@ -86,6 +99,14 @@ func (m *InfluxMHandle) HttpTime(f func()) {
 	m.httpLat.Time(f)
 }
 
+func (m *InfluxMHandle) RrlDropEvent() {
+	m.rrlDrop.Mark(1)
+}
+
+func (m *InfluxMHandle) RrlSlipEvent() {
+	m.rrlSlip.Mark(1)
+}
+
 type DummyMHandle struct {
 }
 
@@ -105,3 +126,9 @@ func (m *DummyMHandle) HttpEvent() {
 func (m *DummyMHandle) HttpTime(f func()) {
 	f()
 }
+
+func (m *DummyMHandle) RrlDropEvent() {
+}
+
+func (m *DummyMHandle) RrlSlipEvent() {
+}
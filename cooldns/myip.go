@@ -0,0 +1,145 @@
+// The CoolDNS Project. The simple dynamic dns server and update service.
+// Copyright (C) 2014 The CoolDNS Authors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.package main
+
+package cooldns
+
+import (
+	"encoding/json"
+	"github.com/miekg/dns"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Label of the name in every zone that answers with the address of the
+// client. It can not be registered.
+const myIpLabel = "myip"
+
+// Whether a name is myip.<zone>
+func isMyIpName(zone, name string) bool {
+	return strings.ToLower(name) == myIpLabel+"."+strings.ToLower(zone)
+}
+
+// Entry answering myip.<zone> for a client: its address as A or AAAA and
+// as TXT record
+func myIpEntry(name string, client net.IP) *Entry {
+	e := &Entry{Hostname: strings.ToLower(name)}
+	if client == nil {
+		return e
+	}
+	if ip4 := client.To4(); ip4 != nil {
+		e.Ip4s = []net.IP{ip4}
+	} else {
+		e.Ip6s = []net.IP{client}
+	}
+	e.Txts = []string{client.String()}
+	return e
+}
+
+// The answers differ for every client, they must not be cached
+func uncached(rrs []dns.RR) []dns.RR {
+	for _, rr := range rrs {
+		rr.Header().Ttl = 0
+	}
+	return rrs
+}
+
+// Networks of the proxies whose X-Forwarded-For header is trusted. Single
+// addresses are accepted as well.
+func parseProxies(proxies []string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, proxy := range proxies {
+		if !strings.Contains(proxy, "/") {
+			if ip := net.ParseIP(proxy); ip != nil && ip.To4() != nil {
+				proxy += "/32"
+			} else {
+				proxy += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+func trustedProxy(proxies []*net.IPNet, ip net.IP) bool {
+	for _, network := range proxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Address of the client of a request. As long as the request comes from a
+// trusted proxy, the address the proxy appended to X-Forwarded-For is taken
+// instead.
+func requestIp(req *http.Request, proxies []*net.IPNet) net.IP {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	var hops []string
+	for _, header := range req.Header[http.CanonicalHeaderKey("X-Forwarded-For")] {
+		hops = append(hops, strings.Split(header, ",")...)
+	}
+	for i := len(hops) - 1; i >= 0 && ip != nil && trustedProxy(proxies, ip); i-- {
+		hop := net.ParseIP(strings.TrimSpace(hops[i]))
+		if hop == nil {
+			break
+		}
+		ip = hop
+	}
+	return ip
+}
+
+// Address of the caller as answered by /ip
+type ClientIp struct {
+	Ip      string `json:"ip"`
+	Version int    `json:"version"`
+}
+
+// GET /ip answers the address of the caller as text, or as JSON if the
+// client accepts application/json or asks with format=json
+func clientIpHandler(proxies []*net.IPNet) func(http.ResponseWriter, *http.Request) {
+	return func(res http.ResponseWriter, req *http.Request) {
+		ip := requestIp(req, proxies)
+		if ip == nil {
+			http.Error(res, "Unknown client address", http.StatusInternalServerError)
+			return
+		}
+		res.Header().Set("Cache-Control", "no-store")
+		if req.URL.Query().Get("format") != "json" &&
+			!strings.Contains(req.Header.Get("Accept"), "application/json") {
+			res.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			res.Write([]byte(ip.String() + "\n"))
+			return
+		}
+		answer := ClientIp{Ip: ip.String(), Version: 6}
+		if ip.To4() != nil {
+			answer.Version = 4
+		}
+		res.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(res).Encode(answer); err != nil {
+			log.Println("Failed to write client address:", err)
+		}
+	}
+}
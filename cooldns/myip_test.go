@@ -0,0 +1,152 @@
+// The CoolDNS Project. The simple dynamic dns server and update service.
+// Copyright (C) 2014 The CoolDNS Authors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.package main
+
+package cooldns
+
+import (
+	"encoding/json"
+	"github.com/miekg/dns"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestDnsMyIp(t *testing.T) {
+	db, err := getTmpDB()
+	if err != nil {
+		t.Fatal("Failed to create temporary DB")
+	}
+	port := startDnsServer(db, "")
+
+	in, err := dnsQuery(port, "myip.ist.nicht.cool.", dns.TypeA)
+	if err != nil {
+		t.Fatal("Query failed:", err)
+	}
+	if in.Rcode != dns.RcodeSuccess || len(in.Answer) != 1 {
+		t.Fatal("Unexpected answer:", in)
+	}
+	a := in.Answer[0].(*dns.A)
+	if a.A.String() != "127.0.0.1" || a.Hdr.Ttl != 0 {
+		t.Error("Unexpected address record:", a)
+	}
+
+	in, err = dnsQuery(port, "MyIp.ist.nicht.cool.", dns.TypeTXT)
+	if err != nil {
+		t.Fatal("Query failed:", err)
+	}
+	if len(in.Answer) != 1 || in.Answer[0].(*dns.TXT).Txt[0] != "127.0.0.1" {
+		t.Error("Unexpected TXT answer:", in)
+	}
+
+	// IPv4 clients have no IPv6 address
+	in, err = dnsQuery(port, "myip.ist.nicht.cool.", dns.TypeAAAA)
+	if err != nil {
+		t.Fatal("Query failed:", err)
+	}
+	if in.Rcode != dns.RcodeSuccess || len(in.Answer) != 0 {
+		t.Error("Unexpected AAAA answer:", in)
+	}
+}
+
+func TestRequestIp(t *testing.T) {
+	proxies, err := parseProxies([]string{"10.0.0.0/8", "::1"})
+	if err != nil {
+		t.Fatal("Failed to parse proxies:", err)
+	}
+	tests := []struct {
+		remote, forwarded, ip string
+	}{
+		{"192.0.2.1:1234", "", "192.0.2.1"},
+		// Only trusted proxies may forward
+		{"192.0.2.1:1234", "198.51.100.7", "192.0.2.1"},
+		{"10.1.1.1:1234", "198.51.100.7", "198.51.100.7"},
+		{"[::1]:1234", "2001:db8::7", "2001:db8::7"},
+		// The last untrusted hop is the client
+		{"10.1.1.1:1234", "203.0.113.9, 198.51.100.7, 10.2.2.2", "198.51.100.7"},
+		{"10.1.1.1:1234", "garbage", "10.1.1.1"},
+	}
+	for _, test := range tests {
+		req, _ := http.NewRequest("GET", "/ip", nil)
+		req.RemoteAddr = test.remote
+		if test.forwarded != "" {
+			req.Header.Set("X-Forwarded-For", test.forwarded)
+		}
+		if ip := requestIp(req, proxies); ip.String() != test.ip {
+			t.Errorf("Request from %s forwarded for %q has address %s, expected %s",
+				test.remote, test.forwarded, ip, test.ip)
+		}
+	}
+	if _, err := parseProxies([]string{"10.0.0.0/33"}); err == nil {
+		t.Error("Malformatted proxy was accepted")
+	}
+}
+
+func TestClientIpHandler(t *testing.T) {
+	handler := clientIpHandler(nil)
+
+	req, _ := http.NewRequest("GET", "/ip", nil)
+	req.RemoteAddr = "[2001:db8::7]:1234"
+	res := httptest.NewRecorder()
+	handler(res, req)
+	if res.Body.String() != "2001:db8::7\n" {
+		t.Errorf("Unexpected text answer %q", res.Body.String())
+	}
+
+	req, _ = http.NewRequest("GET", "/ip?format=json", nil)
+	req.RemoteAddr = "192.0.2.1:1234"
+	res = httptest.NewRecorder()
+	handler(res, req)
+	var answer ClientIp
+	if err := json.Unmarshal(res.Body.Bytes(), &answer); err != nil {
+		t.Fatal("Malformatted JSON answer:", err)
+	}
+	if answer.Ip != "192.0.2.1" || answer.Version != 4 {
+		t.Error("Unexpected JSON answer:", answer)
+	}
+	if res.Header().Get("Content-Type") != "application/json" {
+		t.Error("Unexpected content type", res.Header().Get("Content-Type"))
+	}
+}
+
+// DNS over HTTPS takes the client address from trusted proxies like /ip
+func TestDohMyIp(t *testing.T) {
+	db, err := getTmpDB()
+	if err != nil {
+		t.Fatal("Failed to create temporary DB")
+	}
+	resolver := RunDns(&DnsServerConfig{
+		Domain: "ist.nicht.cool.",
+		Listen: "127.0.0.1:0",
+	}, db, nil)
+	proxies, _ := parseProxies([]string{"127.0.0.1"})
+	server := httptest.NewServer(dohHandler(resolver, proxies))
+	defer server.Close()
+
+	req, _ := http.NewRequest("GET", server.URL+"/dns-query?name=myip.ist.nicht.cool&type=TXT", nil)
+	req.Header.Set("X-Forwarded-For", "198.51.100.7")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal("Request failed:", err)
+	}
+	defer resp.Body.Close()
+	var msg dohJsonMsg
+	if err := json.NewDecoder(resp.Body).Decode(&msg); err != nil {
+		t.Fatal("Malformatted JSON:", err)
+	}
+	if len(msg.Answer) != 1 || msg.Answer[0].Data != `"198.51.100.7"` {
+		t.Errorf("Unexpected answer: %+v", msg)
+	}
+}
@@ -0,0 +1,146 @@
+// The CoolDNS Project. The simple dynamic dns server and update service.
+// Copyright (C) 2014 The CoolDNS Authors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.package main
+
+package cooldns
+
+import (
+	"errors"
+	"github.com/miekg/dns"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// Timing of notifies. Changes within notifyDelay are sent as one notify, a
+// target that does not answer for a zone is asked again after notifyBackoff,
+// doubling the wait every time up to notifyRetries attempts.
+var (
+	notifyDelay   = time.Second
+	notifyBackoff = 2 * time.Second
+	notifyRetries = 5
+	notifyTimeout = 2 * time.Second
+)
+
+// Sends RFC 1996 NOTIFY messages to the secondaries after every change
+type notifier struct {
+	h       *dnsHandler
+	targets []string
+	changed chan struct{}
+}
+
+func newNotifier(h *dnsHandler, targets []string) *notifier {
+	n := &notifier{
+		h:       h,
+		changed: make(chan struct{}, 1),
+	}
+	for _, target := range targets {
+		// Targets without a port use the standard DNS port
+		if _, _, err := net.SplitHostPort(target); err != nil {
+			target = net.JoinHostPort(target, "53")
+		}
+		n.targets = append(n.targets, target)
+	}
+	h.db.OnChange(n.trigger)
+	go n.run()
+	return n
+}
+
+// Mark the zone as changed without blocking the database
+func (n *notifier) trigger(serial uint32) {
+	select {
+	case n.changed <- struct{}{}:
+	default:
+		// A notify is already pending
+	}
+}
+
+func (n *notifier) run() {
+	for _ = range n.changed {
+		// Wait for more changes of a burst, they are covered by this notify
+		time.Sleep(notifyDelay)
+		select {
+		case <-n.changed:
+		default:
+		}
+
+		var wg sync.WaitGroup
+		for _, target := range n.targets {
+			for _, zone := range n.h.zones {
+				wg.Add(1)
+				go func(target, zone string) {
+					defer wg.Done()
+					n.notify(target, zone)
+				}(target, zone.domain)
+			}
+		}
+		// Changes during the retries are collected for the next round
+		wg.Wait()
+	}
+}
+
+// A target that is not a secondary of the zone answers NOTAUTH or REFUSED,
+// asking again does not change its mind
+type notifyRefused int
+
+func (rcode notifyRefused) Error() string {
+	return "Refused with " + dns.RcodeToString[int(rcode)]
+}
+
+// Send a notify about a zone to a single target, retrying until it is
+// acknowledged or refused
+func (n *notifier) notify(target, zone string) {
+	backoff := notifyBackoff
+	for i := 0; i < notifyRetries; i++ {
+		err := n.send(target, zone)
+		if err == nil {
+			return
+		}
+		if _, ok := err.(notifyRefused); ok {
+			log.Printf("Notify: %s for %s: %s", target, zone, err)
+			return
+		}
+		log.Printf("Notify: %s for %s failed (attempt %d): %s", target, zone, i+1, err)
+		if i < notifyRetries-1 {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+	}
+	log.Println("Notify: Giving up on", target, "for", zone)
+}
+
+func (n *notifier) send(target, zone string) error {
+	h := n.h
+	m := new(dns.Msg)
+	m.SetNotify(zone)
+	m.Answer = []dns.RR{h.soa(zone)}
+	c := &dns.Client{Timeout: notifyTimeout}
+	if h.tsigkey != "" {
+		c.TsigSecret = map[string]string{zone: h.tsigkey}
+		m.SetTsig(zone, dns.HmacSHA256, 300, time.Now().Unix())
+	}
+	in, _, err := c.Exchange(m, target)
+	if err != nil {
+		return err
+	}
+	if in.Rcode == dns.RcodeNotAuth || in.Rcode == dns.RcodeRefused {
+		return notifyRefused(in.Rcode)
+	}
+	if in.Opcode != dns.OpcodeNotify || in.Rcode != dns.RcodeSuccess {
+		return errors.New("Unexpected response " + dns.RcodeToString[in.Rcode])
+	}
+	return nil
+}
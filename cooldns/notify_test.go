@@ -0,0 +1,156 @@
+// The CoolDNS Project. The simple dynamic dns server and update service.
+// Copyright (C) 2014 The CoolDNS Authors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.package main
+
+package cooldns
+
+import (
+	"github.com/miekg/dns"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Notifies are sent and retried quickly in the tests. The notifiers of
+// earlier tests keep running, the timing is set once for all of them.
+func init() {
+	notifyDelay = 100 * time.Millisecond
+	notifyTimeout = 100 * time.Millisecond
+	notifyBackoff = 10 * time.Millisecond
+}
+
+// A secondary that records the serials of all signed notifies it
+// acknowledges. The first drop notifies are ignored.
+func startSecondary(t *testing.T, key string, drop int32) (string, chan uint32) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Failed to listen:", err)
+	}
+	serials := make(chan uint32, 100)
+	handler := func(w dns.ResponseWriter, r *dns.Msg) {
+		if r.Opcode != dns.OpcodeNotify || r.IsTsig() == nil || w.TsigStatus() != nil {
+			t.Error("Received unexpected message:", r)
+			return
+		}
+		// The handler runs on the goroutines of the server
+		if atomic.AddInt32(&drop, -1) >= 0 {
+			return
+		}
+		serials <- r.Answer[0].(*dns.SOA).Serial
+		m := new(dns.Msg)
+		m.SetReply(r)
+		m.SetTsig(r.IsTsig().Hdr.Name, dns.HmacSHA256, 300, time.Now().Unix())
+		w.WriteMsg(m)
+	}
+	server := &dns.Server{
+		PacketConn:    pc,
+		Handler:       dns.HandlerFunc(handler),
+		TsigSecret:    map[string]string{"ist.nicht.cool.": key},
+		MsgAcceptFunc: acceptMsg,
+	}
+	go server.ActivateAndServe()
+	return pc.LocalAddr().String(), serials
+}
+
+func TestDnsNotify(t *testing.T) {
+	db, err := getTmpDB()
+	if err != nil {
+		t.Fatal("Failed to create temporary DB")
+	}
+	key, _ := NewTsigKey()
+	secondary, serials := startSecondary(t, key, 1)
+	startDnsServerConfig(db, &DnsServerConfig{
+		Domain:  "ist.nicht.cool.",
+		TsigKey: key,
+		Notify:  []string{secondary},
+	})
+
+	// A burst of changes results in a single notify with the last serial
+	for i := 0; i < 5; i++ {
+		db.SaveEntry(genRandEntry())
+	}
+	select {
+	case serial := <-serials:
+		if serial != db.Serial() {
+			t.Errorf("Notify has serial %d, expected %d", serial, db.Serial())
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("No notify received")
+	}
+	select {
+	case serial := <-serials:
+		t.Error("Burst was not coalesced, got another notify with serial", serial)
+	case <-time.After(3 * notifyDelay):
+	}
+}
+
+func TestDnsNotifyRefused(t *testing.T) {
+	db, err := getTmpDB()
+	if err != nil {
+		t.Fatal("Failed to create temporary DB")
+	}
+	key, _ := NewTsigKey()
+
+	// The target is a secondary of ist.nicht.cool. only and ignores the
+	// first notify for it
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Failed to listen:", err)
+	}
+	var refused, dropped int32 = 0, 1
+	acked := make(chan string, 10)
+	handler := func(w dns.ResponseWriter, r *dns.Msg) {
+		zone := r.Question[0].Name
+		m := new(dns.Msg)
+		switch {
+		case zone != "ist.nicht.cool.":
+			// Secondaries do not know the keys of other zones
+			atomic.AddInt32(&refused, 1)
+			m.SetRcode(r, dns.RcodeNotAuth)
+			w.WriteMsg(m)
+		case atomic.AddInt32(&dropped, -1) >= 0:
+		default:
+			acked <- zone
+			m.SetReply(r)
+			m.SetTsig(zone, dns.HmacSHA256, 300, time.Now().Unix())
+			w.WriteMsg(m)
+		}
+	}
+	server := &dns.Server{
+		PacketConn:    pc,
+		Handler:       dns.HandlerFunc(handler),
+		TsigSecret:    map[string]string{"ist.nicht.cool.": key},
+		MsgAcceptFunc: acceptMsg,
+	}
+	go server.ActivateAndServe()
+	startDnsServerConfig(db, &DnsServerConfig{
+		Domain:  "ist.nicht.cool.",
+		TsigKey: key,
+		Notify:  []string{pc.LocalAddr().String()},
+		Zones:   []*ZoneConfig{&ZoneConfig{Domain: "sehr.cool."}},
+	})
+
+	db.SaveEntry(genRandEntry())
+	select {
+	case <-acked:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Zone of the target was not notified")
+	}
+	time.Sleep(5 * notifyBackoff)
+	if n := atomic.LoadInt32(&refused); n != 1 {
+		t.Errorf("Refused zone was notified %d times, expected once", n)
+	}
+}
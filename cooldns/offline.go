@@ -0,0 +1,105 @@
+// The CoolDNS Project. The simple dynamic dns server and update service.
+// Copyright (C) 2014 The CoolDNS Authors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.package main
+
+package cooldns
+
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	"net"
+)
+
+// What an offline entry answers, set in Entry.OfflineMode
+const (
+	// The name does not exist, the default
+	OfflineNxdomain = "nxdomain"
+	// The parking addresses or host of the zone
+	OfflineParking = "parking"
+	// The last records, with an additional TXT record offlineMarker
+	OfflineLast = "last"
+)
+
+// TXT record added to entries that are offline in OfflineLast mode
+const offlineMarker = "cooldns: offline"
+
+// Checks if s is a known offline mode, empty means OfflineNxdomain
+func isOfflineMode(s string) bool {
+	return s == "" || s == OfflineNxdomain || s == OfflineParking || s == OfflineLast
+}
+
+// Offline entries that do not exist in the zone
+func (e *Entry) hidden() bool {
+	return e.Offline && e.OfflineMode != OfflineParking && e.OfflineMode != OfflineLast
+}
+
+// Entries that serve their own records
+func (e *Entry) serving() bool {
+	return !e.Offline || e.OfflineMode == OfflineLast
+}
+
+// Parking addresses or host name of the zone
+type parking struct {
+	ip4s, ip6s []net.IP
+	host       string
+}
+
+func newParking(targets []string) (*parking, error) {
+	p := new(parking)
+	for _, target := range targets {
+		ip := net.ParseIP(target)
+		switch {
+		case ip == nil && p.host == "":
+			if _, ok := dns.IsDomainName(target); !ok {
+				return nil, fmt.Errorf("%s is neither an address nor a host name", target)
+			}
+			p.host = dns.Fqdn(target)
+		case ip == nil:
+			return nil, fmt.Errorf("More than one parking host")
+		case ip.To4() != nil:
+			p.ip4s = append(p.ip4s, ip)
+		default:
+			p.ip6s = append(p.ip6s, ip)
+		}
+	}
+	if p.host != "" && len(p.ip4s)+len(p.ip6s) != 0 {
+		return nil, fmt.Errorf("Parking host and addresses are exclusive")
+	}
+	return p, nil
+}
+
+// The entry as it is served, offline entries according to their mode. nil
+// if the entry does not exist.
+func (h *dnsHandler) servedEntry(e *Entry) *Entry {
+	switch {
+	case !e.Offline:
+		return e
+	case e.OfflineMode == OfflineParking:
+		// Without parking the name exists without records
+		return &Entry{
+			Hostname: e.Hostname,
+			Ttl:      e.Ttl,
+			Wildcard: e.Wildcard,
+			Cname:    h.parking.host,
+			Ip4s:     h.parking.ip4s,
+			Ip6s:     h.parking.ip6s,
+		}
+	case e.OfflineMode == OfflineLast:
+		served := e.Copy()
+		served.Txts = append(served.Txts, offlineMarker)
+		return served
+	}
+	return nil
+}
@@ -0,0 +1,138 @@
+// The CoolDNS Project. The simple dynamic dns server and update service.
+// Copyright (C) 2014 The CoolDNS Authors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.package main
+
+package cooldns
+
+import (
+	"github.com/miekg/dns"
+	"math/rand"
+	"net"
+	"sync"
+)
+
+// How the addresses of an entry are ordered in answers, set in
+// Entry.AnswerPolicy
+const (
+	// The order they are stored in, the default
+	AnswerFixed = "fixed"
+	// Rotated by one address with every answer
+	AnswerRoundRobin = "roundrobin"
+	// A random order for every answer
+	AnswerShuffle = "shuffle"
+	// A single address, picked at random according to Entry.Weights
+	AnswerWeighted = "weighted"
+)
+
+// Checks if s is a known answer policy, empty means AnswerFixed
+func isAnswerPolicy(s string) bool {
+	return s == "" || s == AnswerFixed || s == AnswerRoundRobin || s == AnswerShuffle || s == AnswerWeighted
+}
+
+// Weight of an address in AnswerWeighted mode, addresses without a weight
+// count once
+func (e *Entry) weight(ip net.IP) uint32 {
+	if w, ok := e.Weights[ip.String()]; ok {
+		return w
+	}
+	return 1
+}
+
+func (e *Entry) validateWeights() (errors []string) {
+	if !isAnswerPolicy(e.AnswerPolicy) {
+		errors = append(errors, "Unknown answer policy")
+	}
+	for ip := range e.Weights {
+		if net.ParseIP(ip) == nil {
+			errors = append(errors, "Malformatted Ip Address")
+		}
+	}
+	return errors
+}
+
+// Positions of the entries that rotate their answers, by hostname and type
+type rotation struct {
+	sync.Mutex
+	next map[rotationKey]int
+}
+
+type rotationKey struct {
+	hostname string
+	qtype    uint16
+}
+
+func newRotation() *rotation {
+	return &rotation{next: make(map[rotationKey]int)}
+}
+
+// Offset of the next answer of an entry for n addresses
+func (r *rotation) offset(hostname string, qtype uint16, n int) int {
+	r.Lock()
+	defer r.Unlock()
+	key := rotationKey{hostname, qtype}
+	offset := r.next[key] % n
+	r.next[key] = offset + 1
+	return offset
+}
+
+// Address of an A or AAAA record
+func recordIp(rr dns.RR) net.IP {
+	switch rr := rr.(type) {
+	case *dns.A:
+		return rr.A
+	case *dns.AAAA:
+		return rr.AAAA
+	}
+	return nil
+}
+
+// Address records of an entry ordered by its answer policy. Transfers and
+// glue keep the stored order.
+func (h *dnsHandler) order(entry *Entry, rrs []dns.RR) []dns.RR {
+	if len(rrs) < 2 || recordIp(rrs[0]) == nil {
+		return rrs
+	}
+	ordered := make([]dns.RR, len(rrs))
+	switch entry.AnswerPolicy {
+	case AnswerRoundRobin:
+		offset := h.rotation.offset(entry.Hostname, rrs[0].Header().Rrtype, len(rrs))
+		copy(ordered, rrs[offset:])
+		copy(ordered[len(rrs)-offset:], rrs[:offset])
+	case AnswerShuffle:
+		for i, j := range rand.Perm(len(rrs)) {
+			ordered[i] = rrs[j]
+		}
+	case AnswerWeighted:
+		var total uint64
+		for _, rr := range rrs {
+			total += uint64(entry.weight(recordIp(rr)))
+		}
+		// Without any weight all addresses are answered
+		if total == 0 {
+			return rrs
+		}
+		pick := uint64(rand.Int63n(int64(total)))
+		for _, rr := range rrs {
+			w := uint64(entry.weight(recordIp(rr)))
+			if pick < w {
+				return []dns.RR{rr}
+			}
+			pick -= w
+		}
+	default:
+		return rrs
+	}
+	return ordered
+}
@@ -0,0 +1,140 @@
+// The CoolDNS Project. The simple dynamic dns server and update service.
+// Copyright (C) 2014 The CoolDNS Authors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.package main
+
+package cooldns
+
+import (
+	"github.com/miekg/dns"
+	"net"
+	"testing"
+)
+
+func addressRecords(ips ...string) []dns.RR {
+	var rrs []dns.RR
+	for _, ip := range ips {
+		rr := new(dns.A)
+		rr.Hdr = dns.RR_Header{Name: "host.ist.nicht.cool.", Rrtype: dns.TypeA, Class: dns.ClassINET}
+		rr.A = net.ParseIP(ip)
+		rrs = append(rrs, rr)
+	}
+	return rrs
+}
+
+func recordIps(rrs []dns.RR) (ips []string) {
+	for _, rr := range rrs {
+		ips = append(ips, recordIp(rr).String())
+	}
+	return ips
+}
+
+func TestAnswerOrder(t *testing.T) {
+	h := &dnsHandler{rotation: newRotation()}
+	rrs := addressRecords("10.0.0.1", "10.0.0.2", "10.0.0.3")
+	e := &Entry{Hostname: "host.ist.nicht.cool."}
+
+	if got := recordIps(h.order(e, rrs)); got[0] != "10.0.0.1" || got[2] != "10.0.0.3" {
+		t.Error("Fixed order was changed:", got)
+	}
+
+	e.AnswerPolicy = AnswerRoundRobin
+	for _, first := range []string{"10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.1"} {
+		got := recordIps(h.order(e, rrs))
+		if len(got) != 3 || got[0] != first {
+			t.Errorf("Expected rotation to start at %s, got %v", first, got)
+		}
+	}
+	if rrs[0].(*dns.A).A.String() != "10.0.0.1" {
+		t.Error("Stored order was changed")
+	}
+
+	e.AnswerPolicy = AnswerShuffle
+	seen := make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		got := h.order(e, rrs)
+		if len(got) != 3 {
+			t.Fatal("Shuffle lost addresses:", got)
+		}
+		seen[recordIp(got[0]).String()] = true
+	}
+	if len(seen) != 3 {
+		t.Error("Shuffle did not vary the first address:", seen)
+	}
+
+	e.AnswerPolicy = AnswerWeighted
+	e.Weights = map[string]uint32{"10.0.0.1": 0, "10.0.0.2": 3}
+	counts := make(map[string]int)
+	for i := 0; i < 400; i++ {
+		got := h.order(e, rrs)
+		if len(got) != 1 {
+			t.Fatal("Weighted answer is not a single address:", got)
+		}
+		counts[recordIp(got[0]).String()]++
+	}
+	if counts["10.0.0.1"] != 0 || counts["10.0.0.2"] < counts["10.0.0.3"] {
+		t.Error("Unexpected distribution of weighted answers:", counts)
+	}
+	e.Weights = map[string]uint32{"10.0.0.1": 0, "10.0.0.2": 0, "10.0.0.3": 0}
+	if got := h.order(e, rrs); len(got) != 3 {
+		t.Error("Addresses without weights were not all answered:", got)
+	}
+}
+
+func TestDnsAnswerPolicy(t *testing.T) {
+	tmpFile, err := getTmpFile()
+	if err != nil {
+		t.Fatal("Failed to create temporary file")
+	}
+	db, err := getDB(tmpFile)
+	if err != nil {
+		t.Fatal("Failed to create DB:", err)
+	}
+	err = db.SaveEntry(&Entry{
+		Hostname:     "rr.ist.nicht.cool.",
+		Ip4s:         []net.IP{net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.2")},
+		Weights:      map[string]uint32{"10.0.0.2": 5},
+		AnswerPolicy: AnswerRoundRobin,
+	})
+	if err != nil {
+		t.Fatal("Failed to save entry:", err)
+	}
+	// Policy and weights are stored
+	db.Close()
+	db, err = getDB(tmpFile)
+	if err != nil {
+		t.Fatal("Failed to reopen DB:", err)
+	}
+	e := db.GetEntry("rr.ist.nicht.cool.")
+	if e == nil || e.AnswerPolicy != AnswerRoundRobin || e.Weights["10.0.0.2"] != 5 {
+		t.Fatal("Answer policy was not stored:", e)
+	}
+
+	port := startDnsServer(db, "")
+	var first []string
+	for i := 0; i < 2; i++ {
+		in, err := dnsQuery(port, "rr.ist.nicht.cool.", dns.TypeA)
+		if err != nil || len(in.Answer) != 2 {
+			t.Fatal("Unexpected answer:", in, err)
+		}
+		first = append(first, recordIp(in.Answer[0]).String())
+	}
+	if first[0] == first[1] {
+		t.Error("Answers were not rotated:", first)
+	}
+
+	if errs := (&Entry{AnswerPolicy: "sometimes"}).validateWeights(); len(errs) != 1 {
+		t.Error("Unknown answer policy was accepted:", errs)
+	}
+}
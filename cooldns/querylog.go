@@ -0,0 +1,483 @@
+// The CoolDNS Project. The simple dynamic dns server and update service.
+// Copyright (C) 2014 The CoolDNS Authors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.package main
+
+package cooldns
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/miekg/dns"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Formats of the query log
+const (
+	QueryLogDnstap = "dnstap"
+	QueryLogJson   = "json"
+)
+
+// Entries waiting to be written. If the queue is full, entries are dropped
+// so logging never delays answers.
+const queryLogQueue = 4096
+
+// Time to wait before the query log socket is connected again
+var queryLogRetry = 5 * time.Second
+
+// A query and its response. The response is nil if none was sent, e.g.
+// because of the response rate limit.
+type queryLogEntry struct {
+	proto    string // udp, tcp, tcp-tls or https
+	client   net.Addr
+	start    time.Time
+	end      time.Time
+	query    *dns.Msg
+	response *dns.Msg
+}
+
+// Encoding of the entries in the log
+type queryLogFormat interface {
+	// Handshake and header when the destination is opened, bidirectional
+	// is set for sockets
+	open(rw io.ReadWriter, bidirectional bool) error
+	write(w io.Writer, e *queryLogEntry) error
+	// Finish a file written before, false if the format continues it
+	finish(f *os.File) (bool, error)
+}
+
+// Logs queries asynchronously to a file or socket
+type queryLogger struct {
+	dest    string
+	format  queryLogFormat
+	sample  uint64
+	count   uint64
+	dropped uint64
+	queue   chan *queryLogEntry
+}
+
+func newQueryLogger(dest, format string, sample int) (*queryLogger, error) {
+	l := &queryLogger{
+		dest:   dest,
+		sample: 1,
+		queue:  make(chan *queryLogEntry, queryLogQueue),
+	}
+	if sample > 1 {
+		l.sample = uint64(sample)
+	}
+	switch format {
+	case "", QueryLogDnstap:
+		l.format = newDnstapFormat()
+	case QueryLogJson:
+		l.format = jsonFormat{}
+	default:
+		return nil, fmt.Errorf("Unknown query log format %q", format)
+	}
+	go l.run()
+	return l, nil
+}
+
+// Whether the next query is logged
+func (l *queryLogger) sampled() bool {
+	return atomic.AddUint64(&l.count, 1)%l.sample == 0
+}
+
+func (l *queryLogger) log(e *queryLogEntry) {
+	select {
+	case l.queue <- e:
+	default:
+		atomic.AddUint64(&l.dropped, 1)
+	}
+}
+
+// Records the response written by the handler
+type queryLogWriter struct {
+	dns.ResponseWriter
+	response *dns.Msg
+}
+
+func (w *queryLogWriter) WriteMsg(m *dns.Msg) error {
+	// Zone transfers write many messages, the first one is enough
+	if w.response == nil {
+		w.response = m
+	}
+	return w.ResponseWriter.WriteMsg(m)
+}
+
+// Handler of a listener, queries are logged if a query log is configured
+func (h *dnsHandler) handler(proto string) dns.HandlerFunc {
+	if h.queryLog == nil {
+		return h.handleRequest
+	}
+	return func(w dns.ResponseWriter, r *dns.Msg) {
+		if !h.queryLog.sampled() {
+			h.handleRequest(w, r)
+			return
+		}
+		lw := &queryLogWriter{ResponseWriter: w}
+		start := time.Now()
+		h.handleRequest(lw, r)
+		h.queryLog.log(&queryLogEntry{
+			proto:    proto,
+			client:   w.RemoteAddr(),
+			start:    start,
+			end:      time.Now(),
+			query:    r,
+			response: lw.response,
+		})
+	}
+}
+
+// Open the destination, a file, "-" for stdout or unix:<path> for a socket
+func (l *queryLogger) open() (io.WriteCloser, error) {
+	var (
+		dest          io.ReadWriteCloser
+		err           error
+		bidirectional bool
+	)
+	switch {
+	case l.dest == "-":
+		dest = os.Stdout
+	case strings.HasPrefix(l.dest, "unix:"):
+		dest, err = net.Dial("unix", strings.TrimPrefix(l.dest, "unix:"))
+		bidirectional = true
+	default:
+		dest, err = l.openFile()
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = l.format.open(dest, bidirectional); err != nil {
+		dest.Close()
+		return nil, err
+	}
+	return dest, nil
+}
+
+// Open the log file. Files that the format can not continue are finished
+// and moved aside to <file>.<time>, the log starts in a new file.
+func (l *queryLogger) openFile() (*os.File, error) {
+	f, err := os.OpenFile(l.dest, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if info.Size() == 0 {
+		return f, nil
+	}
+	finished, err := l.format.finish(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if !finished {
+		return f, nil
+	}
+	f.Close()
+	// Files moved aside within the same second are numbered
+	stamp := l.dest + "." + time.Now().UTC().Format("20060102T150405")
+	moved := stamp
+	for i := 1; ; i++ {
+		if _, err := os.Stat(moved); os.IsNotExist(err) {
+			break
+		}
+		moved = fmt.Sprintf("%s-%d", stamp, i)
+	}
+	if err = os.Rename(l.dest, moved); err != nil {
+		return nil, err
+	}
+	return os.OpenFile(l.dest, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+}
+
+// Write the queued entries, the destination is opened again after errors
+func (l *queryLogger) run() {
+	var (
+		dest   io.WriteCloser
+		buf    *bufio.Writer
+		failed time.Time
+	)
+	for e := range l.queue {
+		if dest == nil && time.Since(failed) > queryLogRetry {
+			var err error
+			if dest, err = l.open(); err != nil {
+				log.Println("Query log: Failed to open:", err)
+				failed = time.Now()
+			} else {
+				buf = bufio.NewWriter(dest)
+			}
+		}
+		if dest == nil {
+			atomic.AddUint64(&l.dropped, 1)
+			continue
+		}
+		err := l.format.write(buf, e)
+		// Flush when there is nothing left to do
+		if err == nil && len(l.queue) == 0 {
+			err = buf.Flush()
+		}
+		if err != nil {
+			log.Println("Query log: Failed to write:", err)
+			if dest != os.Stdout {
+				dest.Close()
+			}
+			dest = nil
+			failed = time.Now()
+		}
+		if dropped := atomic.SwapUint64(&l.dropped, 0); dropped != 0 {
+			log.Printf("Query log: Dropped %d entries\n", dropped)
+		}
+	}
+}
+
+// One line of JSON per query
+type jsonFormat struct{}
+
+type jsonEntry struct {
+	Time    time.Time `json:"time"`
+	Proto   string    `json:"proto"`
+	Client  string    `json:"client"`
+	Qname   string    `json:"qname,omitempty"`
+	Qtype   string    `json:"qtype,omitempty"`
+	Rcode   string    `json:"rcode,omitempty"`
+	Dropped bool      `json:"dropped,omitempty"`
+	Latency float64   `json:"latency_ms"`
+}
+
+func (f jsonFormat) open(rw io.ReadWriter, bidirectional bool) error {
+	return nil
+}
+
+// Lines are simply appended
+func (f jsonFormat) finish(file *os.File) (bool, error) {
+	return false, nil
+}
+
+func (f jsonFormat) write(w io.Writer, e *queryLogEntry) error {
+	entry := jsonEntry{
+		Time:    e.start.UTC(),
+		Proto:   e.proto,
+		Client:  e.client.String(),
+		Latency: float64(e.end.Sub(e.start)) / float64(time.Millisecond),
+	}
+	if len(e.query.Question) != 0 {
+		entry.Qname = e.query.Question[0].Name
+		entry.Qtype = dns.Type(e.query.Question[0].Qtype).String()
+	}
+	if e.response != nil {
+		entry.Rcode = dns.RcodeToString[e.response.Rcode]
+	} else {
+		entry.Dropped = true
+	}
+	data, err := json.Marshal(&entry)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(data, '\n'))
+	return err
+}
+
+// dnstap (https://dnstap.info) messages in Frame Streams. Every query
+// becomes an AUTH_RESPONSE message carrying query and response, or an
+// AUTH_QUERY message if no response was sent.
+type dnstapFormat struct {
+	identity []byte
+}
+
+func newDnstapFormat() *dnstapFormat {
+	f := new(dnstapFormat)
+	if hostname, err := os.Hostname(); err == nil {
+		f.identity = []byte(hostname)
+	}
+	return f
+}
+
+const dnstapContentType = "protobuf:dnstap.Dnstap"
+
+// Frame Streams control frames
+const (
+	fstrmAccept = 1
+	fstrmStart  = 2
+	fstrmStop   = 3
+	fstrmReady  = 4
+
+	fstrmContentType = 1
+)
+
+// Write a control frame with the content type
+func writeControl(w io.Writer, control uint32) error {
+	frame := make([]byte, 20, 20+len(dnstapContentType))
+	binary.BigEndian.PutUint32(frame[4:], uint32(12+len(dnstapContentType)))
+	binary.BigEndian.PutUint32(frame[8:], control)
+	binary.BigEndian.PutUint32(frame[12:], fstrmContentType)
+	binary.BigEndian.PutUint32(frame[16:], uint32(len(dnstapContentType)))
+	_, err := w.Write(append(frame, dnstapContentType...))
+	return err
+}
+
+// Read a control frame and return its type
+func readControl(r io.Reader) (uint32, error) {
+	var header [8]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, err
+	}
+	length := binary.BigEndian.Uint32(header[4:])
+	if binary.BigEndian.Uint32(header[:]) != 0 || length < 4 || length > 512 {
+		return 0, errors.New("Malformatted control frame")
+	}
+	frame := make([]byte, length)
+	if _, err := io.ReadFull(r, frame); err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint32(frame), nil
+}
+
+// Sockets are bidirectional, the reader has to accept the content type
+func (f *dnstapFormat) open(rw io.ReadWriter, bidirectional bool) error {
+	if bidirectional {
+		if err := writeControl(rw, fstrmReady); err != nil {
+			return err
+		}
+		control, err := readControl(rw)
+		if err != nil {
+			return err
+		}
+		if control != fstrmAccept {
+			return errors.New("Content type was not accepted")
+		}
+	}
+	return writeControl(rw, fstrmStart)
+}
+
+// A stream has a single START, so a new file is started. The old one gets a
+// STOP frame unless it already ends with one.
+func (f *dnstapFormat) finish(file *os.File) (bool, error) {
+	stop := make([]byte, 12)
+	binary.BigEndian.PutUint32(stop[4:], 4)
+	binary.BigEndian.PutUint32(stop[8:], fstrmStop)
+	info, err := file.Stat()
+	if err != nil {
+		return false, err
+	}
+	tail := make([]byte, len(stop))
+	if info.Size() >= int64(len(stop)) {
+		if _, err := file.ReadAt(tail, info.Size()-int64(len(stop))); err != nil {
+			return false, err
+		}
+	}
+	if string(tail) != string(stop) {
+		if _, err := file.Write(stop); err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+func (f *dnstapFormat) write(w io.Writer, e *queryLogEntry) error {
+	data := f.encode(e)
+	frame := make([]byte, 4, 4+len(data))
+	binary.BigEndian.PutUint32(frame, uint32(len(data)))
+	_, err := w.Write(append(frame, data...))
+	return err
+}
+
+// Protocol buffer encoding of the fields used by dnstap
+type protobuf []byte
+
+func (p protobuf) varint(field int, v uint64) protobuf {
+	p = binary.AppendUvarint(p, uint64(field<<3))
+	return binary.AppendUvarint(p, v)
+}
+
+func (p protobuf) fixed32(field int, v uint32) protobuf {
+	p = binary.AppendUvarint(p, uint64(field<<3|5))
+	return binary.LittleEndian.AppendUint32(p, v)
+}
+
+func (p protobuf) bytes(field int, v []byte) protobuf {
+	p = binary.AppendUvarint(p, uint64(field<<3|2))
+	p = binary.AppendUvarint(p, uint64(len(v)))
+	return append(p, v...)
+}
+
+// Values of the dnstap enums
+const (
+	dnstapMessage      = 1
+	dnstapAuthQuery    = 1
+	dnstapAuthResponse = 2
+	dnstapInet         = 1
+	dnstapInet6        = 2
+	dnstapUdp          = 1
+	dnstapTcp          = 2
+	dnstapDot          = 3
+	dnstapDoh          = 4
+)
+
+func (f *dnstapFormat) encode(e *queryLogEntry) []byte {
+	var msg protobuf
+	if e.response != nil {
+		msg = msg.varint(1, dnstapAuthResponse)
+	} else {
+		msg = msg.varint(1, dnstapAuthQuery)
+	}
+
+	ip, port := clientAddr(e.client)
+	if ip4 := ip.To4(); ip4 != nil {
+		msg = msg.varint(2, dnstapInet).bytes(4, ip4)
+	} else if ip != nil {
+		msg = msg.varint(2, dnstapInet6).bytes(4, ip)
+	}
+	switch e.proto {
+	case "udp":
+		msg = msg.varint(3, dnstapUdp)
+	case "tcp":
+		msg = msg.varint(3, dnstapTcp)
+	case "tcp-tls":
+		msg = msg.varint(3, dnstapDot)
+	case "https":
+		msg = msg.varint(3, dnstapDoh)
+	}
+	if ip != nil {
+		msg = msg.varint(6, uint64(port))
+	}
+
+	msg = msg.varint(8, uint64(e.start.Unix())).fixed32(9, uint32(e.start.Nanosecond()))
+	if query, err := e.query.Pack(); err == nil {
+		msg = msg.bytes(10, query)
+	}
+	if e.response != nil {
+		msg = msg.varint(12, uint64(e.end.Unix())).fixed32(13, uint32(e.end.Nanosecond()))
+		if response, err := e.response.Pack(); err == nil {
+			msg = msg.bytes(14, response)
+		}
+	}
+
+	var tap protobuf
+	if f.identity != nil {
+		tap = tap.bytes(1, f.identity)
+	}
+	return tap.bytes(2, []byte("cooldns")).bytes(14, msg).varint(15, dnstapMessage)
+}
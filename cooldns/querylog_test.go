@@ -0,0 +1,276 @@
+// The CoolDNS Project. The simple dynamic dns server and update service.
+// Copyright (C) 2014 The CoolDNS Authors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.package main
+
+package cooldns
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"github.com/miekg/dns"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestQueryLogSample(t *testing.T) {
+	l := &queryLogger{sample: 3}
+	sampled := 0
+	for i := 0; i < 9; i++ {
+		if l.sampled() {
+			sampled++
+		}
+	}
+	if sampled != 3 {
+		t.Error("Expected 3 sampled queries, got", sampled)
+	}
+}
+
+func TestQueryLogJson(t *testing.T) {
+	file, err := getTmpFile()
+	if err != nil {
+		t.Fatal("Failed to create temporary file")
+	}
+	db, err := getTmpDB()
+	if err != nil {
+		t.Fatal("Failed to create temporary DB")
+	}
+	db.SaveEntry(&Entry{
+		Hostname: "log.ist.nicht.cool.",
+		Ip4s:     []net.IP{net.ParseIP("192.168.0.1")},
+	})
+	port := startDnsServerConfig(db, &DnsServerConfig{
+		Domain:         "ist.nicht.cool.",
+		QueryLog:       file,
+		QueryLogFormat: QueryLogJson,
+	})
+	if _, err := dnsQuery(port, "log.ist.nicht.cool.", dns.TypeA); err != nil {
+		t.Fatal("Query failed:", err)
+	}
+	if _, err := dnsQuery(port, "missing.ist.nicht.cool.", dns.TypeAAAA); err != nil {
+		t.Fatal("Query failed:", err)
+	}
+
+	var entries []jsonEntry
+	for i := 0; i < 20 && len(entries) < 2; i++ {
+		time.Sleep(50 * time.Millisecond)
+		f, err := os.Open(file)
+		if err != nil {
+			t.Fatal("Failed to open the log:", err)
+		}
+		entries = nil
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			var entry jsonEntry
+			if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+				t.Fatal("Malformatted log line:", scanner.Text())
+			}
+			entries = append(entries, entry)
+		}
+		f.Close()
+	}
+	if len(entries) != 2 {
+		t.Fatal("Expected 2 log entries, got", entries)
+	}
+	if e := entries[0]; e.Qname != "log.ist.nicht.cool." || e.Qtype != "A" ||
+		e.Rcode != "NOERROR" || e.Proto != "udp" || e.Latency <= 0 {
+		t.Errorf("Unexpected entry: %+v", e)
+	}
+	if host, _, _ := net.SplitHostPort(entries[0].Client); host != "127.0.0.1" {
+		t.Error("Unexpected client:", entries[0].Client)
+	}
+	if e := entries[1]; e.Qname != "missing.ist.nicht.cool." || e.Qtype != "AAAA" ||
+		e.Rcode != "NXDOMAIN" {
+		t.Errorf("Unexpected entry: %+v", e)
+	}
+}
+
+// Read a frame, the length is 0 for control frames
+func readFrame(t *testing.T, r io.Reader) (uint32, []byte) {
+	var length uint32
+	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+		t.Fatal("Failed to read frame:", err)
+	}
+	if length == 0 {
+		binary.Read(r, binary.BigEndian, &length)
+	}
+	frame := make([]byte, length)
+	if _, err := io.ReadFull(r, frame); err != nil {
+		t.Fatal("Failed to read frame:", err)
+	}
+	return binary.BigEndian.Uint32(frame), frame
+}
+
+// Fields of a protocol buffer message, varints and fixed32 as number
+func decodeProtobuf(t *testing.T, data []byte) map[int]interface{} {
+	fields := make(map[int]interface{})
+	for len(data) > 0 {
+		key, n := binary.Uvarint(data)
+		data = data[n:]
+		switch key & 7 {
+		case 0:
+			v, n := binary.Uvarint(data)
+			fields[int(key>>3)] = v
+			data = data[n:]
+		case 2:
+			length, n := binary.Uvarint(data)
+			fields[int(key>>3)] = data[n : n+int(length)]
+			data = data[n+int(length):]
+		case 5:
+			fields[int(key>>3)] = uint64(binary.LittleEndian.Uint32(data))
+			data = data[4:]
+		default:
+			t.Fatal("Unexpected wire type", key&7)
+		}
+	}
+	return fields
+}
+
+func TestQueryLogDnstap(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cooldns")
+	if err != nil {
+		t.Fatal("Failed to create temporary directory")
+	}
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "dnstap.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal("Failed to listen:", err)
+	}
+	defer listener.Close()
+
+	db, err := getTmpDB()
+	if err != nil {
+		t.Fatal("Failed to create temporary DB")
+	}
+	db.SaveEntry(&Entry{
+		Hostname: "tap.ist.nicht.cool.",
+		Ip4s:     []net.IP{net.ParseIP("192.168.0.1")},
+	})
+	port := startDnsServerConfig(db, &DnsServerConfig{
+		Domain:   "ist.nicht.cool.",
+		QueryLog: "unix:" + socket,
+	})
+	if _, err := dnsQuery(port, "tap.ist.nicht.cool.", dns.TypeA); err != nil {
+		t.Fatal("Query failed:", err)
+	}
+
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatal("Failed to accept:", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	if control, _ := readFrame(t, conn); control != fstrmReady {
+		t.Fatal("Expected READY, got", control)
+	}
+	if err := writeControl(conn, fstrmAccept); err != nil {
+		t.Fatal("Failed to accept:", err)
+	}
+	if control, frame := readFrame(t, conn); control != fstrmStart ||
+		string(frame[12:]) != dnstapContentType {
+		t.Fatal("Expected START, got", frame)
+	}
+
+	_, frame := readFrame(t, conn)
+	tap := decodeProtobuf(t, frame)
+	if tap[15] != uint64(dnstapMessage) || string(tap[2].([]byte)) != "cooldns" {
+		t.Fatal("Unexpected dnstap message:", tap)
+	}
+	msg := decodeProtobuf(t, tap[14].([]byte))
+	if msg[1] != uint64(dnstapAuthResponse) || msg[2] != uint64(dnstapInet) ||
+		msg[3] != uint64(dnstapUdp) || !net.IP(msg[4].([]byte)).Equal(net.ParseIP("127.0.0.1")) {
+		t.Error("Unexpected message:", msg)
+	}
+	query, response := new(dns.Msg), new(dns.Msg)
+	if query.Unpack(msg[10].([]byte)) != nil || query.Question[0].Name != "tap.ist.nicht.cool." {
+		t.Error("Unexpected query:", query)
+	}
+	if response.Unpack(msg[14].([]byte)) != nil || len(response.Answer) != 1 {
+		t.Error("Unexpected response:", response)
+	}
+	if msg[12].(uint64) < msg[8].(uint64) {
+		t.Error("Response was sent before the query arrived:", msg)
+	}
+}
+
+// A dnstap file of an earlier run is finished and moved aside, the new file
+// starts its own stream
+func TestQueryLogDnstapReopen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cooldns")
+	if err != nil {
+		t.Fatal("Failed to create temporary directory")
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "queries.fstrm")
+	// A stream that was not stopped
+	var old bytes.Buffer
+	writeControl(&old, fstrmStart)
+	old.Write([]byte{0, 0, 0, 4, 1, 2, 3, 4})
+	if err := ioutil.WriteFile(file, old.Bytes(), 0640); err != nil {
+		t.Fatal("Failed to write the old log:", err)
+	}
+
+	for run := 0; run < 2; run++ {
+		l := &queryLogger{dest: file, format: newDnstapFormat()}
+		dest, err := l.open()
+		if err != nil {
+			t.Fatal("Failed to open the log:", err)
+		}
+		dest.Close()
+	}
+
+	moved, _ := filepath.Glob(file + ".*")
+	if len(moved) != 2 {
+		t.Fatal("Expected 2 finished files, got", moved)
+	}
+	for _, name := range moved {
+		f, err := os.Open(name)
+		if err != nil {
+			t.Fatal("Failed to open the finished log:", err)
+		}
+		if control, _ := readFrame(t, f); control != fstrmStart {
+			t.Errorf("%s does not start with START", name)
+		}
+		// The data frame of the old stream
+		if name == moved[0] {
+			readFrame(t, f)
+		}
+		if control, _ := readFrame(t, f); control != fstrmStop {
+			t.Errorf("%s does not end with STOP", name)
+		}
+		if rest, _ := ioutil.ReadAll(f); len(rest) != 0 {
+			t.Errorf("%s has %d bytes after STOP", name, len(rest))
+		}
+		f.Close()
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		t.Fatal("Failed to open the log:", err)
+	}
+	defer f.Close()
+	if control, _ := readFrame(t, f); control != fstrmStart {
+		t.Error("New log does not start with START")
+	}
+	if rest, _ := ioutil.ReadAll(f); len(rest) != 0 {
+		t.Errorf("New log has %d bytes after START", len(rest))
+	}
+}
@@ -0,0 +1,170 @@
+// The CoolDNS Project. The simple dynamic dns server and update service.
+// Copyright (C) 2014 The CoolDNS Authors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.package main
+
+package cooldns
+
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	"strings"
+)
+
+// Types that are stored as rdata in presentation format
+var rdataTypes = []uint16{
+	dns.TypeSRV,
+	dns.TypeCAA,
+	dns.TypePTR,
+	dns.TypeSSHFP,
+	dns.TypeTLSA,
+	dns.TypeHTTPS,
+	dns.TypeSVCB,
+}
+
+// The field of the entry holding the records of an rdata type
+func (e *Entry) rdata(rrtype uint16) *[]string {
+	switch rrtype {
+	case dns.TypeSRV:
+		return &e.Srvs
+	case dns.TypeCAA:
+		return &e.Caas
+	case dns.TypePTR:
+		return &e.Ptrs
+	case dns.TypeSSHFP:
+		return &e.Sshfps
+	case dns.TypeTLSA:
+		return &e.Tlsas
+	case dns.TypeHTTPS:
+		return &e.Https
+	case dns.TypeSVCB:
+		return &e.Svcbs
+	}
+	return nil
+}
+
+// Split a stored record into its owner below the hostname and the rdata.
+// The owner is empty for records of the hostname itself.
+func splitOwner(record string) (owner, rdata string) {
+	record = strings.TrimSpace(record)
+	if !strings.HasPrefix(record, "_") {
+		return "", record
+	}
+	i := strings.IndexAny(record, " \t")
+	if i < 0 {
+		return strings.ToLower(record), ""
+	}
+	return strings.ToLower(record[:i]), strings.TrimSpace(record[i:])
+}
+
+// Owner names below the hostname that have records
+func (e *Entry) owners() []string {
+	var owners []string
+	seen := make(map[string]bool)
+	for _, rrtype := range rdataTypes {
+		for _, record := range *e.rdata(rrtype) {
+			owner, _ := splitOwner(record)
+			if owner != "" && !seen[owner] {
+				seen[owner] = true
+				owners = append(owners, owner)
+			}
+		}
+	}
+	return owners
+}
+
+// Parse a record of the given type, owned by name
+func rdataRecord(name string, ttl uint32, rrtype uint16, rdata string) (dns.RR, error) {
+	rr, err := dns.NewRR(fmt.Sprintf("%s %d IN %s %s", name, ttl, dns.TypeToString[rrtype], rdata))
+	if err == nil && rr == nil {
+		err = fmt.Errorf("Empty %s record", dns.TypeToString[rrtype])
+	}
+	if err != nil {
+		return nil, err
+	}
+	// Some fields like hex strings are only checked when packed
+	_, err = dns.PackRR(rr, make([]byte, dns.MaxMsgSize), 0, nil, false)
+	return rr, err
+}
+
+// Records of the given type and owner, owned by name
+func (h *dnsHandler) rdataRecords(entry *Entry, owner, name string, qtype uint16) []dns.RR {
+	field := entry.rdata(qtype)
+	if field == nil {
+		return nil
+	}
+	var rrs []dns.RR
+	for _, record := range *field {
+		recordOwner, rdata := splitOwner(record)
+		if recordOwner != owner {
+			continue
+		}
+		// Records are validated before they are saved
+		rr, err := rdataRecord(name, h.ttl(entry), qtype, rdata)
+		if err == nil {
+			rrs = append(rrs, rr)
+		}
+	}
+	return rrs
+}
+
+// All records of an owner below the hostname
+func (h *dnsHandler) ownerRecords(entry *Entry, owner, name string) []dns.RR {
+	var rrs []dns.RR
+	for _, rrtype := range rdataTypes {
+		rrs = append(rrs, h.rdataRecords(entry, owner, name, rrtype)...)
+	}
+	return rrs
+}
+
+// Check the records of all rdata types of the entry
+func (e *Entry) validateRdata() (errors []string) {
+	for _, rrtype := range rdataTypes {
+		for _, record := range *e.rdata(rrtype) {
+			if err := validateRecord(rrtype, record); err != "" {
+				errors = append(errors, err)
+			}
+		}
+	}
+	return errors
+}
+
+func validateRecord(rrtype uint16, record string) string {
+	typeName := dns.TypeToString[rrtype]
+	owner, rdata := splitOwner(record)
+	var labels []string
+	if owner != "" {
+		labels = strings.Split(owner, ".")
+		for _, label := range labels {
+			if len(label) < 2 || !strings.HasPrefix(label, "_") {
+				return "Malformatted owner of " + typeName + " record"
+			}
+		}
+		if _, ok := dns.IsDomainName(owner); !ok {
+			return "Malformatted owner of " + typeName + " record"
+		}
+	}
+	// Services and TLS associations live below the host, e.g.
+	// _sip._udp or _443._tcp
+	if (rrtype == dns.TypeSRV || rrtype == dns.TypeTLSA) && len(labels) != 2 {
+		return typeName + " record needs an owner like _service._proto"
+	}
+	if strings.Contains(rdata, "\n") {
+		return "Malformatted " + typeName + " record"
+	}
+	if _, err := rdataRecord("host.", 0, rrtype, rdata); err != nil {
+		return "Malformatted " + typeName + " record"
+	}
+	return ""
+}
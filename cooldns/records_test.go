@@ -0,0 +1,62 @@
+// The CoolDNS Project. The simple dynamic dns server and update service.
+// Copyright (C) 2014 The CoolDNS Authors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.package main
+
+package cooldns
+
+import (
+	"github.com/miekg/dns"
+	"testing"
+)
+
+type recordTest struct {
+	Type      uint16
+	Record    string
+	Validates bool
+}
+
+var recordtests = []recordTest{
+	{dns.TypeSRV, "_sip._udp 10 5 5060 sip.ist.nicht.cool.", true},
+	{dns.TypeSRV, "_minecraft._tcp 0 0 25565 mc.ist.nicht.cool.", true},
+	// SRV records need a service and protocol
+	{dns.TypeSRV, "10 5 5060 sip.ist.nicht.cool.", false},
+	{dns.TypeSRV, "_sip 10 5 5060 sip.ist.nicht.cool.", false},
+	{dns.TypeSRV, "_sip._udp 10 5 sip.ist.nicht.cool.", false},
+	{dns.TypeSRV, "sip._udp 10 5 5060 sip.ist.nicht.cool.", false},
+	{dns.TypeCAA, `0 issue "letsencrypt.org"`, true},
+	{dns.TypeCAA, `0 iodef "mailto:admin@ist.nicht.cool"`, true},
+	{dns.TypeCAA, "issue letsencrypt.org", false},
+	{dns.TypePTR, "host.ist.nicht.cool.", true},
+	{dns.TypeSSHFP, "4 2 0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef", true},
+	{dns.TypeSSHFP, "4 2 kein hex", false},
+	{dns.TypeTLSA, "_443._tcp 3 1 1 0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef", true},
+	{dns.TypeTLSA, "3 1 1 0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef", false},
+	{dns.TypeHTTPS, "1 . alpn=h2,h3", true},
+	{dns.TypeHTTPS, "0 alias.ist.nicht.cool.", true},
+	{dns.TypeHTTPS, "1 . unbekannt=1", false},
+	{dns.TypeSVCB, "_dns 1 . alpn=dot", true},
+	{dns.TypeSVCB, "", false},
+}
+
+func TestValidateRecord(t *testing.T) {
+	for _, test := range recordtests {
+		err := validateRecord(test.Type, test.Record)
+		if test.Validates && err != "" {
+			t.Errorf("%s %q should validate: %s", dns.TypeToString[test.Type], test.Record, err)
+		} else if !test.Validates && err == "" {
+			t.Errorf("%s %q should not validate", dns.TypeToString[test.Type], test.Record)
+		}
+	}
+}
@@ -0,0 +1,208 @@
+// The CoolDNS Project. The simple dynamic dns server and update service.
+// Copyright (C) 2014 The CoolDNS Authors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.package main
+
+package cooldns
+
+import (
+	"github.com/miekg/dns"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Clients are grouped by prefix like BIND does, spoofed addresses usually
+// differ in the host bits only
+const (
+	rrlIp4Prefix = 24
+	rrlIp6Prefix = 56
+)
+
+// Buckets that were not used for rrlWindow are full again and are removed.
+// At most rrlMaxBuckets are tracked, further keys share a single bucket.
+var (
+	rrlWindow     = 15 * time.Second
+	rrlMaxBuckets = 100000
+)
+
+// Every second limited response slips by default
+const defaultRrlSlip = 2
+
+// What to do with a response
+type rrlAction int
+
+const (
+	rrlSend rrlAction = iota
+	rrlDrop
+	// Send an empty truncated response, real clients retry over TCP
+	rrlSlip
+)
+
+// Kinds of responses that are limited separately
+const (
+	rrlAnswer   = "answer"
+	rrlNodata   = "nodata"
+	rrlNxdomain = "nxdomain"
+	rrlError    = "error"
+)
+
+type rrlBucket struct {
+	tokens  float64
+	last    time.Time
+	limited int // responses limited since the bucket ran empty
+}
+
+// Response rate limiting with token buckets, keyed on the client prefix
+// and the kind of response.
+type rateLimiter struct {
+	sync.Mutex
+	rate    float64 // responses per second and bucket
+	slip    int     // every slip-th limited response slips, never if negative
+	buckets map[string]*rrlBucket
+	cleaned time.Time
+	now     func() time.Time
+	// Bucket of all keys that do not fit into a full table
+	overflow *rrlBucket
+}
+
+func newRateLimiter(rate uint32, slip int) *rateLimiter {
+	return &rateLimiter{
+		rate:    float64(rate),
+		slip:    slip,
+		buckets: make(map[string]*rrlBucket),
+		now:     time.Now,
+	}
+}
+
+// Prefix of a client address
+func rrlPrefix(addr net.Addr) string {
+	var ip net.IP
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		ip = a.IP
+	case *net.TCPAddr:
+		ip = a.IP
+	default:
+		return addr.String()
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(rrlIp4Prefix, 32)).String()
+	}
+	return ip.Mask(net.CIDRMask(rrlIp6Prefix, 128)).String()
+}
+
+// Key of the bucket of a response. Answers are limited per name and type,
+// denials per zone so random names do not get a bucket each. name is the
+// name answers are limited on, see rrlName.
+func rrlKey(prefix, zone, name string, m *dns.Msg) string {
+	var kind, key string
+	switch {
+	case m.Rcode == dns.RcodeNameError:
+		kind, key = rrlNxdomain, zone
+	case m.Rcode != dns.RcodeSuccess:
+		kind = rrlError
+	case len(m.Answer) == 0:
+		kind, key = rrlNodata, zone
+	default:
+		kind = rrlAnswer
+		key = strings.ToLower(name) + "/" + dns.TypeToString[m.Question[0].Qtype]
+	}
+	return prefix + "/" + kind + "/" + key
+}
+
+// Decide about a response to a client
+func (l *rateLimiter) check(key string) rrlAction {
+	l.Lock()
+	defer l.Unlock()
+	now := l.now()
+	if now.Sub(l.cleaned) > rrlWindow {
+		for k, b := range l.buckets {
+			if now.Sub(b.last) > rrlWindow {
+				delete(l.buckets, k)
+			}
+		}
+		l.cleaned = now
+	}
+
+	b := l.buckets[key]
+	if b == nil {
+		if len(l.buckets) < rrlMaxBuckets {
+			b = &rrlBucket{tokens: l.rate, last: now}
+			l.buckets[key] = b
+		} else {
+			if l.overflow == nil {
+				l.overflow = &rrlBucket{tokens: l.rate, last: now}
+			}
+			b = l.overflow
+		}
+	}
+	b.tokens += now.Sub(b.last).Seconds() * l.rate
+	if b.tokens > l.rate {
+		b.tokens = l.rate
+	}
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		b.limited = 0
+		return rrlSend
+	}
+	b.limited++
+	if l.slip > 0 && b.limited%l.slip == 0 {
+		return rrlSlip
+	}
+	return rrlDrop
+}
+
+// Name the answers for qname are limited on. Answers from a wildcard are
+// limited on the wildcard like BIND does, so random names below it do not
+// get a bucket each.
+func (h *dnsHandler) rrlName(qname string) string {
+	name := strings.ToLower(qname)
+	entry, owner, _ := h.lookupEntry(name)
+	if entry == nil || owner != "" || !entry.Wildcard || entry.delegated() {
+		return name
+	}
+	if host := strings.ToLower(ownerName(entry)); host != name {
+		return "*." + host
+	}
+	return name
+}
+
+// Apply the rate limit to a response over UDP. Returns false if the
+// response is dropped, slipped responses are truncated.
+func (h *dnsHandler) limit(w dns.ResponseWriter, zone string, m *dns.Msg) bool {
+	if h.rrl == nil || w.RemoteAddr().Network() != "udp" || len(m.Question) == 0 {
+		return true
+	}
+	name := m.Question[0].Name
+	if len(m.Answer) != 0 {
+		name = h.rrlName(name)
+	}
+	switch h.rrl.check(rrlKey(rrlPrefix(w.RemoteAddr()), zone, name, m)) {
+	case rrlDrop:
+		h.metric.RrlDropEvent()
+		return false
+	case rrlSlip:
+		h.metric.RrlSlipEvent()
+		opt := m.IsEdns0()
+		m.Answer, m.Ns, m.Extra = nil, nil, nil
+		if opt != nil {
+			m.Extra = []dns.RR{opt}
+		}
+		m.Truncated = true
+	}
+	return true
+}
@@ -0,0 +1,173 @@
+// The CoolDNS Project. The simple dynamic dns server and update service.
+// Copyright (C) 2014 The CoolDNS Authors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.package main
+
+package cooldns
+
+import (
+	"github.com/miekg/dns"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	l := newRateLimiter(2, 2)
+	now := time.Unix(1000, 0)
+	l.now = func() time.Time { return now }
+
+	expected := []rrlAction{rrlSend, rrlSend, rrlDrop, rrlSlip, rrlDrop, rrlSlip}
+	for i, action := range expected {
+		if a := l.check("a"); a != action {
+			t.Errorf("Response %d: expected %d, got %d", i, action, a)
+		}
+	}
+	// Other keys have their own bucket
+	if l.check("b") != rrlSend {
+		t.Error("Response for another key was limited")
+	}
+	// Tokens are refilled with the rate
+	now = now.Add(500 * time.Millisecond)
+	if l.check("a") != rrlSend {
+		t.Error("Bucket was not refilled")
+	}
+	if l.check("a") != rrlDrop {
+		t.Error("Bucket was refilled too much")
+	}
+	// Unused buckets are removed
+	now = now.Add(2 * rrlWindow)
+	l.check("b")
+	if len(l.buckets) != 1 {
+		t.Error("Stale buckets were not removed:", len(l.buckets))
+	}
+
+	l = newRateLimiter(1, -1)
+	l.now = func() time.Time { return now }
+	for i := 0; i < 5; i++ {
+		if a := l.check("a"); i > 0 && a != rrlDrop {
+			t.Error("Response slipped although slip is disabled")
+		}
+	}
+
+	// Keys beyond a full table share a bucket
+	defer func(max int) { rrlMaxBuckets = max }(rrlMaxBuckets)
+	rrlMaxBuckets = 2
+	l = newRateLimiter(1, -1)
+	l.now = func() time.Time { return now }
+	l.check("a")
+	l.check("b")
+	if l.check("c") != rrlSend {
+		t.Error("First response beyond a full table was limited")
+	}
+	if l.check("d") != rrlDrop {
+		t.Error("Response beyond a full table was not limited")
+	}
+}
+
+func TestRrlKey(t *testing.T) {
+	prefixes := map[string]string{
+		"192.168.1.17":          "192.168.1.0",
+		"2001:db8:1:2ff:1::1":   "2001:db8:1:200::",
+		"::ffff:192.168.20.200": "192.168.20.0",
+	}
+	for addr, prefix := range prefixes {
+		if p := rrlPrefix(&net.UDPAddr{IP: net.ParseIP(addr)}); p != prefix {
+			t.Errorf("Prefix of %s: expected %s, got %s", addr, prefix, p)
+		}
+	}
+
+	r := new(dns.Msg)
+	r.SetQuestion("random1.ist.nicht.cool.", dns.TypeA)
+	m := new(dns.Msg)
+	m.SetRcode(r, dns.RcodeNameError)
+	nx1 := rrlKey("192.168.1.0", "ist.nicht.cool.", m.Question[0].Name, m)
+	r.SetQuestion("random2.ist.nicht.cool.", dns.TypeA)
+	m.SetRcode(r, dns.RcodeNameError)
+	if nx2 := rrlKey("192.168.1.0", "ist.nicht.cool.", m.Question[0].Name, m); nx1 != nx2 {
+		t.Error("NXDOMAIN responses of a zone do not share a bucket:", nx1, nx2)
+	}
+	m.SetReply(r)
+	if nodata := rrlKey("192.168.1.0", "ist.nicht.cool.", m.Question[0].Name, m); nodata == nx1 {
+		t.Error("NODATA and NXDOMAIN share a bucket")
+	}
+	m.Answer = []dns.RR{&dns.A{}}
+	answer := rrlKey("192.168.1.0", "ist.nicht.cool.", m.Question[0].Name, m)
+	r.SetQuestion("random2.ist.nicht.cool.", dns.TypeAAAA)
+	m.SetReply(r)
+	m.Answer = []dns.RR{&dns.AAAA{}}
+	if rrlKey("192.168.1.0", "ist.nicht.cool.", m.Question[0].Name, m) == answer {
+		t.Error("Answers of different types share a bucket")
+	}
+	r.SetQuestion("RANDOM2.ist.nicht.cool.", dns.TypeAAAA)
+	m.SetReply(r)
+	m.Answer = []dns.RR{&dns.AAAA{}}
+	if rrlKey("192.168.1.0", "ist.nicht.cool.", m.Question[0].Name, m) !=
+		rrlKey("192.168.1.0", "ist.nicht.cool.", "random2.ist.nicht.cool.", m) {
+		t.Error("Answers for names in different case do not share a bucket")
+	}
+}
+
+func TestDnsRrl(t *testing.T) {
+	db, err := getTmpDB()
+	if err != nil {
+		t.Fatal("Failed to create temporary DB")
+	}
+	db.SaveEntry(&Entry{
+		Hostname: "rrl.ist.nicht.cool.",
+		Ip4s:     []net.IP{net.ParseIP("192.168.0.1")},
+	})
+	port := startDnsServerConfig(db, &DnsServerConfig{
+		Domain:  "ist.nicht.cool.",
+		RrlRate: 1,
+	})
+	in, err := dnsQuery(port, "rrl.ist.nicht.cool.", dns.TypeA)
+	if err != nil || len(in.Answer) != 1 {
+		t.Fatal("First answer was limited:", in, err)
+	}
+
+	m := new(dns.Msg)
+	m.SetQuestion("rrl.ist.nicht.cool.", dns.TypeA)
+	c := &dns.Client{Timeout: 200 * time.Millisecond}
+	if in, _, err := c.Exchange(m, "127.0.0.1:"+port); err == nil {
+		t.Error("Limited response was not dropped:", in)
+	}
+	in, _, err = c.Exchange(m, "127.0.0.1:"+port)
+	if err != nil || !in.Truncated || len(in.Answer) != 0 {
+		t.Error("Limited response did not slip:", in, err)
+	}
+
+	// TCP is not limited
+	c.Net = "tcp"
+	in, _, err = c.Exchange(m, "127.0.0.1:"+port)
+	if err != nil || len(in.Answer) != 1 {
+		t.Error("TCP answer was limited:", in, err)
+	}
+
+	// Answers from a wildcard share the bucket of the wildcard
+	db.SaveEntry(&Entry{
+		Hostname: "wild.ist.nicht.cool.",
+		Ip4s:     []net.IP{net.ParseIP("192.168.0.2")},
+		Wildcard: true,
+	})
+	in, err = dnsQuery(port, "random1.wild.ist.nicht.cool.", dns.TypeA)
+	if err != nil || len(in.Answer) != 1 {
+		t.Fatal("First wildcard answer was limited:", in, err)
+	}
+	c.Net = "udp"
+	m.SetQuestion("random2.wild.ist.nicht.cool.", dns.TypeA)
+	if in, _, err := c.Exchange(m, "127.0.0.1:"+port); err == nil {
+		t.Error("Wildcard answer for another name was not limited:", in)
+	}
+}
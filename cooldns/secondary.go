@@ -0,0 +1,422 @@
+// The CoolDNS Project. The simple dynamic dns server and update service.
+// Copyright (C) 2014 The CoolDNS Authors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.package main
+
+package cooldns
+
+import (
+	"errors"
+	"github.com/miekg/dns"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Secondaries do not change the zone themselves
+var ErrReadOnly = errors.New("Secondary database is read only")
+
+// Timing of the secondary before the first SOA of the primary is known.
+// Afterwards the refresh, retry and expire timers of the SOA apply.
+var (
+	secondaryRetry   = 10 * time.Second
+	secondaryTimeout = 10 * time.Second
+)
+
+// Zone transfers only carry the records of a zone. Reverse zones and views
+// need the addresses and settings of the entries, a secondary would answer
+// differently than the primary.
+func checkSecondaryConfig(config *DnsServerConfig) error {
+	if len(config.ReversePrefixes) != 0 {
+		return errors.New("Secondaries can not serve reverse zones")
+	}
+	if len(config.Views) != 0 {
+		return errors.New("Secondaries can not serve views")
+	}
+	return nil
+}
+
+// In-memory database of a secondary, filled by zone transfers from the
+// primary. Hosts and their credentials stay on the primary.
+type SecondaryCoolDB struct {
+	sync.Mutex
+	cache *DnsDB
+	// Entries and SOA of every transferred zone
+	zones map[string][]*Entry
+	soas  map[string]*dns.SOA
+	// Highest serial of all zones
+	serial    uint32
+	listeners []func(uint32)
+}
+
+func NewSecondaryCoolDB() *SecondaryCoolDB {
+	return &SecondaryCoolDB{
+		cache: NewCache(),
+		zones: make(map[string][]*Entry),
+		soas:  make(map[string]*dns.SOA),
+	}
+}
+
+func (db *SecondaryCoolDB) GetEntry(name string) *Entry {
+	return db.cache.Get(name)
+}
+
+func (db *SecondaryCoolDB) LookupEntry(name string) (*Entry, string, bool) {
+	return db.cache.Lookup(name)
+}
+
+func (db *SecondaryCoolDB) LookupReverse(name string) ([]string, bool) {
+	return db.cache.LookupReverse(name)
+}
+
+func (db *SecondaryCoolDB) SaveEntry(e *Entry) error {
+	return ErrReadOnly
+}
+
+func (db *SecondaryCoolDB) GetAuth(name string) *Auth {
+	return nil
+}
+
+func (db *SecondaryCoolDB) SaveAuth(a *Auth) error {
+	return ErrReadOnly
+}
+
+func (db *SecondaryCoolDB) Entries() []*Entry {
+	return db.cache.All()
+}
+
+func (db *SecondaryCoolDB) Serial() uint32 {
+	db.Lock()
+	defer db.Unlock()
+	return db.serial
+}
+
+// Secondaries keep no journal, downstream secondaries get the full zone
+func (db *SecondaryCoolDB) Journal(serial uint32) ([]*JournalEntry, error) {
+	return nil, ErrJournalIncomplete
+}
+
+func (db *SecondaryCoolDB) OnChange(f func(uint32)) {
+	db.Lock()
+	defer db.Unlock()
+	db.listeners = append(db.listeners, f)
+}
+
+func (db *SecondaryCoolDB) Close() error {
+	return nil
+}
+
+// SOA of a transferred zone, nil if the zone was not transferred yet
+func (db *SecondaryCoolDB) soa(zone string) *dns.SOA {
+	db.Lock()
+	defer db.Unlock()
+	if soa := db.soas[zone]; soa != nil {
+		return dns.Copy(soa).(*dns.SOA)
+	}
+	return nil
+}
+
+// Replace the entries of a zone with the ones of a transfer
+func (db *SecondaryCoolDB) setZone(soa *dns.SOA, entries []*Entry) {
+	db.Lock()
+	defer db.Unlock()
+	db.zones[soa.Hdr.Name] = entries
+	db.soas[soa.Hdr.Name] = soa
+	if int32(soa.Serial-db.serial) > 0 {
+		db.serial = soa.Serial
+	}
+	all := make(map[string]*Entry)
+	for _, entries := range db.zones {
+		for _, e := range entries {
+			all[e.Hostname] = e
+		}
+	}
+	db.cache.Lock()
+	db.cache.LoadCache(all, make(map[string]*Auth))
+	db.cache.Unlock()
+	for _, f := range db.listeners {
+		f(db.serial)
+	}
+}
+
+// Keeps the zones of a secondary in sync with the primary
+type secondary struct {
+	h       *dnsHandler
+	db      *SecondaryCoolDB
+	primary string
+	zones   map[string]*secondaryZone
+}
+
+// State of a zone followed by a secondary
+type secondaryZone struct {
+	sync.Mutex
+	name string
+	// Records of the zone without the SOA, as last transferred
+	records []dns.RR
+	soa     *dns.SOA
+	// The data is no longer served after expires (RFC 1035 section 4.3.5)
+	expires time.Time
+	notify  chan struct{}
+}
+
+func newSecondary(h *dnsHandler, primary string) *secondary {
+	db, ok := h.db.(*SecondaryCoolDB)
+	if !ok {
+		log.Fatal("Secondaries need a SecondaryCoolDB")
+	}
+	// Primaries without a port use the standard DNS port
+	if _, _, err := net.SplitHostPort(primary); err != nil {
+		primary = net.JoinHostPort(primary, "53")
+	}
+	s := &secondary{h: h, db: db, primary: primary, zones: make(map[string]*secondaryZone)}
+	for _, zone := range h.zones {
+		z := &secondaryZone{name: zone.domain, notify: make(chan struct{}, 1)}
+		s.zones[zone.domain] = z
+		go s.run(z)
+	}
+	return s
+}
+
+// Whether the data of a zone may be served. Reverse zones are derived from
+// the zone of the domain.
+func (s *secondary) serving(zone string) bool {
+	z := s.zones[zone]
+	if z == nil {
+		z = s.zones[s.h.zones[0].domain]
+	}
+	z.Lock()
+	defer z.Unlock()
+	return z.soa != nil && time.Now().Before(z.expires)
+}
+
+// Refresh a zone soon, without blocking the caller. False if the zone is
+// not followed.
+func (s *secondary) trigger(zone string) bool {
+	z := s.zones[strings.ToLower(zone)]
+	if z == nil {
+		return false
+	}
+	select {
+	case z.notify <- struct{}{}:
+	default:
+		// A refresh is already pending
+	}
+	return true
+}
+
+// Refresh a zone whenever its refresh timer runs out or the primary sends a
+// notify. Failed refreshes are retried after the retry timer.
+func (s *secondary) run(z *secondaryZone) {
+	var wait time.Duration
+	for {
+		select {
+		case <-time.After(wait):
+		case <-z.notify:
+		}
+		err := s.refresh(z)
+		z.Lock()
+		switch {
+		case z.soa == nil:
+			wait = secondaryRetry
+		case err != nil:
+			wait = time.Duration(z.soa.Retry) * time.Second
+		default:
+			wait = time.Duration(z.soa.Refresh) * time.Second
+		}
+		z.Unlock()
+		if err != nil {
+			log.Printf("Secondary: Refresh of %s failed: %s", z.name, err)
+		}
+	}
+}
+
+// Sign a query or transfer to the primary with the zone key if there is one
+func (s *secondary) sign(m *dns.Msg, zone string) *dns.Msg {
+	if s.h.tsigkey != "" {
+		m.SetTsig(zone, dns.HmacSHA256, 300, time.Now().Unix())
+	}
+	return m
+}
+
+// Keys of the answers of the primary. Queries are answered with the key of
+// the domain, transfers with the key of the zone.
+func (s *secondary) secrets(zone string) map[string]string {
+	if s.h.tsigkey == "" {
+		return nil
+	}
+	return map[string]string{zone: s.h.tsigkey, s.h.domain: s.h.tsigkey}
+}
+
+// Check the serial of the primary and transfer the zone if it changed
+func (s *secondary) refresh(z *secondaryZone) error {
+	z.Lock()
+	current := z.soa
+	z.Unlock()
+
+	m := s.sign(new(dns.Msg).SetQuestion(z.name, dns.TypeSOA), z.name)
+	c := &dns.Client{Net: "tcp", Timeout: secondaryTimeout, TsigSecret: s.secrets(z.name)}
+	in, _, err := c.Exchange(m, s.primary)
+	if err != nil {
+		return err
+	}
+	if in.Rcode != dns.RcodeSuccess || len(in.Answer) != 1 {
+		return errors.New("Unexpected SOA answer " + dns.RcodeToString[in.Rcode])
+	}
+	soa, ok := in.Answer[0].(*dns.SOA)
+	if !ok {
+		return errors.New("Unexpected SOA answer " + in.Answer[0].String())
+	}
+	if current != nil && int32(soa.Serial-current.Serial) <= 0 {
+		// Up to date, the data is fresh again
+		z.Lock()
+		z.expires = time.Now().Add(time.Duration(current.Expire) * time.Second)
+		z.Unlock()
+		return nil
+	}
+	return s.transfer(z, current)
+}
+
+// Transfer a zone, incrementally if there is data to start from
+func (s *secondary) transfer(z *secondaryZone, current *dns.SOA) error {
+	m := new(dns.Msg)
+	if current != nil {
+		m.SetIxfr(z.name, current.Serial, current.Ns, current.Mbox)
+	} else {
+		m.SetAxfr(z.name)
+	}
+	s.sign(m, z.name)
+	tr := &dns.Transfer{
+		DialTimeout: secondaryTimeout,
+		ReadTimeout: secondaryTimeout,
+		TsigSecret:  s.secrets(z.name),
+	}
+	env, err := tr.In(m, s.primary)
+	if err != nil {
+		return err
+	}
+	var rrs []dns.RR
+	for e := range env {
+		if e.Error != nil {
+			return e.Error
+		}
+		rrs = append(rrs, e.RR...)
+	}
+
+	z.Lock()
+	records, err := applyTransfer(z.records, rrs)
+	z.Unlock()
+	if err != nil {
+		return err
+	}
+	soa := rrs[0].(*dns.SOA)
+	entries, warnings, err := s.h.zoneEntries(z.name, records)
+	if err != nil {
+		return err
+	}
+	for _, warning := range warnings {
+		log.Printf("Secondary: %s: %s", z.name, warning)
+	}
+
+	z.Lock()
+	z.records = records
+	z.soa = soa
+	z.expires = time.Now().Add(time.Duration(soa.Expire) * time.Second)
+	z.Unlock()
+	s.db.setZone(soa, entries)
+	log.Printf("Secondary: %s transferred at serial %d", z.name, soa.Serial)
+	return nil
+}
+
+// The records of a zone after a transfer. A transfer is either the full
+// zone between two SOA records, or a sequence of differences (RFC 1995)
+// that are applied to the current records. A single SOA means the records
+// are up to date.
+func applyTransfer(current, rrs []dns.RR) ([]dns.RR, error) {
+	if len(rrs) == 1 {
+		if _, ok := rrs[0].(*dns.SOA); ok {
+			return current, nil
+		}
+	}
+	if len(rrs) < 2 {
+		return nil, errors.New("Transfer is too short")
+	}
+	first, ok := rrs[0].(*dns.SOA)
+	last, lastOk := rrs[len(rrs)-1].(*dns.SOA)
+	if !ok || !lastOk || first.Serial != last.Serial {
+		return nil, errors.New("Transfer does not start and end with the SOA")
+	}
+	if _, incremental := rrs[1].(*dns.SOA); !incremental || len(rrs) == 2 {
+		return rrs[1 : len(rrs)-1], nil
+	}
+
+	records := make(map[string]dns.RR)
+	var order []string
+	for _, rr := range current {
+		key := strings.ToLower(rr.String())
+		records[key] = rr
+		order = append(order, key)
+	}
+	// Every difference starts with the old SOA followed by the deleted
+	// records and the new SOA followed by the added records
+	adding := true
+	for _, rr := range rrs[1 : len(rrs)-1] {
+		if _, ok := rr.(*dns.SOA); ok {
+			adding = !adding
+			continue
+		}
+		key := strings.ToLower(rr.String())
+		if adding {
+			if records[key] == nil {
+				order = append(order, key)
+			}
+			records[key] = rr
+		} else {
+			delete(records, key)
+		}
+	}
+	var result []dns.RR
+	for _, key := range order {
+		if rr := records[key]; rr != nil {
+			result = append(result, rr)
+			// Records that were deleted and added again are listed twice
+			delete(records, key)
+		}
+	}
+	return result, nil
+}
+
+// Answer a NOTIFY of the primary (RFC 1996) and refresh the zone
+func (h *dnsHandler) handleNotify(w dns.ResponseWriter, r *dns.Msg) {
+	m := new(dns.Msg)
+	m.SetReply(r)
+	m.Authoritative = true
+	tsig := r.IsTsig()
+	switch {
+	case len(r.Question) != 1:
+		m.Rcode = dns.RcodeFormatError
+	case h.tsigkey != "" && (tsig == nil || w.TsigStatus() != nil):
+		m.Rcode = dns.RcodeRefused
+	case !h.secondary.trigger(r.Question[0].Name):
+		m.Rcode = dns.RcodeNotAuth
+	}
+	if tsig != nil && w.TsigStatus() == nil {
+		m.SetTsig(tsig.Hdr.Name, tsig.Algorithm, 300, time.Now().Unix())
+	}
+	err := w.WriteMsg(m)
+	if err != nil {
+		log.Println("Notify: Failed to write response:", err)
+	}
+}
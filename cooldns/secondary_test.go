@@ -0,0 +1,187 @@
+// The CoolDNS Project. The simple dynamic dns server and update service.
+// Copyright (C) 2014 The CoolDNS Authors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.package main
+
+package cooldns
+
+import (
+	"github.com/miekg/dns"
+	"net"
+	"testing"
+	"time"
+)
+
+// Query a server that signs its answers with the zone key
+func signedQuery(port, key, name string, qtype uint16) (in *dns.Msg, err error) {
+	c := &dns.Client{TsigSecret: map[string]string{"ist.nicht.cool.": key}}
+	for i := 0; i < 10; i++ {
+		m := new(dns.Msg)
+		m.SetQuestion(name, qtype)
+		in, _, err = c.Exchange(m, "127.0.0.1:"+port)
+		if err == nil {
+			return in, nil
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	return nil, err
+}
+
+// Wait until the secondary answers a name with an address
+func waitForAddress(t *testing.T, port, key, name, ip string) {
+	deadline := time.Now().Add(3 * time.Second)
+	for time.Now().Before(deadline) {
+		in, err := signedQuery(port, key, name, dns.TypeA)
+		if err == nil && len(in.Answer) == 1 && in.Answer[0].(*dns.A).A.String() == ip {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatalf("Secondary does not answer %s with %s", name, ip)
+}
+
+func freePort(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Failed to listen:", err)
+	}
+	defer l.Close()
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+	return port
+}
+
+func TestDnsSecondary(t *testing.T) {
+	secondaryRetry = 50 * time.Millisecond
+	notifyDelay = 10 * time.Millisecond
+	key, _ := NewTsigKey()
+	primaryPort := freePort(t)
+	secondaryPort := freePort(t)
+
+	// Without a primary there is nothing to answer with
+	resolver := RunDns(&DnsServerConfig{
+		Domain:  "ist.nicht.cool.",
+		Listen:  "127.0.0.1:" + secondaryPort,
+		TsigKey: key,
+		Primary: "127.0.0.1:" + primaryPort,
+	}, NewSecondaryCoolDB(), nil)
+	in, err := signedQuery(secondaryPort, key, "ist.nicht.cool.", dns.TypeSOA)
+	if err != nil {
+		t.Fatal("Query failed:", err)
+	}
+	if in.Rcode != dns.RcodeServerFailure {
+		t.Error("Secondary without data answered", dns.RcodeToString[in.Rcode])
+	}
+
+	db, err := getTmpDB()
+	if err != nil {
+		t.Fatal("Failed to create temporary DB")
+	}
+	db.SaveEntry(&Entry{Hostname: "eins.ist.nicht.cool.", Ip4s: []net.IP{net.ParseIP("1.1.1.1")}})
+	RunDns(&DnsServerConfig{
+		Domain:  "ist.nicht.cool.",
+		Listen:  "127.0.0.1:" + primaryPort,
+		TsigKey: key,
+		Notify:  []string{"127.0.0.1:" + secondaryPort},
+	}, db, nil)
+	waitForAddress(t, secondaryPort, key, "eins.ist.nicht.cool.", "1.1.1.1")
+
+	// Changes are notified and transferred incrementally
+	db.SaveEntry(&Entry{Hostname: "zwei.ist.nicht.cool.", Ip4s: []net.IP{net.ParseIP("2.2.2.2")}})
+	db.SaveEntry(&Entry{Hostname: "eins.ist.nicht.cool.", Ip4s: []net.IP{net.ParseIP("1.1.1.2")}})
+	waitForAddress(t, secondaryPort, key, "zwei.ist.nicht.cool.", "2.2.2.2")
+	waitForAddress(t, secondaryPort, key, "eins.ist.nicht.cool.", "1.1.1.2")
+	in, err = signedQuery(secondaryPort, key, "ist.nicht.cool.", dns.TypeSOA)
+	if err != nil || len(in.Answer) != 1 {
+		t.Fatal("SOA query failed:", err, in)
+	}
+	if serial := in.Answer[0].(*dns.SOA).Serial; serial != db.Serial() {
+		t.Errorf("Secondary has serial %d, expected %d", serial, db.Serial())
+	}
+
+	// Updates are refused
+	m := new(dns.Msg)
+	m.SetUpdate("ist.nicht.cool.")
+	m.SetTsig("ist.nicht.cool.", dns.HmacSHA256, 300, time.Now().Unix())
+	c := &dns.Client{TsigSecret: map[string]string{"ist.nicht.cool.": key}}
+	in, _, err = c.Exchange(m, "127.0.0.1:"+secondaryPort)
+	if err != nil || in.Rcode != dns.RcodeRefused {
+		t.Error("Update was not refused:", err, in)
+	}
+
+	// Expired data is not served
+	z := resolver.(*dnsHandler).secondary.zones["ist.nicht.cool."]
+	z.Lock()
+	z.expires = time.Now()
+	z.Unlock()
+	in, err = signedQuery(secondaryPort, key, "eins.ist.nicht.cool.", dns.TypeA)
+	if err != nil {
+		t.Fatal("Query failed:", err)
+	}
+	if in.Rcode != dns.RcodeServerFailure {
+		t.Error("Expired secondary answered", dns.RcodeToString[in.Rcode])
+	}
+}
+
+func TestApplyTransfer(t *testing.T) {
+	rr := func(s string) dns.RR {
+		r, err := dns.NewRR(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return r
+	}
+	soa := func(serial string) dns.RR {
+		return rr("cool. 60 IN SOA ns.cool. hostmaster.cool. " + serial + " 1 1 1 1")
+	}
+	current := []dns.RR{rr("a.cool. 60 IN A 1.1.1.1"), rr("b.cool. 60 IN A 2.2.2.2")}
+
+	// A full zone replaces the records
+	records, err := applyTransfer(current, []dns.RR{soa("3"), rr("c.cool. 60 IN A 3.3.3.3"), soa("3")})
+	if err != nil || len(records) != 1 || records[0].Header().Name != "c.cool." {
+		t.Error("Full zone was not applied:", err, records)
+	}
+	// Differences delete and add records
+	records, err = applyTransfer(current, []dns.RR{soa("3"),
+		soa("1"), rr("a.cool. 60 IN A 1.1.1.1"), soa("2"), rr("c.cool. 60 IN A 3.3.3.3"),
+		soa("2"), soa("3"), rr("a.cool. 60 IN A 4.4.4.4"),
+		soa("3")})
+	if err != nil || len(records) != 3 {
+		t.Fatal("Differences were not applied:", err, records)
+	}
+	for i, want := range []string{"2.2.2.2", "3.3.3.3", "4.4.4.4"} {
+		if ip := records[i].(*dns.A).A.String(); ip != want {
+			t.Errorf("Record %d is %s, expected %s", i, ip, want)
+		}
+	}
+	// Transfers must be framed by the SOA
+	if _, err := applyTransfer(current, []dns.RR{soa("3"), rr("c.cool. 60 IN A 3.3.3.3")}); err == nil {
+		t.Error("Unframed transfer was applied")
+	}
+}
+
+func TestSecondaryConfig(t *testing.T) {
+	config := &DnsServerConfig{Domain: "ist.nicht.cool.", Primary: "127.0.0.1:53"}
+	if err := checkSecondaryConfig(config); err != nil {
+		t.Error("Plain secondary was refused:", err)
+	}
+	config.ReversePrefixes = []string{"192.168.0.0/16"}
+	if err := checkSecondaryConfig(config); err == nil {
+		t.Error("Secondary with reverse zones was accepted")
+	}
+	config.ReversePrefixes = nil
+	config.Views = []*ViewConfig{&ViewConfig{Name: "office", Networks: []string{"10.0.0.0/8"}}}
+	if err := checkSecondaryConfig(config); err == nil {
+		t.Error("Secondary with views was accepted")
+	}
+}
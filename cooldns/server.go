@@ -18,9 +18,11 @@ package cooldns
 
 import (
 	"encoding/base64"
+	"fmt"
 	"github.com/codegangsta/martini-contrib/render"
 	"github.com/go-martini/martini"
 	"github.com/martini-contrib/binding"
+	"github.com/miekg/dns"
 	"log"
 	"net"
 	"net/http"
@@ -36,6 +38,16 @@ type WebConfig struct {
 	Listen    string // Listener <interface>:<port>. Default ":3000"
 	RcPubKey  string // reCaptcha public key
 	RcPrivKey string // reCaptcha private key
+	// Further zones hosts can be registered in, see DnsServerConfig
+	Zones []*ZoneConfig
+	// Names of the views hosts can set addresses for
+	Views []string
+	// Password of the admin user for the /admin endpoints. If not set,
+	// they are not served.
+	AdminSecret string
+	// Addresses or networks (CIDR) of proxies in front of the server. The
+	// client address they add to X-Forwarded-For is trusted.
+	TrustedProxies []string
 }
 
 type Registration struct {
@@ -43,6 +55,14 @@ type Registration struct {
 	MyIp     string `form:"myip"`
 	Offline  string `form:"offline"`
 	Txt      string `form:"txt"`
+	Ttl      string `form:"ttl"`
+	Wildcard string `form:"wildcard"`
+	Reverse  string `form:"reverse"`
+
+	// What the host answers while it is offline, one of the Offline* modes
+	OfflineMode string `form:"offlinemode"`
+	// View the address is set for. Empty sets the default address.
+	View string `form:"view"`
 }
 
 func (r *Registration) Validate(errors binding.Errors, req *http.Request) binding.Errors {
@@ -72,6 +92,34 @@ func (r *Registration) Validate(errors binding.Errors, req *http.Request) bindin
 			Message:        "offline is neither yes nor no",
 		})
 	}
+	if !isOfflineMode(strings.ToLower(req.Form.Get("offlinemode"))) {
+		errors = append(errors, binding.Error{
+			Classification: binding.ContentTypeError,
+			Message:        "offlinemode is neither nxdomain, parking nor last",
+		})
+	}
+	wildcard := strings.ToLower(req.Form.Get("wildcard"))
+	if wildcard != "" && wildcard != "yes" && wildcard != "no" {
+		errors = append(errors, binding.Error{
+			Classification: binding.ContentTypeError,
+			Message:        "wildcard is neither yes nor no",
+		})
+	}
+	reverse := strings.ToLower(req.Form.Get("reverse"))
+	if reverse != "" && reverse != "yes" && reverse != "no" {
+		errors = append(errors, binding.Error{
+			Classification: binding.ContentTypeError,
+			Message:        "reverse is neither yes nor no",
+		})
+	}
+	if ttl := req.Form.Get("ttl"); ttl != "" {
+		if _, err := parseTtl(ttl); err != nil {
+			errors = append(errors, binding.Error{
+				Classification: binding.ContentTypeError,
+				Message:        "ttl is not a number of seconds",
+			})
+		}
+	}
 	return errors
 }
 
@@ -139,12 +187,18 @@ func AuthHandler(db CoolDB, res http.ResponseWriter, req *http.Request) {
 	}
 }
 
-func Register(db CoolDB, r render.Render, reg Registration, errors binding.Errors) {
+func Register(db CoolDB, views viewNames, r render.Render, reg Registration, errors binding.Errors) {
+	if reg.View != "" && !views.has(reg.View) {
+		errors = append(errors, binding.Error{
+			Classification: binding.ContentTypeError,
+			Message:        "view is unknown",
+		})
+	}
 	if errors != nil {
 		r.JSON(400, errors)
 		return
 	}
-	// Set Offline flag, does nothing yet but it's nice to have
+	// Set Offline flag, the offline mode decides what the host answers
 	var offline bool
 	if strings.ToLower(reg.Offline) == "yes" {
 		offline = true
@@ -157,13 +211,76 @@ func Register(db CoolDB, r render.Render, reg Registration, errors binding.Error
 		Offline:  offline,
 		Txts:     []string{reg.Txt},
 	}
+	// Without the ttl, wildcard, reverse and offlinemode parameters the
+	// settings are left as they are
+	old := db.GetEntry(reg.Hostname)
+	if reg.Ttl != "" {
+		// Already checked during validation
+		e.Ttl, _ = parseTtl(reg.Ttl)
+	} else if old != nil {
+		e.Ttl = old.Ttl
+	}
+	e.OfflineMode = strings.ToLower(reg.OfflineMode)
+	if e.OfflineMode == "" && old != nil {
+		e.OfflineMode = old.OfflineMode
+	}
+	switch strings.ToLower(reg.Wildcard) {
+	case "yes":
+		e.Wildcard = true
+	case "":
+		if old != nil {
+			e.Wildcard = old.Wildcard
+		}
+	}
+	switch strings.ToLower(reg.Reverse) {
+	case "yes":
+		e.Reverse = true
+	case "":
+		if old != nil {
+			e.Reverse = old.Reverse
+		}
+	}
+
+	// Further records and delegations stay, the new address is their glue.
+	// The answer policy is only changed by the update form.
+	if old != nil {
+		e.Srvs = old.Srvs
+		e.Caas = old.Caas
+		e.Ptrs = old.Ptrs
+		e.Sshfps = old.Sshfps
+		e.Tlsas = old.Tlsas
+		e.Https = old.Https
+		e.Svcbs = old.Svcbs
+		e.Nss = old.Nss
+		e.AnswerPolicy = old.AnswerPolicy
+		e.Weights = old.Copy().Weights
+	}
 
-	// Check if ipv4 or ipv6, OK thee is no really sane way to do this at the moment
-	ip := net.ParseIP(reg.MyIp)
-	if strings.Contains(reg.MyIp, ":") {
-		e.Ip6s = append(e.Ip6s, ip)
+	// Addresses of views stay, an address for a view leaves the default
+	// addresses as they are
+	if old != nil {
+		e.ViewIps = old.Copy().ViewIps
+	}
+	if reg.View != "" {
+		if old != nil {
+			e.Ip4s = old.Ip4s
+			e.Ip6s = old.Ip6s
+		}
+		if e.ViewIps == nil {
+			e.ViewIps = make(map[string][]net.IP)
+		}
+		if !offline {
+			e.ViewIps[reg.View] = []net.IP{net.ParseIP(reg.MyIp)}
+		}
+	} else if offline && old != nil {
+		// Hosts going offline keep their last known addresses
+		e.Ip4s = old.Ip4s
+		e.Ip6s = old.Ip6s
+	} else if strings.Contains(reg.MyIp, ":") {
+		// Check if ipv4 or ipv6, OK thee is no really sane way to do this at the moment
+		e.Ip6s = append(e.Ip6s, net.ParseIP(reg.MyIp))
 	} else {
-		e.Ip4s = append(e.Ip4s, ip)
+		e.Ip4s = append(e.Ip4s, net.ParseIP(reg.MyIp))
 	}
 
 	err := db.SaveEntry(e)
@@ -176,10 +293,13 @@ func Register(db CoolDB, r render.Render, reg Registration, errors binding.Error
 	return
 }
 
-func SetupWeb(config *WebConfig, db CoolDB, metric MetricsHandle) http.Handler {
+// Setup the web server. If resolver is not nil, DNS over HTTPS is served at
+// /dns-query.
+func SetupWeb(config *WebConfig, db CoolDB, metric MetricsHandle, resolver Resolver) http.Handler {
 	// Setup Martini
 	m := martini.Classic()
 	m.Map(db)
+	m.Map(viewNames(config.Views))
 
 	// Call metrics on every Request
 	m.Use(func(c martini.Context) {
@@ -205,14 +325,109 @@ func SetupWeb(config *WebConfig, db CoolDB, metric MetricsHandle) http.Handler {
 	// form api handlers
 	m.Post("/", binding.Form(WebNewDomain{}), web.FormApiDomainNew)
 	m.Post("/update", binding.Form(WebUpdateDomain{}), web.FormApiDomainUpdate)
+
+	// Address of the caller
+	proxies, err := parseProxies(config.TrustedProxies)
+	if err != nil {
+		log.Fatal("Malformatted trusted proxy:", err)
+	}
+	m.Get("/ip", clientIpHandler(proxies))
+
+	// DNS over HTTPS
+	if resolver != nil {
+		doh := dohHandler(resolver, proxies)
+		m.Get("/dns-query", doh)
+		m.Post("/dns-query", doh)
+	}
+
+	// Zone files for administrators
+	if files, ok := resolver.(ZoneFiles); ok && config.AdminSecret != "" {
+		auth := adminAuth(config.AdminSecret)
+		m.Get("/admin/zone", auth, adminExport(files))
+		m.Post("/admin/zone", auth, adminImport(files))
+	}
 	return m
 }
 
+// Roll the DNSSEC zone signing ("zsk") or key signing ("ksk") key of a zone
+// in the configured key directory, the zone of the Domain if zone is empty.
+// "ksk-finish" retires the old KSK after the parent zone got the new DS
+// record. For a KSK the DS record for the parent zone is printed.
+func Rollover(config *Config, kind, zone string) {
+	if config.DnsConfig.DnssecKeys == "" {
+		log.Fatal("No DNSSEC key directory configured")
+	}
+	if zone == "" {
+		zone = config.Domain
+	}
+	key, err := rolloverKey(config.DnsConfig.DnssecKeys, fqdn(strings.ToLower(zone)), kind)
+	if err != nil {
+		log.Fatal("Rollover failed:", err)
+	}
+	fmt.Println(key)
+	if key.Flags&dns.SEP != 0 {
+		fmt.Println(key.ToDS(dns.SHA256))
+	}
+}
+
+// Write a zone as master file to stdout, the zone of the Domain if zone is
+// empty
+func ExportZone(config *Config, zone string) {
+	db, err := NewSqliteCoolDB(config.DbFile)
+	if err != nil {
+		log.Fatal("Error Loading db:", err)
+	}
+	defer db.Close()
+	err = NewZoneFiles(config.DnsConfig, db).Export(os.Stdout, zone)
+	if err != nil {
+		log.Fatal("Export failed:", err)
+	}
+}
+
+// Import the entries of a master file into a zone, the zone of the Domain if
+// zone is empty. The changes and the secrets of new hosts are printed, with
+// dryRun nothing is saved.
+func ImportZone(config *Config, file, zone string, dryRun bool) {
+	f, err := os.Open(file)
+	if err != nil {
+		log.Fatal("Import failed:", err)
+	}
+	defer f.Close()
+	db, err := NewSqliteCoolDB(config.DbFile)
+	if err != nil {
+		log.Fatal("Error Loading db:", err)
+	}
+	defer db.Close()
+	result, err := NewZoneFiles(config.DnsConfig, db).Import(f, zone, dryRun)
+	if err != nil {
+		log.Fatal("Import failed:", err)
+	}
+	fmt.Print(result)
+}
+
 // The main Server Runner, specify a listen string in the form <net>:<port>,
 // and a database filename.
 func Run(config *Config) {
 	log.Println("Starting coolDNS Server")
 
+	// Create Metrics Handler
+	var metrics MetricsHandle
+	if config.InfluxConfig != nil {
+		metrics = NewInfluxMetrics(config.InfluxConfig)
+	} else {
+		metrics = NewDummyMetrics()
+	}
+
+	// Secondaries only answer DNS queries with the zones of the primary
+	if config.DnsConfig.Primary != "" {
+		log.Println("Following primary", config.DnsConfig.Primary)
+		RunDns(config.DnsConfig, NewSecondaryCoolDB(), metrics)
+		sigChan := make(chan os.Signal, 1)
+		signal.Notify(sigChan, os.Kill, syscall.SIGTERM, os.Interrupt)
+		<-sigChan
+		return
+	}
+
 	db, err := NewSqliteCoolDB(config.DbFile)
 	if err != nil {
 		log.Fatal("Error Loading db:", err)
@@ -231,18 +446,10 @@ func Run(config *Config) {
 		os.Exit(0)
 	}()
 
-	// Create Metrics Handler
-	var metrics MetricsHandle
-	if config.InfluxConfig != nil {
-		metrics = NewInfluxMetrics(config.InfluxConfig)
-	} else {
-		metrics = NewDummyMetrics()
-	}
-
 	// Run the DNS server
-	go RunDns(config.DnsConfig, db, metrics)
+	resolver := RunDns(config.DnsConfig, db, metrics)
 
-	handler := SetupWeb(config.WebConfig, db, metrics)
+	handler := SetupWeb(config.WebConfig, db, metrics, resolver)
 	err = http.ListenAndServe(config.WebConfig.Listen, handler)
 	if err != nil {
 		log.Fatal("Server Failed:", err)
@@ -19,20 +19,31 @@ package cooldns
 import (
 	_ "code.google.com/p/gosqlite/sqlite3"
 	"database/sql"
+	"encoding/json"
 	"fmt"
 	"log"
 	"net"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type SqliteCoolDB struct {
 	sync.Mutex
 	c     *sql.DB
 	cache *DnsDB
+	// Serial of the zone, only changed while holding the lock
+	serial uint32
+	// Called after every committed change of the zone
+	listeners []func(uint32)
 }
 
+// Number of changes kept in the journal for incremental zone transfers
+const journalSize = 1000
+
 const createCoolDNS string = `
 CREATE TABLE if NOT EXISTS cooldns (
   hostname TEXT,
@@ -42,18 +53,81 @@ CREATE TABLE if NOT EXISTS cooldns (
   txt TEXT,
   mx TEXT,
   cname TEXT,
+  ttl INTEGER DEFAULT 0,
+  wildcard BOOLEAN DEFAULT 0,
+  reverse BOOLEAN DEFAULT 0,
+  offline_mode TEXT DEFAULT '',
+  srv TEXT DEFAULT '',
+  caa TEXT DEFAULT '',
+  ptr TEXT DEFAULT '',
+  sshfp TEXT DEFAULT '',
+  tlsa TEXT DEFAULT '',
+  https TEXT DEFAULT '',
+  svcb TEXT DEFAULT '',
+  ns TEXT DEFAULT '',
+  views TEXT DEFAULT '',
+  policy TEXT DEFAULT '',
+  weights TEXT DEFAULT '',
 UNIQUE (hostname) ON CONFLICT REPLACE
 );
 `
+
+// A column that was added to a table after its first release
+type columnMigration struct {
+	column, definition string
+}
+
+// Columns that were added to the cooldns table after its first release.
+// They are added to existing databases on startup.
+var cooldnsMigrations = []columnMigration{
+	{"ttl", "INTEGER DEFAULT 0"},
+	{"wildcard", "BOOLEAN DEFAULT 0"},
+	{"reverse", "BOOLEAN DEFAULT 0"},
+	{"srv", "TEXT DEFAULT ''"},
+	{"caa", "TEXT DEFAULT ''"},
+	{"ptr", "TEXT DEFAULT ''"},
+	{"sshfp", "TEXT DEFAULT ''"},
+	{"tlsa", "TEXT DEFAULT ''"},
+	{"https", "TEXT DEFAULT ''"},
+	{"svcb", "TEXT DEFAULT ''"},
+	{"offline_mode", "TEXT DEFAULT ''"},
+	{"ns", "TEXT DEFAULT ''"},
+	{"views", "TEXT DEFAULT ''"},
+	{"policy", "TEXT DEFAULT ''"},
+	{"weights", "TEXT DEFAULT ''"},
+}
+
 const createUsers string = `
 CREATE TABLE if NOT EXISTS users (
   name TEXT,
   salt VARCHAR(8),
   key VARCHAR(32),
+  tsig TEXT DEFAULT '',
 UNIQUE (name) ON CONFLICT REPLACE
 ) 
 `
 
+const createZone string = `
+CREATE TABLE if NOT EXISTS zone (
+  serial INTEGER
+)
+`
+
+// Every change of an entry, old and new are entry rows in JSON
+const createJournal string = `
+CREATE TABLE if NOT EXISTS journal (
+  serial INTEGER PRIMARY KEY,
+  hostname TEXT,
+  old TEXT,
+  new TEXT
+)
+`
+
+// Columns that were added to the users table after its first release.
+var usersMigrations = []columnMigration{
+	{"tsig", "TEXT DEFAULT ''"},
+}
+
 func createTable(db *sql.DB) error {
 	tx, err := db.Begin()
 	if err != nil {
@@ -73,9 +147,62 @@ func createTable(db *sql.DB) error {
 	if err != nil {
 		return err
 	}
+	_, err = tx.Exec(createZone)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(createJournal)
+	if err != nil {
+		return err
+	}
+	err = migrateTable(tx, "cooldns", cooldnsMigrations)
+	if err != nil {
+		return err
+	}
+	err = migrateTable(tx, "users", usersMigrations)
+	if err != nil {
+		return err
+	}
 	return tx.Commit()
 }
 
+// Add all columns missing in an existing table
+func migrateTable(tx *sql.Tx, table string, migrations []columnMigration) error {
+	rows, err := tx.Query("PRAGMA table_info(" + table + ")")
+	if err != nil {
+		return err
+	}
+	columns := make(map[string]bool)
+	for rows.Next() {
+		var (
+			cid       int
+			name      string
+			ctype     string
+			notnull   bool
+			dfltValue interface{}
+			pk        int
+		)
+		err = rows.Scan(&cid, &name, &ctype, &notnull, &dfltValue, &pk)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		columns[name] = true
+	}
+	rows.Close()
+
+	for _, m := range migrations {
+		if columns[m.column] {
+			continue
+		}
+		_, err = tx.Exec("ALTER TABLE " + table + " ADD COLUMN " + m.column + " " + m.definition)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func NewSqliteCoolDB(filename string) (*SqliteCoolDB, error) {
 	db, err := sql.Open("sqlite3", filename)
 	if err != nil {
@@ -102,6 +229,10 @@ func NewSqliteCoolDB(filename string) (*SqliteCoolDB, error) {
 		log.Fatal("Error Loading User Cache:", err)
 	}
 	cache.LoadCache(dnsCache, userCache)
+	cooldb.serial, err = cooldb.loadSerial()
+	if err != nil {
+		log.Fatal("Error Loading Serial:", err)
+	}
 
 	cooldb.cache = cache
 	return cooldb, nil
@@ -115,79 +246,286 @@ func (db *SqliteCoolDB) Close() error {
 
 const dbRecSep = "\x1f"
 
-func (db *SqliteCoolDB) SaveEntry(e *Entry) error {
-	if !e.Offline {
-		db.cache.Put(e)
-	}
-	db.Lock()
-	defer db.Unlock()
+// Representation of an Entry in the cooldns table. It is also stored as
+// JSON in the journal.
+type entryRow struct {
+	Hostname string
+	Cname    string
+	Ip4      string
+	Ip6      string
+	Offline  bool
+	Mx       string
+	Txt      string
+	Ttl      uint32
+	Wildcard bool
+	Reverse  bool
+	Srv      string
+	Caa      string
+	Ptr      string
+	Sshfp    string
+	Tlsa     string
+	Https    string
+	Svcb     string
+	// Mode of offline entries
+	OfflineMode string
+	// Name servers of delegated entries
+	Ns string
+	// Addresses of views as "<view> <ip>" lines
+	Views string
+	// Answer policy and weights as "<ip> <weight>" lines
+	Policy  string
+	Weights string
+}
 
-	tx, err := db.c.Begin()
-	if err != nil {
-		return err
+func newEntryRow(e *Entry) *entryRow {
+	r := &entryRow{
+		Hostname: e.Hostname,
+		Cname:    e.Cname,
+		Offline:  e.Offline,
+		Ttl:      e.Ttl,
+		Wildcard: e.Wildcard,
+		Reverse:  e.Reverse,
+		Srv:      strings.Join(e.Srvs, dbRecSep),
+		Caa:      strings.Join(e.Caas, dbRecSep),
+		Ptr:      strings.Join(e.Ptrs, dbRecSep),
+		Sshfp:    strings.Join(e.Sshfps, dbRecSep),
+		Tlsa:     strings.Join(e.Tlsas, dbRecSep),
+		Https:    strings.Join(e.Https, dbRecSep),
+		Svcb:     strings.Join(e.Svcbs, dbRecSep),
 	}
-	defer func() {
-		if err != nil {
-			tx.Rollback()
-		}
-	}()
-	// Check if values exist otherwise fill them with blanks
-	var (
-		hostname string
-		cname    string
-		ip4s     string
-		ip6s     string
-		offline  bool
-		txts     string
-		mxs      string
-	)
-
-	hostname = e.Hostname
-
-	cname = e.Cname
 
 	var ip4a []string
 	for _, ip4 := range e.Ip4s {
 		ip4a = append(ip4a, ip4.String())
 	}
-	ip4s = strings.Join(ip4a, dbRecSep)
+	r.Ip4 = strings.Join(ip4a, dbRecSep)
 
 	var ip6a []string
 	for _, ip6 := range e.Ip6s {
 		ip6a = append(ip6a, ip6.String())
 	}
-	ip6s = strings.Join(ip6a, dbRecSep)
+	r.Ip6 = strings.Join(ip6a, dbRecSep)
 
-	txts = strings.Join(e.Txts, dbRecSep)
-	offline = e.Offline
+	r.Txt = strings.Join(e.Txts, dbRecSep)
+	r.OfflineMode = e.OfflineMode
+	r.Ns = strings.Join(e.Nss, dbRecSep)
+
+	var views []string
+	for view, ips := range e.ViewIps {
+		for _, ip := range ips {
+			views = append(views, view+" "+ip.String())
+		}
+	}
+	sort.Strings(views)
+	r.Views = strings.Join(views, dbRecSep)
+
+	r.Policy = e.AnswerPolicy
+	var weights []string
+	for ip, w := range e.Weights {
+		weights = append(weights, fmt.Sprintf("%s %d", ip, w))
+	}
+	sort.Strings(weights)
+	r.Weights = strings.Join(weights, dbRecSep)
 
 	var mxa []string
 	for _, mx := range e.Mxs {
 		mxa = append(mxa, fmt.Sprintf("%d %s", mx.priority, mx.ip))
 	}
-	mxs = strings.Join(mxa, dbRecSep)
+	r.Mx = strings.Join(mxa, dbRecSep)
+
+	return r
+}
+
+func (r *entryRow) entry() *Entry {
+	e := &Entry{
+		Hostname: r.Hostname,
+		Cname:    r.Cname,
+		Offline:  r.Offline,
+		Ttl:      r.Ttl,
+		Wildcard: r.Wildcard,
+		Reverse:  r.Reverse,
+		Srvs:     splitRecords(r.Srv),
+		Caas:     splitRecords(r.Caa),
+		Ptrs:     splitRecords(r.Ptr),
+		Sshfps:   splitRecords(r.Sshfp),
+		Tlsas:    splitRecords(r.Tlsa),
+		Https:    splitRecords(r.Https),
+		Svcbs:    splitRecords(r.Svcb),
+	}
+	// unmarshal ip4 address
+	for _, ip4 := range strings.Split(r.Ip4, dbRecSep) {
+		ip := net.ParseIP(ip4)
+		if ip == nil {
+			continue
+		}
+		e.Ip4s = append(e.Ip4s, ip)
+	}
+	// unmarshal ip6 addresses
+	for _, ip6 := range strings.Split(r.Ip6, dbRecSep) {
+		ip := net.ParseIP(ip6)
+		if ip == nil {
+			continue
+		}
+		e.Ip6s = append(e.Ip6s, ip)
+	}
+
+	e.Txts = strings.Split(r.Txt, dbRecSep)
+	e.OfflineMode = r.OfflineMode
+	e.Nss = splitRecords(r.Ns)
+	// unmarshal the addresses of views
+	for _, line := range splitRecords(r.Views) {
+		fields := strings.Fields(line)
+		if len(fields) != 2 || net.ParseIP(fields[1]) == nil {
+			log.Println("Warning: loadAll: Malformatted view address in database:", line)
+			continue
+		}
+		if e.ViewIps == nil {
+			e.ViewIps = make(map[string][]net.IP)
+		}
+		e.ViewIps[fields[0]] = append(e.ViewIps[fields[0]], net.ParseIP(fields[1]))
+	}
+	e.AnswerPolicy = r.Policy
+	// unmarshal the weights of addresses
+	for _, line := range splitRecords(r.Weights) {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			log.Println("Warning: loadAll: Malformatted weight in database:", line)
+			continue
+		}
+		w, err := strconv.ParseUint(fields[1], 10, 32)
+		if err != nil {
+			log.Println("Warning: loadAll: Malformatted weight in database:", line)
+			continue
+		}
+		if e.Weights == nil {
+			e.Weights = make(map[string]uint32)
+		}
+		e.Weights[fields[0]] = uint32(w)
+	}
+	// unmarshal MX entries
+	for _, mx := range strings.Split(r.Mx, dbRecSep) {
+		mxSubA := strings.Fields(mx)
+		if len(mxSubA) != 2 {
+			continue
+		}
+		prio, err := strconv.ParseInt(mxSubA[0], 10, 0)
+		if err != nil {
+			log.Println("Warning: loadAll: Malformatted mx entry in database:", mxSubA)
+			continue
+		}
+		e.Mxs = append(e.Mxs, MxEntry{
+			ip:       mxSubA[1],
+			priority: int(prio),
+		})
+	}
+	return e
+}
+
+// Split records in presentation format, no records are stored as an empty
+// string.
+func splitRecords(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, dbRecSep)
+}
 
-	// TODO remove logging
-	// log.Printf("hostname: %s, cname :%s, ip4: %s, ip6: %s, txts: %s, mxs: %v", hostname, cname, ip4, ip6, txts, mxs)
+func (db *SqliteCoolDB) SaveEntry(e *Entry) error {
+	db.Lock()
+	defer db.Unlock()
+	old := db.cache.Get(e.Hostname)
+
+	tx, err := db.c.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	r := newEntryRow(e)
 
 	_, err = tx.Exec(`
 	INSERT OR REPLACE INTO cooldns 
-	 (hostname, cname, ip4, ip6, offline, mx, txt)
-	VALUES (?, ?, ?, ?, ?, ?, ?);
+	 (hostname, cname, ip4, ip6, offline, mx, txt, ttl, wildcard, reverse,
+	  srv, caa, ptr, sshfp, tlsa, https, svcb, offline_mode, ns, views, policy, weights)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?);
 			`,
-		hostname,
-		cname,
-		ip4s,
-		ip6s,
-		offline,
-		mxs,
-		txts)
+		r.Hostname,
+		r.Cname,
+		r.Ip4,
+		r.Ip6,
+		r.Offline,
+		r.Mx,
+		r.Txt,
+		r.Ttl,
+		r.Wildcard,
+		r.Reverse,
+		r.Srv,
+		r.Caa,
+		r.Ptr,
+		r.Sshfp,
+		r.Tlsa,
+		r.Https,
+		r.Svcb,
+		r.OfflineMode,
+		r.Ns,
+		r.Views,
+		r.Policy,
+		r.Weights)
 	if err != nil {
 		return err
 	}
-	return tx.Commit()
+
+	// Every change gets a new serial and is recorded in the journal
+	serial := db.Serial() + 1
+	var oldJson, newJson []byte
+	if old != nil {
+		oldJson, err = json.Marshal(newEntryRow(old))
+		if err != nil {
+			return err
+		}
+	}
+	newJson, err = json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`
+	INSERT INTO journal (serial, hostname, old, new)
+	VALUES (?, ?, ?, ?);
+		`,
+		serial,
+		r.Hostname,
+		string(oldJson),
+		string(newJson))
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("DELETE FROM journal WHERE serial <= ?", int64(serial)-journalSize)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("UPDATE zone SET serial = ?", serial)
+	if err != nil {
+		return err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+	// Offline entries stay in the cache, it knows what they answer
+	db.cache.Put(e)
+	atomic.StoreUint32(&db.serial, serial)
+	for _, f := range db.listeners {
+		f(serial)
+	}
+	return nil
 }
 
+// Users are not part of the zone, saving them neither changes the serial nor
+// calls the change listeners.
 func (db *SqliteCoolDB) SaveAuth(auth *Auth) error {
 	db.cache.PutUser(auth)
 	db.Lock()
@@ -205,12 +543,13 @@ func (db *SqliteCoolDB) SaveAuth(auth *Auth) error {
 
 	_, err = tx.Exec(`
 	INSERT OR REPLACE INTO users
-	 (name, salt, key)
-	VALUES (?, ?, ?);
+	 (name, salt, key, tsig)
+	VALUES (?, ?, ?, ?);
 		`,
 		auth.Name,
 		auth.Salt,
-		auth.Key)
+		auth.Key,
+		auth.TsigKey)
 	if err != nil {
 		return err
 	}
@@ -221,76 +560,65 @@ func (db *SqliteCoolDB) loadAll() (map[string]*Entry, error) {
 	db.Lock()
 	defer db.Unlock()
 
-	rows, err := db.c.Query("SELECT hostname, cname, ip4, ip6, offline, mx, txt FROM cooldns")
+	rows, err := db.c.Query(`SELECT hostname, cname, ip4, ip6, offline, mx, txt, ttl, wildcard, reverse,
+	 srv, caa, ptr, sshfp, tlsa, https, svcb, offline_mode, ns, views, policy, weights FROM cooldns`)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 	m := make(map[string]*Entry)
 	for rows.Next() {
-		e := Entry{}
-		var (
-			ip4s string
-			ip6s string
-			txts string
-			mxs  string
-		)
+		r := entryRow{}
 		err = rows.Scan(
-			&e.Hostname,
-			&e.Cname,
-			&ip4s,
-			&ip6s,
-			&e.Offline,
-			&mxs,
-			&txts)
+			&r.Hostname,
+			&r.Cname,
+			&r.Ip4,
+			&r.Ip6,
+			&r.Offline,
+			&r.Mx,
+			&r.Txt,
+			&r.Ttl,
+			&r.Wildcard,
+			&r.Reverse,
+			&r.Srv,
+			&r.Caa,
+			&r.Ptr,
+			&r.Sshfp,
+			&r.Tlsa,
+			&r.Https,
+			&r.Svcb,
+			&r.OfflineMode,
+			&r.Ns,
+			&r.Views,
+			&r.Policy,
+			&r.Weights)
 		if err != nil {
 			break
 		}
-		// unmarshal ip6 address
-		for _, ip4 := range strings.Split(ip4s, dbRecSep) {
-			ip := net.ParseIP(ip4)
-			if ip == nil {
-				continue
-			}
-			e.Ip4s = append(e.Ip4s, ip)
-		}
-		// unmarshal ip6 addresses
-		for _, ip6 := range strings.Split(ip6s, dbRecSep) {
-			ip := net.ParseIP(ip6)
-			if ip == nil {
-				continue
-			}
-			e.Ip6s = append(e.Ip6s, ip)
-		}
+		m[r.Hostname] = r.entry()
+	}
+	return m, err
+}
 
-		e.Txts = strings.Split(txts, dbRecSep)
-		// unmarshal MX entries
-		for _, mx := range strings.Split(mxs, dbRecSep) {
-			mxSubA := strings.Fields(mx)
-			if len(mxSubA) != 2 {
-				continue
-			}
-			prio, err := strconv.ParseInt(mxSubA[0], 10, 0)
-			if err != nil {
-				log.Println("Warning: loadAll: Malformatted mx entry in database:", mxSubA)
-				continue
-			}
-			e.Mxs = append(e.Mxs, MxEntry{
-				ip:       mxSubA[1],
-				priority: int(prio),
-			})
-		}
+// Load the serial of the zone, a new zone starts with the current time.
+func (db *SqliteCoolDB) loadSerial() (uint32, error) {
+	db.Lock()
+	defer db.Unlock()
 
-		m[e.Hostname] = &e
+	var serial uint32
+	err := db.c.QueryRow("SELECT serial FROM zone").Scan(&serial)
+	if err == sql.ErrNoRows {
+		serial = uint32(time.Now().Unix())
+		_, err = db.c.Exec("INSERT INTO zone (serial) VALUES (?)", serial)
 	}
-	return m, err
+	return serial, err
 }
 
 func (db *SqliteCoolDB) loadUsers() (map[string]*Auth, error) {
 	db.Lock()
 	defer db.Unlock()
 
-	rows, err := db.c.Query("SELECT name, salt, key FROM users")
+	rows, err := db.c.Query("SELECT name, salt, key, tsig FROM users")
 	if err != nil {
 		return nil, err
 	}
@@ -301,7 +629,8 @@ func (db *SqliteCoolDB) loadUsers() (map[string]*Auth, error) {
 		err = rows.Scan(
 			&a.Name,
 			&a.Salt,
-			&a.Key)
+			&a.Key,
+			&a.TsigKey)
 		if err != nil {
 			break
 		}
@@ -318,3 +647,71 @@ func (db *SqliteCoolDB) GetAuth(name string) *Auth {
 func (db *SqliteCoolDB) GetEntry(name string) *Entry {
 	return db.cache.Get(name)
 }
+
+func (db *SqliteCoolDB) LookupEntry(name string) (*Entry, string, bool) {
+	return db.cache.Lookup(name)
+}
+
+func (db *SqliteCoolDB) LookupReverse(name string) ([]string, bool) {
+	return db.cache.LookupReverse(name)
+}
+
+func (db *SqliteCoolDB) Entries() []*Entry {
+	return db.cache.All()
+}
+
+func (db *SqliteCoolDB) Serial() uint32 {
+	return atomic.LoadUint32(&db.serial)
+}
+
+func (db *SqliteCoolDB) OnChange(f func(serial uint32)) {
+	db.Lock()
+	defer db.Unlock()
+	db.listeners = append(db.listeners, f)
+}
+
+func (db *SqliteCoolDB) Journal(since uint32) ([]*JournalEntry, error) {
+	db.Lock()
+	defer db.Unlock()
+
+	rows, err := db.c.Query("SELECT serial, old, new FROM journal WHERE serial > ? ORDER BY serial", since)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var journal []*JournalEntry
+	for rows.Next() {
+		var (
+			j       JournalEntry
+			oldJson string
+			newJson string
+		)
+		err = rows.Scan(&j.Serial, &oldJson, &newJson)
+		if err != nil {
+			return nil, err
+		}
+		if oldJson != "" {
+			var r entryRow
+			err = json.Unmarshal([]byte(oldJson), &r)
+			if err != nil {
+				return nil, err
+			}
+			j.Old = r.entry()
+		}
+		var r entryRow
+		err = json.Unmarshal([]byte(newJson), &r)
+		if err != nil {
+			return nil, err
+		}
+		j.New = r.entry()
+		journal = append(journal, &j)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	// The changes right after since have already been dropped
+	if since != db.serial && (len(journal) == 0 || journal[0].Serial != since+1) {
+		return nil, ErrJournalIncomplete
+	}
+	return journal, nil
+}
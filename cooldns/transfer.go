@@ -0,0 +1,217 @@
+// The CoolDNS Project. The simple dynamic dns server and update service.
+// Copyright (C) 2014 The CoolDNS Authors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.package main
+
+package cooldns
+
+import (
+	"code.google.com/p/go.net/idna"
+	"github.com/miekg/dns"
+	"log"
+	"strings"
+	"time"
+)
+
+// Packed size a single message of a zone transfer is filled up to, well
+// below the 64 KiB limit of a DNS message over TCP
+const transferSize = 16 << 10
+
+// Owner name of an entry on the wire
+func ownerName(e *Entry) string {
+	name, err := idna.ToASCII(e.Hostname)
+	if err != nil {
+		return e.Hostname
+	}
+	return name
+}
+
+// All records of an entry in the zone, wildcards included. Entries of other
+// zones have no records.
+func (h *dnsHandler) zoneEntryRecords(zone string, e *Entry) []dns.RR {
+	e = h.servedEntry(e)
+	if e == nil {
+		return nil
+	}
+	return h.storedRecords(zone, e)
+}
+
+// Records of an entry in the zone as stored, no matter what the entry
+// answers while it is offline
+func (h *dnsHandler) storedRecords(zone string, e *Entry) []dns.RR {
+	if h.zoneOf(ownerName(e)) != zone {
+		return nil
+	}
+	// Names below a delegation belong to the child zone
+	if e.delegated() {
+		return append(h.delegationNs(e), h.glue(e)...)
+	}
+	rrs := h.allRecords(e, ownerName(e))
+	if e.Wildcard {
+		rrs = append(rrs, h.allRecords(e, "*."+ownerName(e))...)
+	}
+	for _, owner := range e.owners() {
+		rrs = append(rrs, h.ownerRecords(e, owner, owner+"."+ownerName(e))...)
+	}
+	return rrs
+}
+
+// All records of the zone, starting and ending with the SOA record
+func (h *dnsHandler) zoneRecords(soa *dns.SOA) []dns.RR {
+	rrs := []dns.RR{soa}
+	rrs = append(rrs, h.ns(soa.Hdr.Name)...)
+	for _, e := range h.db.Entries() {
+		rrs = append(rrs, h.zoneEntryRecords(soa.Hdr.Name, e)...)
+	}
+	return append(rrs, soa)
+}
+
+// Incremental transfer from serial to the current zone (RFC 1995). Every
+// change in the journal becomes its own difference sequence. If the journal
+// does not reach back far enough, the full zone is returned. The serial is
+// shared by all zones, changes of other zones have empty sequences.
+func (h *dnsHandler) incrementalRecords(soa *dns.SOA, serial uint32) []dns.RR {
+	journal, err := h.db.Journal(serial)
+	if err != nil {
+		if err != ErrJournalIncomplete {
+			log.Println("IXFR: Failed to read journal:", err)
+		}
+		return h.zoneRecords(soa)
+	}
+	rrs := []dns.RR{soa}
+	for _, change := range journal {
+		var oldRRs, newRRs []dns.RR
+		if change.Old != nil {
+			oldRRs = h.zoneEntryRecords(soa.Hdr.Name, change.Old)
+		}
+		newRRs = h.zoneEntryRecords(soa.Hdr.Name, change.New)
+
+		before := h.soa(soa.Hdr.Name)
+		before.Serial = change.Serial - 1
+		after := h.soa(soa.Hdr.Name)
+		after.Serial = change.Serial
+		rrs = append(rrs, before)
+		rrs = append(rrs, rrDifference(oldRRs, newRRs)...)
+		rrs = append(rrs, after)
+		rrs = append(rrs, rrDifference(newRRs, oldRRs)...)
+	}
+	return append(rrs, soa)
+}
+
+// Records of a that are not in b. TTL changes count as difference.
+func rrDifference(a, b []dns.RR) []dns.RR {
+	inB := make(map[string]bool)
+	for _, rr := range b {
+		inB[strings.ToLower(rr.String())] = true
+	}
+	var diff []dns.RR
+	for _, rr := range a {
+		if !inB[strings.ToLower(rr.String())] {
+			diff = append(diff, rr)
+		}
+	}
+	return diff
+}
+
+// Split the records of a transfer into messages of at most transferSize
+// bytes. A record that is larger on its own is sent in a message of its own.
+func transferChunks(r *dns.Msg, rrs []dns.RR) [][]dns.RR {
+	var chunks [][]dns.RR
+	m := new(dns.Msg)
+	m.SetReply(r)
+	start := 0
+	for i, rr := range rrs {
+		m.Answer = append(m.Answer, rr)
+		if i > start && m.Len() > transferSize {
+			chunks = append(chunks, rrs[start:i])
+			start = i
+			m.Answer = []dns.RR{rr}
+		}
+	}
+	return append(chunks, rrs[start:])
+}
+
+// Handle AXFR and IXFR requests. Transfers have to be signed with the TSIG
+// key of the zone, without a configured key there are no transfers at all.
+func (h *dnsHandler) handleTransfer(w dns.ResponseWriter, r *dns.Msg) {
+	q := r.Question[0]
+	tsig := r.IsTsig()
+	refuse := func(rcode int) {
+		m := new(dns.Msg)
+		m.SetRcode(r, rcode)
+		if tsig != nil && w.TsigStatus() == nil {
+			m.SetTsig(tsig.Hdr.Name, tsig.Algorithm, 300, time.Now().Unix())
+		}
+		err := w.WriteMsg(m)
+		if err != nil {
+			log.Println("Transfer: Failed to write response:", err)
+		}
+	}
+	zone := strings.ToLower(q.Name)
+	if h.forwardZone(zone) == nil {
+		refuse(dns.RcodeNotAuth)
+		return
+	}
+	if h.tsigkey == "" || tsig == nil || strings.ToLower(tsig.Hdr.Name) != zone {
+		refuse(dns.RcodeRefused)
+		return
+	}
+	if w.TsigStatus() != nil {
+		log.Println("Transfer: TSIG verification failed:", w.TsigStatus())
+		refuse(dns.RcodeNotAuth)
+		return
+	}
+
+	soa := h.soa(zone)
+	var rrs []dns.RR
+	switch q.Qtype {
+	case dns.TypeAXFR:
+		if w.RemoteAddr().Network() != "tcp" {
+			refuse(dns.RcodeRefused)
+			return
+		}
+		rrs = h.zoneRecords(soa)
+	case dns.TypeIXFR:
+		var serial uint32
+		if len(r.Ns) == 1 {
+			if clientSoa, ok := r.Ns[0].(*dns.SOA); ok {
+				serial = clientSoa.Serial
+			}
+		}
+		if serial == 0 {
+			refuse(dns.RcodeFormatError)
+			return
+		}
+		if serial == soa.Serial || w.RemoteAddr().Network() != "tcp" {
+			// Up to date, or the client has to retry over TCP
+			rrs = []dns.RR{soa}
+		} else {
+			rrs = h.incrementalRecords(soa, serial)
+		}
+	}
+
+	ch := make(chan *dns.Envelope)
+	done := make(chan error)
+	tr := new(dns.Transfer)
+	go func() {
+		done <- tr.Out(w, r, ch)
+	}()
+	for _, chunk := range transferChunks(r, rrs) {
+		ch <- &dns.Envelope{RR: chunk}
+	}
+	close(ch)
+	if err := <-done; err != nil {
+		log.Println("Transfer: Failed to send zone:", err)
+	}
+}
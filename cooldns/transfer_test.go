@@ -0,0 +1,220 @@
+// The CoolDNS Project. The simple dynamic dns server and update service.
+// Copyright (C) 2014 The CoolDNS Authors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.package main
+
+package cooldns
+
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Request a zone transfer, signed with the zone key if secret is set
+func transfer(port, secret string, m *dns.Msg) ([]dns.RR, error) {
+	tr := new(dns.Transfer)
+	if secret != "" {
+		zone := m.Question[0].Name
+		tr.TsigSecret = map[string]string{zone: secret}
+		m.SetTsig(zone, dns.HmacSHA256, 300, time.Now().Unix())
+	}
+	var (
+		env chan *dns.Envelope
+		err error
+	)
+	for i := 0; i < 10; i++ {
+		env, err = tr.In(m, "127.0.0.1:"+port)
+		if err == nil {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var rrs []dns.RR
+	for e := range env {
+		if e.Error != nil {
+			return rrs, e.Error
+		}
+		rrs = append(rrs, e.RR...)
+	}
+	return rrs, nil
+}
+
+func countType(rrs []dns.RR, rrtype uint16) int {
+	n := 0
+	for _, rr := range rrs {
+		if rr.Header().Rrtype == rrtype {
+			n++
+		}
+	}
+	return n
+}
+
+func TestDnsAxfr(t *testing.T) {
+	db, err := getTmpDB()
+	if err != nil {
+		t.Fatal("Failed to create temporary DB")
+	}
+	key, _ := NewTsigKey()
+	port := startDnsServer(db, key)
+	for i := range dnstestentrylist {
+		db.SaveEntry(&dnstestentrylist[i])
+	}
+
+	m := new(dns.Msg)
+	m.SetAxfr("ist.nicht.cool.")
+	rrs, err := transfer(port, key, m)
+	if err != nil {
+		t.Fatal("AXFR failed:", err)
+	}
+	if len(rrs) < 2 || rrs[0].Header().Rrtype != dns.TypeSOA ||
+		rrs[len(rrs)-1].Header().Rrtype != dns.TypeSOA {
+		t.Fatal("AXFR does not start and end with the SOA:", rrs)
+	}
+	if rrs[0].(*dns.SOA).Serial != db.Serial() {
+		t.Errorf("AXFR serial %d, expected %d", rrs[0].(*dns.SOA).Serial, db.Serial())
+	}
+	var a, aaaa, mx, txt int
+	for _, e := range dnstestentrylist {
+		a += len(e.Ip4s)
+		aaaa += len(e.Ip6s)
+		mx += len(e.Mxs)
+		// All strings of an entry are sent in a single TXT record
+		if len(e.Txts) > 0 {
+			txt++
+		}
+	}
+	if countType(rrs, dns.TypeA) != a || countType(rrs, dns.TypeAAAA) != aaaa ||
+		countType(rrs, dns.TypeMX) != mx || countType(rrs, dns.TypeTXT) != txt {
+		t.Error("AXFR is missing records:", rrs)
+	}
+	if countType(rrs, dns.TypeNS) != 1 {
+		t.Error("AXFR is missing the NS set:", rrs)
+	}
+
+	// Unsigned and wrongly signed transfers are refused
+	m = new(dns.Msg)
+	m.SetAxfr("ist.nicht.cool.")
+	_, err = transfer(port, "", m)
+	if err == nil {
+		t.Error("Unsigned AXFR was not refused")
+	}
+	wrongKey, _ := NewTsigKey()
+	m = new(dns.Msg)
+	m.SetAxfr("ist.nicht.cool.")
+	_, err = transfer(port, wrongKey, m)
+	if err == nil {
+		t.Error("AXFR with a wrong key was not refused")
+	}
+}
+
+func TestDnsIxfr(t *testing.T) {
+	db, err := getTmpDB()
+	if err != nil {
+		t.Fatal("Failed to create temporary DB")
+	}
+	key, _ := NewTsigKey()
+	port := startDnsServer(db, key)
+	db.SaveEntry(&Entry{
+		Hostname: "ixfr.ist.nicht.cool.",
+		Ip4s:     []net.IP{net.ParseIP("192.168.0.1")},
+	})
+	serial := db.Serial()
+	db.SaveEntry(&Entry{
+		Hostname: "ixfr.ist.nicht.cool.",
+		Ip4s:     []net.IP{net.ParseIP("192.168.0.2")},
+	})
+	db.SaveEntry(&Entry{
+		Hostname: "new.ist.nicht.cool.",
+		Txts:     []string{"neu"},
+	})
+
+	m := new(dns.Msg)
+	m.SetIxfr("ist.nicht.cool.", serial, "ns.ist.nicht.cool.", "hostmaster.ist.nicht.cool.")
+	rrs, err := transfer(port, key, m)
+	if err != nil {
+		t.Fatal("IXFR failed:", err)
+	}
+	// SOA, (SOA, -A, SOA, +A), (SOA, SOA, +TXT), SOA
+	if len(rrs) != 9 {
+		t.Fatal("Unexpected IXFR response:", rrs)
+	}
+	if rrs[1].(*dns.SOA).Serial != serial || rrs[3].(*dns.SOA).Serial != serial+1 {
+		t.Error("Wrong serials in first difference sequence:", rrs)
+	}
+	if rrs[2].(*dns.A).A.String() != "192.168.0.1" || rrs[4].(*dns.A).A.String() != "192.168.0.2" {
+		t.Error("Wrong first difference sequence:", rrs)
+	}
+	if rrs[7].(*dns.TXT).Txt[0] != "neu" {
+		t.Error("Wrong second difference sequence:", rrs)
+	}
+
+	// An up to date client only gets the SOA
+	m = new(dns.Msg)
+	m.SetIxfr("ist.nicht.cool.", db.Serial(), "ns.ist.nicht.cool.", "hostmaster.ist.nicht.cool.")
+	rrs, err = transfer(port, key, m)
+	if err != nil {
+		t.Fatal("IXFR failed:", err)
+	}
+	if len(rrs) != 1 {
+		t.Error("Expected only the SOA:", rrs)
+	}
+
+	// Serials older than the journal fall back to a full transfer
+	m = new(dns.Msg)
+	m.SetIxfr("ist.nicht.cool.", 1, "ns.ist.nicht.cool.", "hostmaster.ist.nicht.cool.")
+	rrs, err = transfer(port, key, m)
+	if err != nil {
+		t.Fatal("IXFR failed:", err)
+	}
+	if countType(rrs, dns.TypeNS) != 1 || countType(rrs, dns.TypeA) != 1 {
+		t.Error("Expected a full zone transfer:", rrs)
+	}
+}
+
+func TestDnsAxfrLarge(t *testing.T) {
+	db, err := getTmpDB()
+	if err != nil {
+		t.Fatal("Failed to create temporary DB")
+	}
+	key, _ := NewTsigKey()
+	port := startDnsServer(db, key)
+	txt := strings.Repeat("x", 250)
+	for i := 0; i < 300; i++ {
+		db.SaveEntry(&Entry{
+			Hostname: fmt.Sprintf("txt%d.ist.nicht.cool.", i),
+			Txts:     []string{txt},
+		})
+	}
+
+	// 300 records of 250 bytes do not fit into a single 64 KiB message
+	m := new(dns.Msg)
+	m.SetAxfr("ist.nicht.cool.")
+	rrs, err := transfer(port, key, m)
+	if err != nil {
+		t.Fatal("AXFR failed:", err)
+	}
+	if countType(rrs, dns.TypeTXT) != 300 {
+		t.Errorf("AXFR sent %d TXT records, expected 300", countType(rrs, dns.TypeTXT))
+	}
+	if rrs[len(rrs)-1].Header().Rrtype != dns.TypeSOA {
+		t.Error("AXFR does not end with the SOA")
+	}
+}
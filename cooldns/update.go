@@ -0,0 +1,445 @@
+// The CoolDNS Project. The simple dynamic dns server and update service.
+// Copyright (C) 2014 The CoolDNS Authors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.package main
+
+package cooldns
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"github.com/miekg/dns"
+	"hash"
+	"log"
+	"net"
+	"strings"
+	"time"
+)
+
+// TSIG key ring of the DNS server. The zone key is named after the zone it
+// is used for, every host has its own key named after the hostname and
+// stored with its Auth. Key names of internationalized hosts are in puny
+// code.
+type tsigKeyring struct {
+	db     CoolDB
+	zones  []*dnsZone
+	secret string
+}
+
+func (k *tsigKeyring) lookup(name string) (string, error) {
+	name = strings.ToLower(name)
+	for _, zone := range k.zones {
+		if name != zone.domain {
+			continue
+		}
+		if k.secret == "" {
+			return "", dns.ErrSecret
+		}
+		return k.secret, nil
+	}
+	a := k.db.GetAuth(storedName(name))
+	if a == nil || a.TsigKey == "" {
+		return "", dns.ErrSecret
+	}
+	return a.TsigKey, nil
+}
+
+func (k *tsigKeyring) Generate(msg []byte, t *dns.TSIG) ([]byte, error) {
+	secret, err := k.lookup(t.Hdr.Name)
+	if err != nil {
+		return nil, err
+	}
+	rawsecret, err := base64.StdEncoding.DecodeString(secret)
+	if err != nil {
+		return nil, err
+	}
+	var h hash.Hash
+	switch dns.CanonicalName(t.Algorithm) {
+	case dns.HmacSHA1:
+		h = hmac.New(sha1.New, rawsecret)
+	case dns.HmacSHA256:
+		h = hmac.New(sha256.New, rawsecret)
+	case dns.HmacSHA512:
+		h = hmac.New(sha512.New, rawsecret)
+	default:
+		return nil, dns.ErrKeyAlg
+	}
+	h.Write(msg)
+	return h.Sum(nil), nil
+}
+
+func (k *tsigKeyring) Verify(msg []byte, t *dns.TSIG) error {
+	b, err := k.Generate(msg, t)
+	if err != nil {
+		return err
+	}
+	mac, err := hex.DecodeString(t.MAC)
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal(b, mac) {
+		return dns.ErrSig
+	}
+	return nil
+}
+
+// Accept dynamic updates in addition to the messages accepted by default.
+// Updates carry records in all sections, so the default checks do not apply.
+func acceptMsg(dh dns.Header) dns.MsgAcceptAction {
+	isResponse := dh.Bits&(1<<15) != 0
+	opcode := int(dh.Bits>>11) & 0xF
+	if opcode == dns.OpcodeUpdate && !isResponse {
+		return dns.MsgAccept
+	}
+	return dns.DefaultMsgAcceptFunc(dh)
+}
+
+// Handle a dynamic update according to RFC 2136. Updates must be signed
+// with the TSIG key of the host they change, the zone key may change every
+// host. Only registered hosts can be updated, new names can not be created.
+func (h *dnsHandler) handleUpdate(w dns.ResponseWriter, r *dns.Msg) {
+	m := new(dns.Msg)
+	m.SetReply(r)
+	defer func(w dns.ResponseWriter, m *dns.Msg) {
+		err := w.WriteMsg(m)
+		if err != nil {
+			log.Println("Update: Failed to write response:", err)
+		}
+	}(w, m)
+
+	// Updates go to the primary
+	if h.secondary != nil {
+		m.Rcode = dns.RcodeRefused
+		return
+	}
+
+	// Zone section
+	if len(r.Question) != 1 || r.Question[0].Qtype != dns.TypeSOA {
+		m.Rcode = dns.RcodeFormatError
+		return
+	}
+	zone := strings.ToLower(r.Question[0].Name)
+	if h.forwardZone(zone) == nil {
+		m.Rcode = dns.RcodeNotAuth
+		return
+	}
+
+	// Only signed updates are accepted
+	tsig := r.IsTsig()
+	if tsig == nil {
+		m.Rcode = dns.RcodeRefused
+		return
+	}
+	if w.TsigStatus() != nil {
+		log.Println("Update: TSIG verification failed:", tsig.Hdr.Name, w.TsigStatus())
+		m.Rcode = dns.RcodeNotAuth
+		return
+	}
+	zoneKey := strings.ToLower(tsig.Hdr.Name) == zone
+	keyName := storedName(tsig.Hdr.Name)
+	m.SetTsig(tsig.Hdr.Name, tsig.Algorithm, 300, time.Now().Unix())
+
+	// Work on copies of all entries that are touched by the update
+	entries := make(map[string]*Entry)
+	getEntry := func(name string) *Entry {
+		name = storedName(name)
+		if e, ok := entries[name]; ok {
+			return e
+		}
+		e := h.db.GetEntry(name)
+		if e != nil {
+			e = e.Copy()
+		}
+		entries[name] = e
+		return e
+	}
+
+	// Prerequisite section
+	rcode := h.checkPrerequisites(zone, r.Answer, getEntry)
+	if rcode != dns.RcodeSuccess {
+		m.Rcode = rcode
+		return
+	}
+
+	// Prescan the update section
+	for _, rr := range r.Ns {
+		hdr := rr.Header()
+		name := strings.ToLower(hdr.Name)
+		if h.zone(name) == nil || h.zone(name).domain != zone {
+			m.Rcode = dns.RcodeNotZone
+			return
+		}
+		// Hosts may only update their own entry
+		if !zoneKey && storedName(name) != keyName {
+			m.Rcode = dns.RcodeRefused
+			return
+		}
+		if getEntry(name) == nil {
+			m.Rcode = dns.RcodeRefused
+			return
+		}
+		switch hdr.Class {
+		case dns.ClassINET:
+			if !updateableType(hdr.Rrtype) {
+				m.Rcode = dns.RcodeRefused
+				return
+			}
+		case dns.ClassANY:
+			if hdr.Ttl != 0 || hdr.Rdlength != 0 ||
+				(hdr.Rrtype != dns.TypeANY && !updateableType(hdr.Rrtype)) {
+				m.Rcode = dns.RcodeFormatError
+				return
+			}
+		case dns.ClassNONE:
+			if hdr.Ttl != 0 || !updateableType(hdr.Rrtype) {
+				m.Rcode = dns.RcodeFormatError
+				return
+			}
+		default:
+			m.Rcode = dns.RcodeFormatError
+			return
+		}
+	}
+
+	// Update section
+	for _, rr := range r.Ns {
+		applyUpdate(getEntry(rr.Header().Name), rr)
+	}
+
+	// The same checks as for all other APIs apply
+	for _, e := range entries {
+		if e == nil {
+			continue
+		}
+		if errors := e.Validate(zone); len(errors) != 0 {
+			log.Println("Update: Rejected entry", e.Hostname, errors)
+			m.Rcode = dns.RcodeRefused
+			return
+		}
+	}
+	for _, e := range entries {
+		if e == nil {
+			continue
+		}
+		err := h.db.SaveEntry(e)
+		if err != nil {
+			log.Println("Update: Entry could not be saved", err)
+			m.Rcode = dns.RcodeServerFailure
+			return
+		}
+	}
+}
+
+// Record types that can be changed by dynamic updates
+func updateableType(t uint16) bool {
+	switch t {
+	case dns.TypeA, dns.TypeAAAA, dns.TypeTXT, dns.TypeMX, dns.TypeCNAME:
+		return true
+	}
+	return false
+}
+
+// Check the prerequisite section of an update (RFC 2136 3.2)
+func (h *dnsHandler) checkPrerequisites(zone string, prereqs []dns.RR, getEntry func(string) *Entry) int {
+	// RRsets that must exist with exactly the given records
+	required := make(map[string][]dns.RR)
+	for _, rr := range prereqs {
+		hdr := rr.Header()
+		if hdr.Ttl != 0 {
+			return dns.RcodeFormatError
+		}
+		if !dns.IsSubDomain(zone, strings.ToLower(hdr.Name)) {
+			return dns.RcodeNotZone
+		}
+		e := getEntry(hdr.Name)
+		switch hdr.Class {
+		case dns.ClassANY:
+			if hdr.Rdlength != 0 {
+				return dns.RcodeFormatError
+			}
+			if hdr.Rrtype == dns.TypeANY {
+				// Name is in use
+				if e == nil {
+					return dns.RcodeNameError
+				}
+			} else if e == nil || len(h.entryRecords(e, hdr.Name, hdr.Rrtype)) == 0 {
+				// RRset exists (value independent)
+				return dns.RcodeNXRrset
+			}
+		case dns.ClassNONE:
+			if hdr.Rdlength != 0 {
+				return dns.RcodeFormatError
+			}
+			if hdr.Rrtype == dns.TypeANY {
+				// Name is not in use
+				if e != nil {
+					return dns.RcodeYXDomain
+				}
+			} else if e != nil && len(h.entryRecords(e, hdr.Name, hdr.Rrtype)) != 0 {
+				// RRset does not exist
+				return dns.RcodeYXRrset
+			}
+		case dns.ClassINET:
+			// RRset exists (value dependent)
+			key := strings.ToLower(hdr.Name) + "/" + dns.TypeToString[hdr.Rrtype]
+			required[key] = append(required[key], rr)
+		default:
+			return dns.RcodeFormatError
+		}
+	}
+	for _, rrs := range required {
+		hdr := rrs[0].Header()
+		e := getEntry(hdr.Name)
+		if e == nil {
+			return dns.RcodeNXRrset
+		}
+		if !sameRRset(rrs, h.entryRecords(e, hdr.Name, hdr.Rrtype)) {
+			return dns.RcodeNXRrset
+		}
+	}
+	return dns.RcodeSuccess
+}
+
+// Compares two RRsets ignoring TTL and order
+func sameRRset(a, b []dns.RR) bool {
+	contains := func(set []dns.RR, rr dns.RR) bool {
+		for _, r := range set {
+			if dns.IsDuplicate(r, rr) {
+				return true
+			}
+		}
+		return false
+	}
+	for _, rr := range a {
+		if !contains(b, rr) {
+			return false
+		}
+	}
+	for _, rr := range b {
+		if !contains(a, rr) {
+			return false
+		}
+	}
+	return true
+}
+
+// Apply a single RR of the update section to an entry. The TXT strings of an
+// entry form a single record, so adding a TXT record replaces it. The TTL
+// of added records becomes the TTL of the entry.
+func applyUpdate(e *Entry, rr dns.RR) {
+	hdr := rr.Header()
+	switch hdr.Class {
+	case dns.ClassINET:
+		e.Ttl = hdr.Ttl
+		switch r := rr.(type) {
+		case *dns.A:
+			if !containsIP(e.Ip4s, r.A) {
+				e.Ip4s = append(e.Ip4s, r.A)
+			}
+		case *dns.AAAA:
+			if !containsIP(e.Ip6s, r.AAAA) {
+				e.Ip6s = append(e.Ip6s, r.AAAA)
+			}
+		case *dns.TXT:
+			e.Txts = r.Txt
+		case *dns.MX:
+			mx := MxEntry{ip: strings.ToLower(r.Mx), priority: int(r.Preference)}
+			for _, emx := range e.Mxs {
+				if emx == mx {
+					return
+				}
+			}
+			e.Mxs = append(e.Mxs, mx)
+		case *dns.CNAME:
+			e.Cname = strings.ToLower(r.Target)
+		}
+	case dns.ClassANY:
+		// Delete an RRset or all RRsets of a name
+		if hdr.Rrtype == dns.TypeA || hdr.Rrtype == dns.TypeANY {
+			e.Ip4s = nil
+		}
+		if hdr.Rrtype == dns.TypeAAAA || hdr.Rrtype == dns.TypeANY {
+			e.Ip6s = nil
+		}
+		if hdr.Rrtype == dns.TypeTXT || hdr.Rrtype == dns.TypeANY {
+			e.Txts = nil
+		}
+		if hdr.Rrtype == dns.TypeMX || hdr.Rrtype == dns.TypeANY {
+			e.Mxs = nil
+		}
+		if hdr.Rrtype == dns.TypeCNAME || hdr.Rrtype == dns.TypeANY {
+			e.Cname = ""
+		}
+	case dns.ClassNONE:
+		// Delete a single RR
+		switch r := rr.(type) {
+		case *dns.A:
+			e.Ip4s = removeIP(e.Ip4s, r.A)
+		case *dns.AAAA:
+			e.Ip6s = removeIP(e.Ip6s, r.AAAA)
+		case *dns.TXT:
+			if stringsEqual(e.Txts, r.Txt) {
+				e.Txts = nil
+			}
+		case *dns.MX:
+			mx := MxEntry{ip: strings.ToLower(r.Mx), priority: int(r.Preference)}
+			var mxs []MxEntry
+			for _, emx := range e.Mxs {
+				if emx != mx {
+					mxs = append(mxs, emx)
+				}
+			}
+			e.Mxs = mxs
+		case *dns.CNAME:
+			if strings.ToLower(r.Target) == e.Cname {
+				e.Cname = ""
+			}
+		}
+	}
+}
+
+func containsIP(ips []net.IP, ip net.IP) bool {
+	for _, i := range ips {
+		if i.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func removeIP(ips []net.IP, ip net.IP) []net.IP {
+	var n []net.IP
+	for _, i := range ips {
+		if !i.Equal(ip) {
+			n = append(n, i)
+		}
+	}
+	return n
+}
+
+func stringsEqual(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,264 @@
+// The CoolDNS Project. The simple dynamic dns server and update service.
+// Copyright (C) 2014 The CoolDNS Authors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.package main
+
+package cooldns
+
+import (
+	"github.com/miekg/dns"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Send an update signed with the key of the given name
+func sendUpdate(port, keyName, secret string, m *dns.Msg) (*dns.Msg, error) {
+	c := new(dns.Client)
+	if keyName != "" {
+		c.TsigSecret = map[string]string{keyName: secret}
+		m.SetTsig(keyName, dns.HmacSHA256, 300, time.Now().Unix())
+	}
+	var (
+		in  *dns.Msg
+		err error
+	)
+	for i := 0; i < 10; i++ {
+		in, _, err = c.Exchange(m, "127.0.0.1:"+port)
+		if err == nil {
+			return in, nil
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	return nil, err
+}
+
+func newRR(t *testing.T, s string) dns.RR {
+	rr, err := dns.NewRR(s)
+	if err != nil {
+		t.Fatal("Failed to parse RR:", s, err)
+	}
+	return rr
+}
+
+type dnsUpdateTest struct {
+	Name    string
+	Key     string // key name, "" for unsigned updates
+	Prereq  []string
+	Insert  []string
+	Remove  []string // single records
+	Clear   []string // whole RRsets
+	Rcode   int
+	Ip4s    []string
+	Txts    []string
+	Comment string
+}
+
+var dnsupdatetests = []dnsUpdateTest{
+	dnsUpdateTest{
+		Name:    "update.ist.nicht.cool.",
+		Key:     "update.ist.nicht.cool.",
+		Insert:  []string{"update.ist.nicht.cool. 300 IN A 192.168.0.1", "update.ist.nicht.cool. 300 IN TXT \"Hallo Welt\""},
+		Rcode:   dns.RcodeSuccess,
+		Ip4s:    []string{"192.168.0.1"},
+		Txts:    []string{"Hallo Welt"},
+		Comment: "Add records",
+	},
+	dnsUpdateTest{
+		Name:    "update.ist.nicht.cool.",
+		Key:     "update.ist.nicht.cool.",
+		Prereq:  []string{"update.ist.nicht.cool. 0 IN A 192.168.0.1"},
+		Insert:  []string{"update.ist.nicht.cool. 300 IN A 192.168.0.2"},
+		Remove:  []string{"update.ist.nicht.cool. 0 IN A 192.168.0.1"},
+		Rcode:   dns.RcodeSuccess,
+		Ip4s:    []string{"192.168.0.2"},
+		Txts:    []string{"Hallo Welt"},
+		Comment: "Replace address with fulfilled prerequisite",
+	},
+	dnsUpdateTest{
+		Name:    "update.ist.nicht.cool.",
+		Key:     "update.ist.nicht.cool.",
+		Prereq:  []string{"update.ist.nicht.cool. 0 IN A 192.168.0.1"},
+		Insert:  []string{"update.ist.nicht.cool. 300 IN A 192.168.0.3"},
+		Rcode:   dns.RcodeNXRrset,
+		Ip4s:    []string{"192.168.0.2"},
+		Txts:    []string{"Hallo Welt"},
+		Comment: "Prerequisite not fulfilled",
+	},
+	dnsUpdateTest{
+		Name:    "update.ist.nicht.cool.",
+		Key:     "update.ist.nicht.cool.",
+		Clear:   []string{"update.ist.nicht.cool. 0 IN TXT \"\""},
+		Rcode:   dns.RcodeSuccess,
+		Ip4s:    []string{"192.168.0.2"},
+		Comment: "Delete RRset",
+	},
+	dnsUpdateTest{
+		Name:    "update.ist.nicht.cool.",
+		Insert:  []string{"update.ist.nicht.cool. 300 IN A 192.168.0.4"},
+		Rcode:   dns.RcodeRefused,
+		Ip4s:    []string{"192.168.0.2"},
+		Comment: "Unsigned update",
+	},
+	dnsUpdateTest{
+		Name:    "update.ist.nicht.cool.",
+		Key:     "other.ist.nicht.cool.",
+		Insert:  []string{"update.ist.nicht.cool. 300 IN A 192.168.0.4"},
+		Rcode:   dns.RcodeRefused,
+		Ip4s:    []string{"192.168.0.2"},
+		Comment: "Key of another host",
+	},
+	dnsUpdateTest{
+		Name:    "update.ist.nicht.cool.",
+		Key:     "update.ist.nicht.cool.",
+		Insert:  []string{"update.ist.nicht.cool. 300 IN NS ns.provider.tld."},
+		Rcode:   dns.RcodeRefused,
+		Ip4s:    []string{"192.168.0.2"},
+		Comment: "Unsupported type",
+	},
+	dnsUpdateTest{
+		Name:    "update.ist.nicht.cool.",
+		Key:     "update.ist.nicht.cool.",
+		Insert:  []string{"update.ist.nicht.cool. 4294967295 IN A 192.168.0.5"},
+		Rcode:   dns.RcodeRefused,
+		Ip4s:    []string{"192.168.0.2"},
+		Comment: "Invalid entry",
+	},
+}
+
+func TestDnsUpdate(t *testing.T) {
+	db, err := getTmpDB()
+	if err != nil {
+		t.Fatal("Failed to create temporary DB")
+	}
+	port := startDnsServer(db, "")
+
+	keys := make(map[string]string)
+	for _, name := range []string{"update.ist.nicht.cool.", "other.ist.nicht.cool."} {
+		auth, err := NewAuth(name, "123456789")
+		if err != nil {
+			t.Fatal("Creating new user failed")
+		}
+		if db.SaveAuth(auth) != nil {
+			t.Fatal("Saving New User failed")
+		}
+		if db.SaveEntry(&Entry{Hostname: name}) != nil {
+			t.Fatal("Saving New Entry failed")
+		}
+		keys[name] = auth.TsigKey
+	}
+
+	for _, test := range dnsupdatetests {
+		m := new(dns.Msg)
+		m.SetUpdate("ist.nicht.cool.")
+		for _, s := range test.Prereq {
+			m.Answer = append(m.Answer, newRR(t, s))
+		}
+		for _, s := range test.Insert {
+			m.Insert([]dns.RR{newRR(t, s)})
+		}
+		for _, s := range test.Remove {
+			m.Remove([]dns.RR{newRR(t, s)})
+		}
+		for _, s := range test.Clear {
+			m.RemoveRRset([]dns.RR{newRR(t, s)})
+		}
+		in, err := sendUpdate(port, test.Key, keys[test.Key], m)
+		if err != nil {
+			t.Fatal("Failed:", err)
+		}
+		if in.Rcode != test.Rcode {
+			t.Errorf("%s: Expected rcode %s, got %s", test.Comment,
+				dns.RcodeToString[test.Rcode],
+				dns.RcodeToString[in.Rcode])
+		}
+
+		e := db.GetEntry(test.Name)
+		var ips []string
+		for _, ip := range e.Ip4s {
+			ips = append(ips, ip.String())
+		}
+		if !stringArrayCompare(ips, test.Ip4s) || !stringArrayCompare(e.Txts, test.Txts) {
+			t.Errorf("%s: Entry does not match:\n%v", test.Comment, e)
+		}
+	}
+}
+
+func TestDnsUpdateBadSignature(t *testing.T) {
+	db, err := getTmpDB()
+	if err != nil {
+		t.Fatal("Failed to create temporary DB")
+	}
+	port := startDnsServer(db, "")
+	auth, _ := NewAuth("badsig.ist.nicht.cool.", "123456789")
+	db.SaveAuth(auth)
+	db.SaveEntry(&Entry{Hostname: "badsig.ist.nicht.cool."})
+
+	wrongKey, _ := NewTsigKey()
+	m := new(dns.Msg)
+	m.SetUpdate("ist.nicht.cool.")
+	m.Insert([]dns.RR{&dns.A{
+		Hdr: dns.RR_Header{Name: "badsig.ist.nicht.cool.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+		A:   net.ParseIP("192.168.0.1"),
+	}})
+	in, err := sendUpdate(port, "badsig.ist.nicht.cool.", wrongKey, m)
+	if err != nil && in == nil {
+		t.Fatal("Failed:", err)
+	}
+	if in.Rcode != dns.RcodeNotAuth {
+		t.Errorf("Expected NOTAUTH, got %s", dns.RcodeToString[in.Rcode])
+	}
+	if e := db.GetEntry("badsig.ist.nicht.cool."); len(e.Ip4s) != 0 {
+		t.Error("Entry was updated with a bad signature:", e)
+	}
+}
+
+func TestDnsUpdateIdn(t *testing.T) {
+	db, err := getTmpDB()
+	if err != nil {
+		t.Fatal("Failed to create temporary DB")
+	}
+	port := startDnsServer(db, "")
+
+	// Internationalized hosts are stored in Unicode, the key name and the
+	// records of the update are in puny code
+	auth, err := NewAuth("müller.ist.nicht.cool.", "123456789")
+	if err != nil {
+		t.Fatal("Creating new user failed")
+	}
+	if db.SaveAuth(auth) != nil {
+		t.Fatal("Saving New User failed")
+	}
+	if db.SaveEntry(&Entry{Hostname: "müller.ist.nicht.cool."}) != nil {
+		t.Fatal("Saving New Entry failed")
+	}
+	m := new(dns.Msg)
+	m.SetUpdate("ist.nicht.cool.")
+	m.Insert([]dns.RR{newRR(t, "xn--mller-kva.ist.nicht.cool. 300 IN A 192.168.0.1")})
+	in, err := sendUpdate(port, "xn--mller-kva.ist.nicht.cool.", auth.TsigKey, m)
+	if err != nil {
+		t.Fatal("Failed:", err)
+	}
+	if in.Rcode != dns.RcodeSuccess {
+		t.Fatal("Update of an internationalized host failed:", dns.RcodeToString[in.Rcode])
+	}
+	e := db.GetEntry("müller.ist.nicht.cool.")
+	if len(e.Ip4s) != 1 || !e.Ip4s[0].Equal(net.ParseIP("192.168.0.1")) {
+		t.Error("Entry was not updated:", e)
+	}
+	if !strings.Contains(tsigKeyMessage(auth), "key name xn--mller-kva.ist.nicht.cool.") {
+		t.Error("Key name is not in puny code:", tsigKeyMessage(auth))
+	}
+}
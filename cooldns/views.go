@@ -0,0 +1,171 @@
+// The CoolDNS Project. The simple dynamic dns server and update service.
+// Copyright (C) 2014 The CoolDNS Authors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.package main
+
+package cooldns
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/miekg/dns"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// A view of the zones. Clients from its networks or signing their queries
+// with one of its TSIG keys get the addresses entries have for the view.
+type ViewConfig struct {
+	Name     string   `json:"name"`
+	Networks []string `json:"networks"`  // CIDR prefixes
+	TsigKeys []string `json:"tsig_keys"` // Names of host or zone keys
+}
+
+// Read the views from a JSON file holding a list of views
+func loadViews(file string) ([]*ViewConfig, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var views []*ViewConfig
+	err = json.NewDecoder(f).Decode(&views)
+	return views, err
+}
+
+// Names of the views addresses can be set for
+type viewNames []string
+
+func (v viewNames) has(name string) bool {
+	for _, view := range v {
+		if view == name {
+			return true
+		}
+	}
+	return false
+}
+
+func newViewNames(views []*ViewConfig) viewNames {
+	var names viewNames
+	for _, view := range views {
+		names = append(names, view.Name)
+	}
+	return names
+}
+
+// Checks if s can be used as name of a view
+func isViewName(s string) bool {
+	return s != "" && !strings.ContainsAny(s, " \t\n")
+}
+
+// The entry with the addresses it has for a view. Entries without addresses
+// for the view answer with their default addresses.
+func (e *Entry) inView(view string) *Entry {
+	ips, ok := e.ViewIps[view]
+	if view == "" || !ok {
+		return e
+	}
+	c := *e
+	c.Ip4s, c.Ip6s = nil, nil
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			c.Ip4s = append(c.Ip4s, ip)
+		} else {
+			c.Ip6s = append(c.Ip6s, ip)
+		}
+	}
+	return &c
+}
+
+func (e *Entry) validateViews() (errors []string) {
+	for view, ips := range e.ViewIps {
+		if !isViewName(view) {
+			errors = append(errors, "Malformatted view name")
+		}
+		for _, ip := range ips {
+			if ip.To16() == nil {
+				errors = append(errors, "Malformatted Ip Address")
+			}
+		}
+	}
+	return errors
+}
+
+// A view of the DNS server
+type dnsView struct {
+	name     string
+	networks []*net.IPNet
+	keys     map[string]bool
+}
+
+func newDnsView(config *ViewConfig) (*dnsView, error) {
+	if !isViewName(config.Name) {
+		return nil, fmt.Errorf("Malformatted view name %q", config.Name)
+	}
+	v := &dnsView{name: config.Name, keys: make(map[string]bool)}
+	for _, network := range config.Networks {
+		_, ipnet, err := net.ParseCIDR(network)
+		if err != nil {
+			return nil, err
+		}
+		v.networks = append(v.networks, ipnet)
+	}
+	for _, key := range config.TsigKeys {
+		v.keys[strings.ToLower(dns.Fqdn(key))] = true
+	}
+	return v, nil
+}
+
+// Address and port of a client
+func clientAddr(addr net.Addr) (net.IP, int) {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return a.IP, a.Port
+	case *net.TCPAddr:
+		return a.IP, a.Port
+	}
+	// Clients of DNS over HTTPS are given as host:port
+	host, p, _ := net.SplitHostPort(addr.String())
+	port, _ := strconv.Atoi(p)
+	return net.ParseIP(host), port
+}
+
+// The view of a query, empty for the default view. Verified TSIG keys take
+// precedence over the network of the client, the first matching view wins.
+func (h *dnsHandler) view(w dns.ResponseWriter, r *dns.Msg) string {
+	if len(h.views) == 0 {
+		return ""
+	}
+	if tsig := r.IsTsig(); tsig != nil && w.TsigStatus() == nil {
+		for _, view := range h.views {
+			if view.keys[strings.ToLower(tsig.Hdr.Name)] {
+				return view.name
+			}
+		}
+	}
+	ip, _ := clientAddr(w.RemoteAddr())
+	if ip == nil {
+		return ""
+	}
+	for _, view := range h.views {
+		for _, network := range view.networks {
+			if network.Contains(ip) {
+				return view.name
+			}
+		}
+	}
+	return ""
+}
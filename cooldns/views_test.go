@@ -0,0 +1,151 @@
+// The CoolDNS Project. The simple dynamic dns server and update service.
+// Copyright (C) 2014 The CoolDNS Authors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.package main
+
+package cooldns
+
+import (
+	"github.com/miekg/dns"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestEntryInView(t *testing.T) {
+	e := &Entry{
+		Hostname: "host.ist.nicht.cool.",
+		Ip4s:     []net.IP{net.ParseIP("192.168.0.1")},
+		Ip6s:     []net.IP{net.ParseIP("fe80::1")},
+		ViewIps: map[string][]net.IP{
+			"lan": []net.IP{net.ParseIP("10.0.0.1"), net.ParseIP("fd00::1")},
+			"v4":  []net.IP{net.ParseIP("10.0.0.2")},
+		},
+	}
+	if e.inView("") != e || e.inView("wan") != e {
+		t.Error("Views without addresses did not get the default addresses")
+	}
+	lan := e.inView("lan")
+	if !reflect.DeepEqual(lan.Ip4s, []net.IP{net.ParseIP("10.0.0.1")}) ||
+		!reflect.DeepEqual(lan.Ip6s, []net.IP{net.ParseIP("fd00::1")}) {
+		t.Error("Unexpected addresses in view:", lan)
+	}
+	if v4 := e.inView("v4"); len(v4.Ip6s) != 0 || len(v4.Ip4s) != 1 {
+		t.Error("Default addresses leaked into the view:", v4)
+	}
+	if len(e.Ip4s) != 1 || !e.Ip4s[0].Equal(net.ParseIP("192.168.0.1")) {
+		t.Error("Entry was modified:", e)
+	}
+
+	e.ViewIps["bad view"] = nil
+	if errs := e.validateViews(); len(errs) != 1 {
+		t.Error("Malformatted view name was accepted:", errs)
+	}
+}
+
+func TestDatabaseViews(t *testing.T) {
+	tmpFile, err := getTmpFile()
+	if err != nil {
+		t.Fatal("Failed to create temporary file")
+	}
+	db, err := getDB(tmpFile)
+	if err != nil {
+		t.Fatal("Failed to create DB:", err)
+	}
+	e := &Entry{
+		Hostname: "host.ist.nicht.cool.",
+		Ip4s:     []net.IP{net.ParseIP("192.168.0.1")},
+		ViewIps: map[string][]net.IP{
+			"lan": []net.IP{net.ParseIP("10.0.0.1"), net.ParseIP("fd00::1")},
+		},
+	}
+	if err := db.SaveEntry(e); err != nil {
+		t.Fatal("Failed to save entry:", err)
+	}
+	db.Close()
+	db, err = getDB(tmpFile)
+	if err != nil {
+		t.Fatal("Failed to reopen DB:", err)
+	}
+	defer db.Close()
+	got := db.GetEntry("host.ist.nicht.cool.")
+	if got == nil || len(got.ViewIps["lan"]) != 2 ||
+		!got.ViewIps["lan"][1].Equal(net.ParseIP("fd00::1")) {
+		t.Error("Addresses of views were not stored:", got)
+	}
+}
+
+func TestDnsViews(t *testing.T) {
+	db, err := getTmpDB()
+	if err != nil {
+		t.Fatal("Failed to create temporary DB")
+	}
+	key, _ := NewTsigKey()
+	views := []*ViewConfig{
+		&ViewConfig{Name: "office", Networks: []string{"10.0.0.0/8"}},
+		&ViewConfig{Name: "lan", Networks: []string{"127.0.0.0/8", "::1/128"}},
+		&ViewConfig{Name: "keyed", TsigKeys: []string{"ist.nicht.cool"}},
+	}
+	port := startDnsServerConfig(db, &DnsServerConfig{
+		Domain: "ist.nicht.cool.",
+		Views:  views,
+	})
+	db.SaveEntry(&Entry{
+		Hostname: "host.ist.nicht.cool.",
+		Ip4s:     []net.IP{net.ParseIP("192.168.0.1")},
+		ViewIps: map[string][]net.IP{
+			"lan":   []net.IP{net.ParseIP("10.0.0.1")},
+			"keyed": []net.IP{net.ParseIP("10.0.0.2")},
+		},
+	})
+	db.SaveEntry(&Entry{
+		Hostname: "plain.ist.nicht.cool.",
+		Ip4s:     []net.IP{net.ParseIP("192.168.0.2")},
+	})
+
+	// Queries from localhost are in the lan view
+	for name, ip := range map[string]string{
+		"host.ist.nicht.cool.":  "10.0.0.1",
+		"plain.ist.nicht.cool.": "192.168.0.2",
+	} {
+		in, err := dnsQuery(port, name, dns.TypeA)
+		if err != nil || len(in.Answer) != 1 || !in.Answer[0].(*dns.A).A.Equal(net.ParseIP(ip)) {
+			t.Errorf("Unexpected answer for %s: %v %v", name, in, err)
+		}
+	}
+
+	// Verified keys take precedence over the network
+	port = startDnsServerConfig(db, &DnsServerConfig{
+		Domain:  "ist.nicht.cool.",
+		TsigKey: key,
+		Views:   views,
+	})
+	c := &dns.Client{TsigSecret: map[string]string{"ist.nicht.cool.": key}}
+	var in *dns.Msg
+	for i := 0; i < 10; i++ {
+		// Signing takes the TSIG record out of the message
+		m := new(dns.Msg)
+		m.SetQuestion("host.ist.nicht.cool.", dns.TypeA)
+		m.SetTsig("ist.nicht.cool.", dns.HmacSHA256, 300, time.Now().Unix())
+		in, _, err = c.Exchange(m, "127.0.0.1:"+port)
+		if err == nil {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if err != nil || len(in.Answer) != 1 || !in.Answer[0].(*dns.A).A.Equal(net.ParseIP("10.0.0.2")) {
+		t.Error("Unexpected answer for the keyed view:", in, err)
+	}
+}
@@ -17,8 +17,10 @@
 package cooldns
 
 import (
+	"code.google.com/p/go.net/idna"
 	"github.com/codegangsta/martini-contrib/render"
 	"github.com/martini-contrib/binding"
+	"github.com/miekg/dns"
 	"log"
 	"net"
 	"net/http"
@@ -30,6 +32,10 @@ type Web struct {
 	Domain    string
 	RcPubKey  string
 	RcPrivKey string
+	// Zones hosts can be registered in, the zone of Domain first
+	zones []*ZoneConfig
+	// Views hosts can set addresses for
+	views viewNames
 }
 
 func NewWeb(c *WebConfig) *Web {
@@ -37,11 +43,54 @@ func NewWeb(c *WebConfig) *Web {
 		Domain:    c.Domain,
 		RcPubKey:  c.RcPubKey,
 		RcPrivKey: c.RcPrivKey,
+		zones:     zoneConfigs(c.Domain, c.Zones),
+		views:     c.Views,
 	}
 }
 
+// The zone selected in a form, the zone of Domain if none is selected. nil
+// if the zone is unknown.
+func (w *Web) selectedZone(zone string) *ZoneConfig {
+	zone = strings.ToLower(strings.Trim(zone, "."))
+	if zone == "" {
+		return w.zones[0]
+	}
+	for _, z := range w.zones {
+		if z.Domain == dns.Fqdn(zone) {
+			return z
+		}
+	}
+	return nil
+}
+
+// Name of the zone selected in a form for the views
+func (w *Web) formZone(zone string) string {
+	if z := w.selectedZone(zone); z != nil {
+		return z.Domain
+	}
+	return w.zones[0].Domain
+}
+
+// Zones to choose from in the forms, none if there is only one
+func (w *Web) zoneChoices() []string {
+	if len(w.zones) < 2 {
+		return nil
+	}
+	var choices []string
+	for _, z := range w.zones {
+		choices = append(choices, "."+z.Domain)
+	}
+	return choices
+}
+
+// Whether registrations in the zone have to solve a reCAPTCHA
+func (w *Web) captcha(zone *ZoneConfig) bool {
+	return w.RcPubKey != "" && !zone.NoCaptcha
+}
+
 type WebNewDomain struct {
 	Hostname string `json:"hostname" form:"domain"`
+	Zone     string `json:"zone" form:"zone"` // empty for the zone of Domain
 	Secret   string `json:"secret" form:"secret"`
 	RcChal   string `json:"rcchal" form:"recaptcha_challenge_field"`
 	RcResp   string `json:"rcresp" form:"recaptcha_response_field"`
@@ -49,11 +98,26 @@ type WebNewDomain struct {
 
 type WebUpdateDomain struct {
 	Hostname string `form:"domain"`
+	Zone     string `form:"zone"` // empty for the zone of Domain
 	Secret   string `form:"secret"`
 	CName    string `form:"cname"`
-	Ips      string `form:"ip"`
+	Ips      string `form:"ip"` // "<ip> [<weight>]" lines
+	Policy   string `form:"policy"`
 	Mxs      string `form:"mx"`
 	TXTs     string `form:"txt"`
+	Ttl      string `form:"ttl"`
+	Wildcard string `form:"wildcard"` // set if the checkbox is checked
+	Reverse  string `form:"reverse"`  // set if the checkbox is checked
+	Offline  string `form:"offline"`  // offline mode, empty if online
+	Srvs     string `form:"srv"`
+	Caas     string `form:"caa"`
+	Ptrs     string `form:"ptr"`
+	Sshfps   string `form:"sshfp"`
+	Tlsas    string `form:"tlsa"`
+	Https    string `form:"https"`
+	Svcbs    string `form:"svcb"`
+	Nss      string `form:"ns"`
+	ViewIps  string `form:"viewip"` // "<view> <ip>" lines
 }
 
 // Web Error Handler function signature. Helps you interface with errors
@@ -63,35 +127,45 @@ type WebErrorHandler func(int, []string, interface{})
 type WebSuccessHandler func([]string, interface{})
 
 func (w *Web) Index(db CoolDB, r render.Render) {
-	r.HTML(200, "index", map[string]string{
+	r.HTML(200, "index", map[string]interface{}{
 		"Rcpublic": w.RcPubKey,
-		"Domain":   "." + w.Domain})
+		"Domain":   "." + w.zones[0].Domain,
+		"Zones":    w.zoneChoices()})
 }
 
 func (w *Web) Update(db CoolDB, r render.Render) {
-	r.HTML(200, "update", map[string]string{
+	r.HTML(200, "update", map[string]interface{}{
 		"Rcpublic": w.RcPubKey,
-		"Domain":   "." + w.Domain})
+		"Domain":   "." + w.zones[0].Domain,
+		"Zones":    w.zoneChoices(),
+		"Views":    []string(w.views)})
 }
 
 func (w *Web) checkNewDomain(n *WebNewDomain) (ok bool, errors []string) {
 	ok = false
+	zone := w.selectedZone(n.Zone)
+	if zone == nil {
+		return false, []string{"Unknown zone"}
+	}
+	n.Zone = zone.Domain
 	// Check if new domain is valid
 	hok := false
-	n.Hostname, hok = ValidateDomain(n.Hostname, w.Domain)
+	n.Hostname, hok = ValidateDomain(n.Hostname, zone.Domain)
 	if !hok {
 		errors = append(errors, "Hostname not Valid")
+	} else if zone.reserved(n.Hostname) {
+		errors = append(errors, "Sorry, Domain is reserved")
 	}
 	// Check if secret exists
 	if n.Secret == "" {
 		errors = append(errors, "Secret Missing")
 	}
 	// Check if reCAPTCHA Challenge exists
-	if w.RcPubKey != "" && n.RcChal == "" {
+	if w.captcha(zone) && n.RcChal == "" {
 		errors = append(errors, "reCAPTCHA challenge missing")
 	}
 	// Check if reCAPTCHA response exists
-	if w.RcPubKey != "" && n.RcResp == "" {
+	if w.captcha(zone) && n.RcResp == "" {
 		errors = append(errors, "reCAPTCHA response missing")
 	}
 
@@ -104,9 +178,14 @@ func (w *Web) checkNewDomain(n *WebNewDomain) (ok bool, errors []string) {
 
 func (w *Web) checkUpdateDomain(n *WebUpdateDomain) (ok bool, errors []string) {
 	ok = false
+	zone := w.selectedZone(n.Zone)
+	if zone == nil {
+		return false, []string{"Unknown zone"}
+	}
+	n.Zone = zone.Domain
 	// Check if new domain is valid
 	hok := false
-	n.Hostname, hok = ValidateDomain(n.Hostname, w.Domain)
+	n.Hostname, hok = ValidateDomain(n.Hostname, zone.Domain)
 	if !hok {
 		errors = append(errors, "Hostname not Valid")
 	}
@@ -123,6 +202,7 @@ func (w *Web) checkUpdateDomain(n *WebUpdateDomain) (ok bool, errors []string) {
 
 type newView struct {
 	Domain   string        // Domain base name
+	Zones    []string      // Zones to choose from
 	Rcpublic string        // reCaptcha Public Key
 	Err      []string      // Occured Errors
 	F        *WebNewDomain // Prefilled items
@@ -136,9 +216,11 @@ func (w *Web) FormApiDomainNew(db CoolDB,
 
 	errHandler := func(errCode int, errors []string, content interface{}) {
 		vContent := content.(*WebNewDomain)
-		vContent.Hostname = strings.TrimSuffix(vContent.Hostname, "."+w.Domain)
+		domain := w.formZone(vContent.Zone)
+		vContent.Hostname = strings.TrimSuffix(vContent.Hostname, "."+domain)
 		view := &newView{
-			Domain:   "." + w.Domain,
+			Domain:   "." + domain,
+			Zones:    w.zoneChoices(),
 			Rcpublic: w.RcPubKey,
 			Err:      errors,
 			F:        vContent,
@@ -148,9 +230,12 @@ func (w *Web) FormApiDomainNew(db CoolDB,
 
 	success := func(success []string, content interface{}) {
 		vContent := content.(*WebUpdateDomain)
-		vContent.Hostname = strings.TrimSuffix(vContent.Hostname, "."+w.Domain)
+		domain := w.formZone(vContent.Zone)
+		vContent.Hostname = strings.TrimSuffix(vContent.Hostname, "."+domain)
 		view := &updateView{
-			Domain:  "." + w.Domain,
+			Domain:  "." + domain,
+			Zones:   w.zoneChoices(),
+			Views:   w.views,
 			Success: success,
 			F:       vContent,
 		}
@@ -162,6 +247,8 @@ func (w *Web) FormApiDomainNew(db CoolDB,
 
 type updateView struct {
 	Domain  string           // Domain base name
+	Zones   []string         // Zones to choose from
+	Views   []string         // Views addresses can be set for
 	Err     []string         // Occured Errors
 	F       *WebUpdateDomain // Prefilled items
 	Success []string         // Success string
@@ -175,9 +262,12 @@ func (w *Web) FormApiDomainUpdate(db CoolDB,
 
 	errHandler := func(errCode int, errors []string, content interface{}) {
 		vContent := content.(*WebUpdateDomain)
-		vContent.Hostname = strings.TrimSuffix(vContent.Hostname, "."+w.Domain)
+		domain := w.formZone(vContent.Zone)
+		vContent.Hostname = strings.TrimSuffix(vContent.Hostname, "."+domain)
 		view := &updateView{
-			Domain: "." + w.Domain,
+			Domain: "." + domain,
+			Zones:  w.zoneChoices(),
+			Views:  w.views,
 			Err:    errors,
 			F:      vContent,
 		}
@@ -185,9 +275,12 @@ func (w *Web) FormApiDomainUpdate(db CoolDB,
 	}
 	success := func(success []string, content interface{}) {
 		vContent := content.(*WebUpdateDomain)
-		vContent.Hostname = strings.TrimSuffix(vContent.Hostname, "."+w.Domain)
+		domain := w.formZone(vContent.Zone)
+		vContent.Hostname = strings.TrimSuffix(vContent.Hostname, "."+domain)
 		view := &updateView{
-			Domain:  "." + w.Domain,
+			Domain:  "." + domain,
+			Zones:   w.zoneChoices(),
+			Views:   w.views,
 			Success: success,
 			F:       vContent,
 		}
@@ -263,12 +356,26 @@ func (w *Web) UpdateDomain(db CoolDB,
 	if exists {
 		// TODO: Well this is pretty lame, we have to find a way
 		// to match A and AAAA Entries
-		for _, ipString := range Ips {
+		for _, line := range Ips {
+			fields := strings.Fields(line)
+			ipString := fields[0]
 			ip := net.ParseIP(ipString)
-			if ip == nil {
+			if ip == nil || len(fields) > 2 {
 				errHandler(200, []string{"Malformatted Ip Address"}, &n)
 				return
 			}
+			// An optional weight for the weighted answer policy
+			if len(fields) == 2 {
+				w, err := strconv.ParseUint(fields[1], 10, 32)
+				if err != nil {
+					errHandler(200, []string{"Malformatted weight"}, &n)
+					return
+				}
+				if entry.Weights == nil {
+					entry.Weights = make(map[string]uint32)
+				}
+				entry.Weights[ip.String()] = uint32(w)
+			}
 			if strings.Contains(ipString, ":") {
 				entry.Ip6s = append(entry.Ip6s, ip)
 			} else {
@@ -299,14 +406,75 @@ func (w *Web) UpdateDomain(db CoolDB,
 		entry.Txts = txts
 
 	}
+	entry.Wildcard = n.Wildcard != ""
+	entry.Reverse = n.Reverse != ""
+	entry.Offline = n.Offline != ""
+	entry.OfflineMode = n.Offline
+	entry.AnswerPolicy = n.Policy
+	// Other records are kept in presentation format and checked by Validate
+	_, entry.Srvs = extractRecords(n.Srvs)
+	_, entry.Caas = extractRecords(n.Caas)
+	_, entry.Ptrs = extractRecords(n.Ptrs)
+	_, entry.Sshfps = extractRecords(n.Sshfps)
+	_, entry.Tlsas = extractRecords(n.Tlsas)
+	_, entry.Https = extractRecords(n.Https)
+	_, entry.Svcbs = extractRecords(n.Svcbs)
+	_, nss := extractRecords(n.Nss)
+	for _, ns := range nss {
+		entry.Nss = append(entry.Nss, fqdn(ns))
+	}
+	// Look for the addresses of views
+	_, viewIps := extractRecords(n.ViewIps)
+	for _, viewIp := range viewIps {
+		fields := strings.Fields(viewIp)
+		if len(fields) != 2 || !w.views.has(fields[0]) {
+			errHandler(200, []string{"Unknown view"}, &n)
+			return
+		}
+		ip := net.ParseIP(fields[1])
+		if ip == nil {
+			errHandler(200, []string{"Malformatted Ip Address"}, &n)
+			return
+		}
+		if entry.ViewIps == nil {
+			entry.ViewIps = make(map[string][]net.IP)
+		}
+		entry.ViewIps[fields[0]] = append(entry.ViewIps[fields[0]], ip)
+	}
+	// Look for TTL, empty means default
+	if strings.TrimSpace(n.Ttl) != "" {
+		entry.Ttl, err = parseTtl(n.Ttl)
+		if err != nil {
+			errHandler(200, []string{"Malformatted TTL"}, &n)
+			return
+		}
+	}
+	if verrors := entry.Validate(n.Zone); len(verrors) != 0 {
+		errHandler(200, verrors, &n)
+		return
+	}
 	err = db.SaveEntry(entry)
 	if err != nil {
 		log.Println("New Domain: Entry could not be saved", err)
 		errHandler(500, []string{"Internal Server Error"}, &n)
 		return
 	}
+	// Hosts registered before DNS UPDATE was supported have no TSIG key
+	if a.TsigKey == "" {
+		keyed := *a
+		keyed.TsigKey, err = NewTsigKey()
+		if err == nil {
+			err = db.SaveAuth(&keyed)
+		}
+		a = &keyed
+		if err != nil {
+			log.Println("Update Domain: TSIG key could not be created", err)
+			errHandler(500, []string{"Internal Server Error"}, &n)
+			return
+		}
+	}
 	n.Secret = ""
-	successHandler([]string{"Domain was Successfully updated"}, &n)
+	successHandler([]string{"Domain was Successfully updated", tsigKeyMessage(a)}, &n)
 
 }
 
@@ -324,7 +492,7 @@ func (w *Web) newDomain(db CoolDB,
 		return
 	}
 	remoteip := strings.Split(req.RemoteAddr, ":")[0]
-	if w.RcPubKey != "" {
+	if w.captcha(w.selectedZone(n.Zone)) {
 		ok, err := ReCaptcha(remoteip, n.RcChal, n.RcResp, w.RcPrivKey)
 		if err != nil {
 			log.Println("NewDomain: Failed to verify reCAPTCHA:", err)
@@ -372,8 +540,19 @@ func (w *Web) newDomain(db CoolDB,
 		return
 	}
 	update := &WebUpdateDomain{
-		Hostname: strings.TrimSuffix(n.Hostname, "."+w.Domain),
+		Hostname: strings.TrimSuffix(n.Hostname, "."+n.Zone),
+		Zone:     n.Zone,
 		Secret:   n.Secret,
 	}
-	successHandler([]string{"Creation of new domain " + update.Hostname + " was successful"}, update)
+	successHandler([]string{"Creation of new domain " + update.Hostname + " was successful", tsigKeyMessage(auth)}, update)
+}
+
+// Tells the user how to send DNS updates for the host. The key name of an
+// internationalized host is in puny code like on the wire.
+func tsigKeyMessage(a *Auth) string {
+	name, err := idna.ToASCII(a.Name)
+	if err != nil {
+		name = a.Name
+	}
+	return "TSIG key for DNS updates (hmac-sha256, key name " + name + "): " + a.TsigKey
 }
@@ -57,7 +57,7 @@ func createTestServer(t *testing.T) *webTestServer {
 		Domain:    "ist.nicht.cool.",
 		Resources: "../",
 	}
-	handler := SetupWeb(config, db, NewDummyMetrics())
+	handler := SetupWeb(config, db, NewDummyMetrics(), nil)
 	return &webTestServer{httptest.NewServer(handler), logBuf, db, f}
 }
 
@@ -217,6 +217,76 @@ func TestUpdateDynApi(t *testing.T) {
 	}
 }
 
+// Records set through the form survive updates of the address
+func TestUpdateDynApiKeepsRecords(t *testing.T) {
+	server := createTestServer(t)
+	defer server.S.Close()
+	const domain = "keep.ist.nicht.cool."
+	auth, _ := NewAuth(domain, "123456789")
+	if err := server.Db.SaveAuth(auth); err != nil {
+		t.Fatal("Saving New User failed")
+	}
+	if err := server.Db.SaveEntry(&Entry{Hostname: domain}); err != nil {
+		t.Fatal("Failed to save Entry")
+	}
+
+	v := url.Values{}
+	v.Set("domain", domain)
+	v.Set("secret", "123456789")
+	v.Set("ip", "192.168.0.1")
+	v.Set("srv", "_sip._udp 10 5 5060 keep.ist.nicht.cool.")
+	resp, err := http.PostForm(getFormUpdateURL(server.S.URL).String(), v)
+	if err != nil || resp.StatusCode != 200 {
+		t.Log(server.Log.String())
+		t.Fatal("Failed to set the SRV record:", err)
+	}
+
+	v = url.Values{}
+	v.Set("hostname", domain)
+	v.Set("myip", "192.168.0.2")
+	resp, err = http.Get(getUpdateURL(domain, "123456789", server.S.URL, v).String())
+	if err != nil || resp.StatusCode != 200 {
+		t.Log(server.Log.String())
+		t.Fatal("Failed to update the address:", err)
+	}
+
+	e := server.Db.GetEntry(domain)
+	if e == nil || len(e.Ip4s) != 1 || e.Ip4s[0].String() != "192.168.0.2" {
+		t.Fatal("Address was not updated:", e)
+	}
+	if len(e.Srvs) != 1 || e.Srvs[0] != "_sip._udp 10 5 5060 keep.ist.nicht.cool." {
+		t.Error("SRV record was lost:", e)
+	}
+}
+
+// Updates without a TTL keep the TTL of the entry
+func TestUpdateDynApiKeepsTtl(t *testing.T) {
+	server := createTestServer(t)
+	defer server.S.Close()
+	const domain = "ttl.ist.nicht.cool."
+	auth, _ := NewAuth(domain, "123456789")
+	if err := server.Db.SaveAuth(auth); err != nil {
+		t.Fatal("Saving New User failed")
+	}
+
+	for _, ttl := range []string{"300", ""} {
+		v := url.Values{}
+		v.Set("hostname", domain)
+		v.Set("myip", "192.168.0.1")
+		if ttl != "" {
+			v.Set("ttl", ttl)
+		}
+		resp, err := http.Get(getUpdateURL(domain, "123456789", server.S.URL, v).String())
+		if err != nil || resp.StatusCode != 200 {
+			t.Log(server.Log.String())
+			t.Fatal("Failed to update:", err)
+		}
+		if e := server.Db.GetEntry(domain); e == nil || e.Ttl != 300 {
+			t.Errorf("Update with ttl %q left TTL %v, expected 300", ttl, e)
+		}
+	}
+}
+
 type updateErrorFieldsTest struct {
 	Domain string
 	Ip     string
@@ -513,6 +583,10 @@ type formdomainupdatetest struct {
 	Cname    string
 	Mxs      string
 	Txts     string
+	Ttl      string
+	Wildcard string
+	Srvs     string
+	Caas     string
 	ErrCount int
 	ExSecret string
 	Entry    Entry
@@ -584,6 +658,83 @@ var formdomainupdatetests = []formdomainupdatetest{
 			Cname: "",
 		},
 	},
+	// Example with TTL
+	formdomainupdatetest{
+		Domain:   "ttl.ist.nicht.cool",
+		Secret:   "123456789",
+		Ips:      "192.168.0.1",
+		Ttl:      "3600",
+		ErrCount: 0,
+		ExSecret: "123456789",
+		Entry: Entry{
+			Hostname: "ttl.ist.nicht.cool.",
+			Ip4s: []net.IP{
+				net.ParseIP("192.168.0.1"),
+			},
+			Ttl: 3600,
+		},
+	},
+	// Example with wildcard
+	formdomainupdatetest{
+		Domain:   "wild.ist.nicht.cool",
+		Secret:   "123456789",
+		Ips:      "192.168.0.1",
+		Wildcard: "on",
+		ErrCount: 0,
+		ExSecret: "123456789",
+		Entry: Entry{
+			Hostname: "wild.ist.nicht.cool.",
+			Ip4s: []net.IP{
+				net.ParseIP("192.168.0.1"),
+			},
+			Wildcard: true,
+		},
+	},
+	// Example with SRV and CAA records
+	formdomainupdatetest{
+		Domain:   "srv.ist.nicht.cool",
+		Secret:   "123456789",
+		Ips:      "192.168.0.1",
+		Srvs:     "_sip._udp 10 5 5060 srv.ist.nicht.cool.\n_xmpp-client._tcp 5 0 5222 srv.ist.nicht.cool.",
+		Caas:     `0 issue "letsencrypt.org"`,
+		ErrCount: 0,
+		ExSecret: "123456789",
+		Entry: Entry{
+			Hostname: "srv.ist.nicht.cool.",
+			Ip4s: []net.IP{
+				net.ParseIP("192.168.0.1"),
+			},
+			Srvs: []string{
+				"_sip._udp 10 5 5060 srv.ist.nicht.cool.",
+				"_xmpp-client._tcp 5 0 5222 srv.ist.nicht.cool.",
+			},
+			Caas: []string{`0 issue "letsencrypt.org"`},
+		},
+	},
+	// SRV record without service
+	formdomainupdatetest{
+		Domain:   "sillysrv.ist.nicht.cool",
+		Secret:   "123456789",
+		Ips:      "192.168.0.1",
+		Srvs:     "10 5 5060 srv.ist.nicht.cool.",
+		ErrCount: 1,
+		ExSecret: "123456789",
+		Entry: Entry{
+			Hostname: "sillysrv.ist.nicht.cool.",
+		},
+	},
+	// Errornous TTL
+	formdomainupdatetest{
+		Domain:   "sillyttl.ist.nicht.cool",
+		Secret:   "123456789",
+		Ips:      "192.168.0.1",
+		Ttl:      "one hour",
+		ErrCount: 1,
+		ExSecret: "123456789",
+		Entry: Entry{
+			Hostname: "sillyttl.ist.nicht.cool.",
+		},
+	},
 	// Empty example
 	formdomainupdatetest{
 		Domain:   "",
@@ -732,6 +883,18 @@ func TestFormDomainUpdate(t *testing.T) {
 		if test.Txts != "" {
 			v.Set("txt", test.Txts)
 		}
+		if test.Ttl != "" {
+			v.Set("ttl", test.Ttl)
+		}
+		if test.Wildcard != "" {
+			v.Set("wildcard", test.Wildcard)
+		}
+		if test.Srvs != "" {
+			v.Set("srv", test.Srvs)
+		}
+		if test.Caas != "" {
+			v.Set("caa", test.Caas)
+		}
 		URL := getFormUpdateURL(server.S.URL)
 
 		resp, err := http.PostForm(URL.String(), v)
@@ -776,3 +939,38 @@ func TestFormDomainUpdate(t *testing.T) {
 		}
 	}
 }
+
+func TestWebZones(t *testing.T) {
+	w := NewWeb(&WebConfig{
+		Domain:   "ist.nicht.cool.",
+		RcPubKey: "public",
+		Zones: []*ZoneConfig{
+			&ZoneConfig{Domain: "sehr.cool.", NoCaptcha: true, Reserved: []string{"www"}},
+		},
+	})
+	if choices := w.zoneChoices(); len(choices) != 2 || choices[1] != ".sehr.cool." {
+		t.Error("Unexpected zone choices:", choices)
+	}
+
+	n := &WebNewDomain{Hostname: "host", Zone: ".sehr.cool.", Secret: "geheim"}
+	if ok, errors := w.checkNewDomain(n); !ok || n.Hostname != "host.sehr.cool." {
+		t.Error("Registration in the zone failed:", n.Hostname, errors)
+	}
+	n = &WebNewDomain{Hostname: "www", Zone: ".sehr.cool.", Secret: "geheim"}
+	if ok, _ := w.checkNewDomain(n); ok {
+		t.Error("Reserved name was accepted")
+	}
+	n = &WebNewDomain{Hostname: "www", Secret: "geheim"}
+	if ok, errors := w.checkNewDomain(n); ok || len(errors) != 2 {
+		t.Error("reCAPTCHA was not required in the default zone:", errors)
+	}
+	n = &WebNewDomain{Hostname: "host", Zone: "nicht.sehr.cool.", Secret: "geheim"}
+	if ok, _ := w.checkNewDomain(n); ok {
+		t.Error("Unknown zone was accepted")
+	}
+
+	u := &WebUpdateDomain{Hostname: "host.sehr.cool", Zone: "sehr.cool", Secret: "geheim"}
+	if ok, errors := w.checkUpdateDomain(u); !ok || u.Hostname != "host.sehr.cool." {
+		t.Error("Update in the zone failed:", u.Hostname, errors)
+	}
+}
@@ -0,0 +1,480 @@
+// The CoolDNS Project. The simple dynamic dns server and update service.
+// Copyright (C) 2014 The CoolDNS Authors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.package main
+
+package cooldns
+
+import (
+	"bufio"
+	"bytes"
+	"code.google.com/p/go.net/idna"
+	"fmt"
+	"github.com/miekg/dns"
+	"io"
+	"io/ioutil"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Export and import of zones as master files (RFC 1035)
+type ZoneFiles interface {
+	// Write the records of all entries of a zone as they are stored, with
+	// the settings that are no DNS data in comments
+	Export(w io.Writer, zone string) error
+	// Read the entries of a zone from a master file. Entries that exist are
+	// replaced, new hosts get credentials. With dryRun nothing is saved.
+	Import(r io.Reader, zone string, dryRun bool) (*ZoneImport, error)
+}
+
+// Result of a zone import
+type ZoneImport struct {
+	Entries []*Entry
+	// Records that are removed ("- ") and added ("+ ") by the import
+	Diff []string
+	// Secrets of the hosts created by the import, empty with dryRun
+	Credentials map[string]string
+	// Hosts that are created by the import
+	NewHosts []string
+	// Records of the file that are not imported
+	Warnings []string
+}
+
+func (i *ZoneImport) String() string {
+	var lines []string
+	for _, warning := range i.Warnings {
+		lines = append(lines, "; warning: "+warning)
+	}
+	lines = append(lines, i.Diff...)
+	for _, host := range i.NewHosts {
+		if secret, ok := i.Credentials[host]; ok {
+			lines = append(lines, fmt.Sprintf("; new host %s secret %s", host, secret))
+		} else {
+			lines = append(lines, "; new host "+host)
+		}
+	}
+	if len(lines) == 0 {
+		return ""
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// Builds a handler for the zone files of a configuration without serving it
+func NewZoneFiles(config *DnsServerConfig, db CoolDB) ZoneFiles {
+	return newDnsHandler(config, db, nil)
+}
+
+// The forward zone named zone, the zone of the domain if zone is empty
+func (h *dnsHandler) fileZone(zone string) (string, error) {
+	if zone == "" {
+		return h.zones[0].domain, nil
+	}
+	zone = dns.Fqdn(strings.ToLower(zone))
+	if h.forwardZone(zone) == nil || h.forwardZone(zone).domain != zone {
+		return "", fmt.Errorf("%s is not served", zone)
+	}
+	return zone, nil
+}
+
+func (h *dnsHandler) Export(w io.Writer, zone string) error {
+	zone, err := h.fileZone(zone)
+	if err != nil {
+		return err
+	}
+	b := bufio.NewWriter(w)
+	fmt.Fprintf(b, "; %s exported %s\n", zone, time.Now().UTC().Format(time.RFC3339))
+	fmt.Fprintf(b, "$ORIGIN %s\n", zone)
+	fmt.Fprintln(b, h.soa(zone).String())
+	for _, rr := range h.ns(zone) {
+		fmt.Fprintln(b, rr.String())
+	}
+	// Offline entries are exported with their own records, what they
+	// answer instead follows from their settings
+	entries := h.db.Entries()
+	sort.Sort(byHostname(entries))
+	for _, e := range entries {
+		rrs := h.storedRecords(zone, e)
+		if len(rrs) == 0 {
+			continue
+		}
+		if settings := entrySettings(e); settings != "" {
+			fmt.Fprintf(b, "%s %s %s\n", settingsComment, ownerName(e), settings)
+		}
+		for _, rr := range rrs {
+			fmt.Fprintln(b, rr.String())
+		}
+	}
+	return b.Flush()
+}
+
+type byHostname []*Entry
+
+func (s byHostname) Len() int           { return len(s) }
+func (s byHostname) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byHostname) Less(i, j int) bool { return s[i].Hostname < s[j].Hostname }
+
+// Comments in master files with the settings of an entry that are no DNS
+// data: "; $cooldns <host> offline=yes offlinemode=parking reverse=yes
+// policy=weighted weight=<ip>/<weight> view=<view>/<ip>". Keys that take
+// several values are repeated.
+const settingsComment = "; $cooldns"
+
+// Settings of an entry as written after the host in settingsComment, empty
+// if it has none
+func entrySettings(e *Entry) string {
+	var settings []string
+	if e.Offline {
+		settings = append(settings, "offline=yes")
+	}
+	if e.OfflineMode != "" {
+		settings = append(settings, "offlinemode="+e.OfflineMode)
+	}
+	if e.Reverse {
+		settings = append(settings, "reverse=yes")
+	}
+	if e.AnswerPolicy != "" {
+		settings = append(settings, "policy="+e.AnswerPolicy)
+	}
+	var weights []string
+	for ip, weight := range e.Weights {
+		weights = append(weights, fmt.Sprintf("weight=%s/%d", ip, weight))
+	}
+	sort.Strings(weights)
+	var views []string
+	for view, ips := range e.ViewIps {
+		for _, ip := range ips {
+			views = append(views, fmt.Sprintf("view=%s/%s", view, ip))
+		}
+	}
+	sort.Strings(views)
+	settings = append(settings, weights...)
+	settings = append(settings, views...)
+	return strings.Join(settings, " ")
+}
+
+// Set the settings of a settingsComment on an entry, replacing all of them
+func setEntrySettings(e *Entry, settings []string) error {
+	e.Offline, e.OfflineMode, e.Reverse, e.AnswerPolicy = false, "", false, ""
+	e.Weights, e.ViewIps = nil, nil
+	for _, setting := range settings {
+		kv := strings.SplitN(setting, "=", 2)
+		if len(kv) != 2 {
+			return fmt.Errorf("Malformatted setting %q", setting)
+		}
+		key, value := kv[0], kv[1]
+		// Values of weight and view are <name>/<value>
+		var name string
+		if key == "weight" || key == "view" {
+			i := strings.LastIndex(value, "/")
+			if i < 0 {
+				return fmt.Errorf("Malformatted setting %q", setting)
+			}
+			name, value = value[:i], value[i+1:]
+		}
+		switch key {
+		case "offline":
+			e.Offline = value == "yes"
+		case "offlinemode":
+			e.OfflineMode = value
+		case "reverse":
+			e.Reverse = value == "yes"
+		case "policy":
+			e.AnswerPolicy = value
+		case "weight":
+			weight, err := strconv.ParseUint(value, 10, 32)
+			if err != nil {
+				return fmt.Errorf("Malformatted weight %q", setting)
+			}
+			if e.Weights == nil {
+				e.Weights = make(map[string]uint32)
+			}
+			e.Weights[name] = uint32(weight)
+		case "view":
+			ip := net.ParseIP(value)
+			if ip == nil {
+				return fmt.Errorf("Malformatted address %q", setting)
+			}
+			if e.ViewIps == nil {
+				e.ViewIps = make(map[string][]net.IP)
+			}
+			e.ViewIps[name] = append(e.ViewIps[name], ip)
+		default:
+			return fmt.Errorf("Unknown setting %q", setting)
+		}
+	}
+	return nil
+}
+
+// Settings comments of a master file by host
+func readSettings(data []byte) map[string][]string {
+	settings := make(map[string][]string)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if !strings.HasPrefix(line, settingsComment+" ") {
+			continue
+		}
+		fields := strings.Fields(strings.TrimPrefix(line, settingsComment))
+		if len(fields) != 0 {
+			host := strings.ToLower(dns.Fqdn(fields[0]))
+			settings[host] = append(settings[host], fields[1:]...)
+		}
+	}
+	return settings
+}
+
+// Types of the apex and of DNSSEC that are generated by the server
+var generatedTypes = map[uint16]bool{
+	dns.TypeSOA:        true,
+	dns.TypeDNSKEY:     true,
+	dns.TypeRRSIG:      true,
+	dns.TypeNSEC:       true,
+	dns.TypeNSEC3:      true,
+	dns.TypeNSEC3PARAM: true,
+	dns.TypeCDS:        true,
+	dns.TypeCDNSKEY:    true,
+}
+
+// Host of an owner name in a zone: wildcards belong to the name they are
+// below, owners made of underscore labels to the name they are prefixed to.
+func importHost(name, zone string) (host, owner string, wildcard bool) {
+	labels := dns.SplitDomainName(name)
+	zoneLabels := dns.CountLabel(zone)
+	if len(labels) > zoneLabels && labels[0] == "*" {
+		return strings.Join(labels[1:], ".") + ".", "", true
+	}
+	i := 0
+	for i < len(labels)-zoneLabels && strings.HasPrefix(labels[i], "_") {
+		i++
+	}
+	if i == len(labels)-zoneLabels {
+		// Underscore labels directly below the apex are hosts
+		i = 0
+	}
+	return strings.Join(labels[i:], ".") + ".", strings.Join(labels[:i], "."), false
+}
+
+func (h *dnsHandler) Import(r io.Reader, zone string, dryRun bool) (*ZoneImport, error) {
+	zone, err := h.fileZone(zone)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	settings := readSettings(data)
+	var rrs []dns.RR
+	zp := dns.NewZoneParser(bytes.NewReader(data), zone, "")
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		rrs = append(rrs, rr)
+	}
+	if err := zp.Err(); err != nil {
+		return nil, err
+	}
+
+	entries, warnings, err := h.zoneEntries(zone, rrs)
+	if err != nil {
+		return nil, err
+	}
+	result := &ZoneImport{Credentials: make(map[string]string), Warnings: warnings}
+	for _, e := range entries {
+		old := h.db.GetEntry(e.Hostname)
+		if old != nil {
+			// Settings that are no DNS data stay as they are
+			merged := old.Copy()
+			merged.Ip4s, merged.Ip6s, merged.Txts, merged.Mxs = e.Ip4s, e.Ip6s, e.Txts, e.Mxs
+			merged.Cname, merged.Ttl, merged.Wildcard, merged.Nss = e.Cname, e.Ttl, e.Wildcard, e.Nss
+			for _, rrtype := range rdataTypes {
+				*merged.rdata(rrtype) = *e.rdata(rrtype)
+			}
+			e = merged
+		}
+		// Without a settings comment the settings of the entry stay
+		if s, ok := settings[strings.ToLower(ownerName(e))]; ok {
+			if err := setEntrySettings(e, s); err != nil {
+				result.Warnings = append(result.Warnings,
+					fmt.Sprintf("skipped %s: %s", e.Hostname, err))
+				continue
+			}
+		}
+		if errors := e.Validate(zone); len(errors) != 0 {
+			result.Warnings = append(result.Warnings,
+				fmt.Sprintf("skipped %s: %s", e.Hostname, strings.Join(errors, ", ")))
+			continue
+		}
+		if old == nil {
+			result.NewHosts = append(result.NewHosts, e.Hostname)
+		}
+		var oldRRs []dns.RR
+		if old != nil {
+			oldRRs = h.zoneEntryRecords(zone, old)
+		}
+		newRRs := h.zoneEntryRecords(zone, e)
+		for _, rr := range rrDifference(oldRRs, newRRs) {
+			result.Diff = append(result.Diff, "- "+rr.String())
+		}
+		for _, rr := range rrDifference(newRRs, oldRRs) {
+			result.Diff = append(result.Diff, "+ "+rr.String())
+		}
+		result.Entries = append(result.Entries, e)
+	}
+	if dryRun {
+		return result, nil
+	}
+
+	for _, e := range result.Entries {
+		if h.db.GetAuth(e.Hostname) == nil {
+			secret, err := NewTsigKey()
+			if err != nil {
+				return nil, err
+			}
+			a, err := NewAuth(e.Hostname, secret)
+			if err != nil {
+				return nil, err
+			}
+			a.TsigKey, err = NewTsigKey()
+			if err == nil {
+				err = h.db.SaveAuth(a)
+			}
+			if err != nil {
+				return nil, err
+			}
+			result.Credentials[e.Hostname] = secret
+		}
+		if err := h.db.SaveEntry(e); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// Entries of the records of a zone ordered by hostname, records that can not
+// be stored in entries are returned as warnings
+func (h *dnsHandler) zoneEntries(zone string, rrs []dns.RR) (entries []*Entry, warnings []string, err error) {
+	// Names below delegations only carry glue, which are the addresses of
+	// the delegated host
+	delegations := make(map[string]bool)
+	for _, rr := range rrs {
+		name := strings.ToLower(rr.Header().Name)
+		if rr.Header().Rrtype == dns.TypeNS && name != zone {
+			delegations[name] = true
+		}
+	}
+	delegation := func(name string) string {
+		for cut := range delegations {
+			if name != cut && dns.IsSubDomain(cut, name) {
+				return cut
+			}
+		}
+		return ""
+	}
+
+	byHost := make(map[string]*Entry)
+	// Records of the hosts by type and rdata, wildcards repeat the
+	// records of their host
+	seen := make(map[string]bool)
+	var hosts []string
+	for _, rr := range rrs {
+		hdr := rr.Header()
+		name := strings.ToLower(hdr.Name)
+		if !dns.IsSubDomain(zone, name) {
+			return nil, nil, fmt.Errorf("%s is outside of %s", hdr.Name, zone)
+		}
+		if generatedTypes[hdr.Rrtype] {
+			continue
+		}
+		if name == zone {
+			if hdr.Rrtype != dns.TypeNS {
+				warnings = append(warnings, "skipped record at the apex: "+rr.String())
+			}
+			continue
+		}
+		host, owner, wildcard := importHost(name, zone)
+		if cut := delegation(name); cut != "" {
+			if hdr.Rrtype != dns.TypeA && hdr.Rrtype != dns.TypeAAAA {
+				continue
+			}
+			host, owner, wildcard = cut, "", false
+		}
+		e := byHost[host]
+		if e == nil {
+			e = &Entry{Hostname: host}
+			if uHost, err := idna.ToUnicode(host); err == nil {
+				e.Hostname = uHost
+			}
+			byHost[host] = e
+			hosts = append(hosts, host)
+		}
+		e.Wildcard = e.Wildcard || wildcard
+		if e.Ttl == 0 && hdr.Ttl != h.ttl(e) {
+			e.Ttl = hdr.Ttl
+		}
+		key := fmt.Sprintf("%s %s %d %s", host, owner, hdr.Rrtype, strings.ToLower(rdataString(rr)))
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		if !importRecord(e, owner, rr) {
+			warnings = append(warnings, "skipped unsupported record: "+rr.String())
+		}
+	}
+	sort.Strings(hosts)
+	for _, host := range hosts {
+		entries = append(entries, byHost[host])
+	}
+	return entries, warnings, nil
+}
+
+// Add a record of a master file to an entry, false if the type is not
+// supported
+func importRecord(e *Entry, owner string, rr dns.RR) bool {
+	if owner != "" {
+		if e.rdata(rr.Header().Rrtype) == nil {
+			return false
+		}
+		field := e.rdata(rr.Header().Rrtype)
+		*field = append(*field, owner+" "+rdataString(rr))
+		return true
+	}
+	switch rr := rr.(type) {
+	case *dns.A:
+		e.Ip4s = append(e.Ip4s, rr.A)
+	case *dns.AAAA:
+		e.Ip6s = append(e.Ip6s, rr.AAAA)
+	case *dns.CNAME:
+		e.Cname = rr.Target
+	case *dns.TXT:
+		e.Txts = append(e.Txts, rr.Txt...)
+	case *dns.MX:
+		e.Mxs = append(e.Mxs, MxEntry{ip: rr.Mx, priority: int(rr.Preference)})
+	case *dns.NS:
+		e.Nss = append(e.Nss, rr.Ns)
+	default:
+		field := e.rdata(rr.Header().Rrtype)
+		if field == nil {
+			return false
+		}
+		*field = append(*field, rdataString(rr))
+	}
+	return true
+}
+
+// The rdata of a record in presentation format
+func rdataString(rr dns.RR) string {
+	return strings.TrimPrefix(rr.String(), rr.Header().String())
+}
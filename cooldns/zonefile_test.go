@@ -0,0 +1,177 @@
+// The CoolDNS Project. The simple dynamic dns server and update service.
+// Copyright (C) 2014 The CoolDNS Authors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.package main
+
+package cooldns
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestZoneExportImport(t *testing.T) {
+	db, err := getTmpDB()
+	if err != nil {
+		t.Fatal("Failed to create temporary DB")
+	}
+	config := &DnsServerConfig{Domain: "ist.nicht.cool."}
+	db.SaveEntry(&Entry{
+		Hostname: "host.ist.nicht.cool.",
+		Ip4s:     []net.IP{net.ParseIP("192.168.0.1")},
+		Mxs:      []MxEntry{MxEntry{"mail.ist.nicht.cool.", 10}},
+		Txts:     []string{"Hallo Welt"},
+		Srvs:     []string{"_sip._udp 10 5 5060 sip.ist.nicht.cool."},
+		Ttl:      300,
+		Wildcard: true,
+		Reverse:  true,
+	})
+	db.SaveEntry(&Entry{
+		Hostname: "del.ist.nicht.cool.",
+		Ip4s:     []net.IP{net.ParseIP("192.168.0.2")},
+		Nss:      []string{"ns1.del.ist.nicht.cool."},
+	})
+	// Offline entries are exported with their stored data and settings
+	db.SaveEntry(&Entry{
+		Hostname:     "off.ist.nicht.cool.",
+		Ip4s:         []net.IP{net.ParseIP("192.168.0.3"), net.ParseIP("192.168.0.4")},
+		Offline:      true,
+		AnswerPolicy: AnswerWeighted,
+		Weights:      map[string]uint32{"192.168.0.3": 3},
+		ViewIps:      map[string][]net.IP{"intern": []net.IP{net.ParseIP("10.0.0.3")}},
+	})
+	var zone bytes.Buffer
+	if err := NewZoneFiles(config, db).Export(&zone, ""); err != nil {
+		t.Fatal("Export failed:", err)
+	}
+	for _, record := range []string{
+		"ist.nicht.cool.\t3600\tIN\tSOA\t",
+		"*.host.ist.nicht.cool.\t300\tIN\tA\t192.168.0.1",
+		"_sip._udp.host.ist.nicht.cool.\t300\tIN\tSRV\t10 5 5060 sip.ist.nicht.cool.",
+		"del.ist.nicht.cool.\t60\tIN\tNS\tns1.del.ist.nicht.cool.",
+		"off.ist.nicht.cool.\t60\tIN\tA\t192.168.0.4",
+		"; $cooldns host.ist.nicht.cool. reverse=yes\n",
+		"; $cooldns off.ist.nicht.cool. offline=yes policy=weighted weight=192.168.0.3/3 view=intern/10.0.0.3\n",
+	} {
+		if !strings.Contains(zone.String(), record) {
+			t.Errorf("Export is missing %q:\n%s", record, zone.String())
+		}
+	}
+
+	// Importing the export changes nothing
+	files := NewZoneFiles(config, db)
+	result, err := files.Import(strings.NewReader(zone.String()), "", true)
+	if err != nil || len(result.Diff) != 0 || len(result.NewHosts) != 0 || len(result.Warnings) != 0 {
+		t.Errorf("Unexpected import of the export: %v %v", result, err)
+	}
+
+	// Into an empty database it restores the entries
+	empty, err := getTmpDB()
+	if err != nil {
+		t.Fatal("Failed to create temporary DB")
+	}
+	result, err = NewZoneFiles(config, empty).Import(strings.NewReader(zone.String()), "", false)
+	if err != nil || len(result.NewHosts) != 3 || len(result.Credentials) != 3 {
+		t.Fatal("Unexpected import:", result, err)
+	}
+	e := empty.GetEntry("host.ist.nicht.cool.")
+	if e == nil || !e.Wildcard || e.Ttl != 300 || len(e.Ip4s) != 1 || len(e.Srvs) != 1 ||
+		len(e.Mxs) != 1 || e.Txts[0] != "Hallo Welt" || !e.Reverse {
+		t.Error("Unexpected imported entry:", e)
+	}
+	off, restored := db.GetEntry("off.ist.nicht.cool."), empty.GetEntry("off.ist.nicht.cool.")
+	if restored == nil || restored.String() != off.String() {
+		t.Errorf("Offline entry was not restored:\nIs:\t%v\nEx:\t%v", restored, off)
+	}
+	if e := empty.GetEntry("del.ist.nicht.cool."); e == nil || len(e.Nss) != 1 {
+		t.Error("Delegation was not imported:", e)
+	}
+	a := empty.GetAuth("host.ist.nicht.cool.")
+	if a == nil || a.TsigKey == "" {
+		t.Fatal("No credentials for the imported host")
+	}
+	if ok, _ := a.CheckAuth("host.ist.nicht.cool.", result.Credentials["host.ist.nicht.cool."]); !ok {
+		t.Error("Reported secret does not match")
+	}
+}
+
+func TestZoneImportDiff(t *testing.T) {
+	db, err := getTmpDB()
+	if err != nil {
+		t.Fatal("Failed to create temporary DB")
+	}
+	db.SaveEntry(&Entry{
+		Hostname:    "host.ist.nicht.cool.",
+		Ip4s:        []net.IP{net.ParseIP("192.168.0.1")},
+		Offline:     true,
+		OfflineMode: OfflineLast,
+	})
+	files := NewZoneFiles(&DnsServerConfig{Domain: "ist.nicht.cool."}, db)
+	zone := `$ORIGIN ist.nicht.cool.
+$TTL 60
+@        IN NS   ns.ist.nicht.cool.
+@        IN MX   10 mail
+host     IN A    192.168.0.9
+neu      IN AAAA fe80::1
+neu      IN LOC  52 22 23.000 N 4 53 32.000 E -2.00m 0.00m 10000m 10m
+sub      IN NS   ns.sub
+ns.sub   IN A    192.168.0.3
+`
+	result, err := files.Import(strings.NewReader(zone), "ist.nicht.cool", true)
+	if err != nil {
+		t.Fatal("Import failed:", err)
+	}
+	for _, line := range []string{
+		"- host.ist.nicht.cool.\t60\tIN\tA\t192.168.0.1",
+		"+ host.ist.nicht.cool.\t60\tIN\tA\t192.168.0.9",
+		"+ neu.ist.nicht.cool.\t60\tIN\tAAAA\tfe80::1",
+		"+ ns.sub.ist.nicht.cool.\t60\tIN\tA\t192.168.0.3",
+	} {
+		found := false
+		for _, diff := range result.Diff {
+			found = found || diff == line
+		}
+		if !found {
+			t.Errorf("Diff %v is missing %q", result.Diff, line)
+		}
+	}
+	// Glue below a delegation are the addresses of the delegated host
+	if e := result.Entries[2]; e.Hostname != "sub.ist.nicht.cool." || len(e.Ip4s) != 1 {
+		t.Error("Unexpected delegation:", e)
+	}
+	if len(result.Warnings) != 2 || len(result.NewHosts) != 2 || len(result.Credentials) != 0 {
+		t.Errorf("Unexpected dry run: %+v", result)
+	}
+	// Nothing is saved in a dry run
+	if e := db.GetEntry("host.ist.nicht.cool."); !e.Ip4s[0].Equal(net.ParseIP("192.168.0.1")) {
+		t.Error("Dry run changed the entry:", e)
+	}
+
+	result, err = files.Import(strings.NewReader(zone), "", false)
+	if err != nil {
+		t.Fatal("Import failed:", err)
+	}
+	e := db.GetEntry("host.ist.nicht.cool.")
+	if !e.Ip4s[0].Equal(net.ParseIP("192.168.0.9")) || !e.Offline || e.OfflineMode != OfflineLast {
+		t.Error("Unexpected entry after import:", e)
+	}
+	if _, err := files.Import(strings.NewReader("host.sehr.cool. IN A 192.168.0.1\n"), "", true); err == nil {
+		t.Error("Records outside of the zone were accepted")
+	}
+	if _, err := files.Import(strings.NewReader(zone), "sehr.cool.", true); err == nil {
+		t.Error("Import into a zone that is not served was accepted")
+	}
+}
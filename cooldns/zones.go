@@ -0,0 +1,153 @@
+// The CoolDNS Project. The simple dynamic dns server and update service.
+// Copyright (C) 2014 The CoolDNS Authors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.package main
+
+package cooldns
+
+import (
+	"encoding/json"
+	"github.com/miekg/dns"
+	"os"
+	"strings"
+)
+
+// Settings of a zone served by the instance. Unset values fall back to the
+// global settings.
+type ZoneConfig struct {
+	Domain string `json:"domain"` // fqdn of the zone
+	// TTL of entries that do not set their own and the bounds for the TTL
+	DefaultTtl uint32 `json:"ttl"`
+	MinTtl     uint32 `json:"ttl_min"`
+	MaxTtl     uint32 `json:"ttl_max"`
+	// Registrations in the zone do not need a reCAPTCHA
+	NoCaptcha bool `json:"no_captcha"`
+	// Names below the zone that can not be registered, e.g. "www"
+	Reserved []string `json:"reserved"`
+}
+
+// Read the zones from a JSON file holding a list of zone settings
+func loadZones(file string) ([]*ZoneConfig, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var zones []*ZoneConfig
+	err = json.NewDecoder(f).Decode(&zones)
+	return zones, err
+}
+
+// All zones of the instance, the zone of domain first. domain is served with
+// the global settings unless it is listed in zones.
+func zoneConfigs(domain string, zones []*ZoneConfig) []*ZoneConfig {
+	domain = strings.ToLower(dns.Fqdn(domain))
+	all := []*ZoneConfig{&ZoneConfig{Domain: domain}}
+	seen := map[string]bool{domain: true}
+	for _, zone := range zones {
+		z := *zone
+		z.Domain = strings.ToLower(dns.Fqdn(z.Domain))
+		if z.Domain == domain {
+			all[0] = &z
+			continue
+		}
+		if !seen[z.Domain] {
+			seen[z.Domain] = true
+			all = append(all, &z)
+		}
+	}
+	return all
+}
+
+// The innermost zone a name belongs to, nil if it is in none of them
+func zoneOfName(zones []*ZoneConfig, name string) *ZoneConfig {
+	name = strings.ToLower(dns.Fqdn(name))
+	var found *ZoneConfig
+	for _, zone := range zones {
+		if dns.IsSubDomain(zone.Domain, name) &&
+			(found == nil || len(zone.Domain) > len(found.Domain)) {
+			found = zone
+		}
+	}
+	return found
+}
+
+// Whether a hostname in the zone is reserved
+func (z *ZoneConfig) reserved(hostname string) bool {
+	name := strings.TrimSuffix(strings.ToLower(hostname), "."+z.Domain)
+	for _, reserved := range z.Reserved {
+		if name == strings.ToLower(strings.Trim(reserved, ".")) {
+			return true
+		}
+	}
+	return false
+}
+
+// A forward zone of the DNS server
+type dnsZone struct {
+	domain         string
+	defaultTtl     uint32
+	minTtl, maxTtl uint32
+	// Online signer, nil for unsigned zones
+	signer *dnssecSigner
+}
+
+// Setup the zone with the global settings as defaults
+func newDnsZone(zone *ZoneConfig, config *DnsServerConfig) *dnsZone {
+	return &dnsZone{
+		domain:     zone.Domain,
+		defaultTtl: firstTtl(zone.DefaultTtl, config.DefaultTtl, defaultTtl),
+		minTtl:     firstTtl(zone.MinTtl, config.MinTtl, defaultMinTtl),
+		maxTtl:     firstTtl(zone.MaxTtl, config.MaxTtl, defaultMaxTtl),
+	}
+}
+
+// The first TTL that is set
+func firstTtl(ttls ...uint32) uint32 {
+	for _, ttl := range ttls {
+		if ttl != 0 {
+			return ttl
+		}
+	}
+	return 0
+}
+
+// The forward zone a name belongs to, nil if there is none
+func (h *dnsHandler) zone(name string) *dnsZone {
+	name = strings.ToLower(name)
+	var found *dnsZone
+	for _, zone := range h.zones {
+		if dns.IsSubDomain(zone.domain, name) &&
+			(found == nil || len(zone.domain) > len(found.domain)) {
+			found = zone
+		}
+	}
+	return found
+}
+
+// The forward zone with the given name, nil for reverse zones
+func (h *dnsHandler) forwardZone(name string) *dnsZone {
+	if zone := h.zone(name); zone != nil && zone.domain == strings.ToLower(name) {
+		return zone
+	}
+	return nil
+}
+
+// Signer of a zone, nil if the zone is not signed
+func (h *dnsHandler) signer(zone string) *dnssecSigner {
+	if z := h.forwardZone(zone); z != nil {
+		return z.signer
+	}
+	return nil
+}
@@ -0,0 +1,136 @@
+// The CoolDNS Project. The simple dynamic dns server and update service.
+// Copyright (C) 2014 The CoolDNS Authors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.package main
+
+package cooldns
+
+import (
+	"github.com/miekg/dns"
+	"net"
+	"testing"
+)
+
+func TestZoneConfigs(t *testing.T) {
+	zones := zoneConfigs("ist.nicht.cool.", []*ZoneConfig{
+		&ZoneConfig{Domain: "Sehr.Cool", DefaultTtl: 300},
+		&ZoneConfig{Domain: "ist.nicht.cool.", NoCaptcha: true},
+		&ZoneConfig{Domain: "sehr.cool."},
+	})
+	if len(zones) != 2 {
+		t.Fatal("Expected 2 zones, got", zones)
+	}
+	if zones[0].Domain != "ist.nicht.cool." || !zones[0].NoCaptcha {
+		t.Errorf("Settings of the domain were not used: %+v", zones[0])
+	}
+	if zones[1].Domain != "sehr.cool." || zones[1].DefaultTtl != 300 {
+		t.Errorf("Unexpected zone: %+v", zones[1])
+	}
+
+	zones = append(zones, &ZoneConfig{Domain: "unter.sehr.cool."})
+	for name, zone := range map[string]string{
+		"host.ist.nicht.cool":      "ist.nicht.cool.",
+		"host.sehr.cool.":          "sehr.cool.",
+		"host.unter.sehr.cool.":    "unter.sehr.cool.",
+		"host.nicht.sehr.cool.org": "",
+	} {
+		z := zoneOfName(zones, name)
+		if (z == nil && zone != "") || (z != nil && z.Domain != zone) {
+			t.Errorf("Zone of %s: expected %q, got %+v", name, zone, z)
+		}
+	}
+}
+
+func TestZoneReserved(t *testing.T) {
+	zone := &ZoneConfig{Domain: "sehr.cool.", Reserved: []string{"www", "Mail."}}
+	for name, reserved := range map[string]bool{
+		"www.sehr.cool.":     true,
+		"mail.sehr.cool.":    true,
+		"sub.www.sehr.cool.": false,
+		"host.sehr.cool.":    false,
+	} {
+		if zone.reserved(name) != reserved {
+			t.Errorf("%s reserved: expected %t", name, reserved)
+		}
+	}
+}
+
+func TestDnsZones(t *testing.T) {
+	db, err := getTmpDB()
+	if err != nil {
+		t.Fatal("Failed to create temporary DB")
+	}
+	zones := []*ZoneConfig{
+		&ZoneConfig{Domain: "sehr.cool.", DefaultTtl: 300, MaxTtl: 600},
+	}
+	port := startDnsServerConfig(db, &DnsServerConfig{
+		Domain: "ist.nicht.cool.",
+		Zones:  zones,
+	})
+	db.SaveEntry(&Entry{
+		Hostname: "host.ist.nicht.cool.",
+		Ip4s:     []net.IP{net.ParseIP("192.168.0.1")},
+	})
+	db.SaveEntry(&Entry{
+		Hostname: "host.sehr.cool.",
+		Ip4s:     []net.IP{net.ParseIP("192.168.0.2")},
+	})
+	db.SaveEntry(&Entry{
+		Hostname: "long.sehr.cool.",
+		Ip4s:     []net.IP{net.ParseIP("192.168.0.3")},
+		Ttl:      3600,
+	})
+
+	// Every zone uses its own TTL settings
+	for name, ttl := range map[string]uint32{
+		"host.ist.nicht.cool.": defaultTtl,
+		"host.sehr.cool.":      300,
+		"long.sehr.cool.":      600,
+	} {
+		in, err := dnsQuery(port, name, dns.TypeA)
+		if err != nil || len(in.Answer) != 1 || in.Answer[0].Header().Ttl != ttl {
+			t.Errorf("Unexpected answer for %s: %v %v", name, in, err)
+		}
+	}
+	in, err := dnsQuery(port, "sehr.cool.", dns.TypeSOA)
+	if err != nil || len(in.Answer) != 1 || in.Answer[0].Header().Name != "sehr.cool." {
+		t.Error("Unexpected SOA of the zone:", in, err)
+	}
+	in, err = dnsQuery(port, "missing.sehr.cool.", dns.TypeA)
+	if err != nil || in.Rcode != dns.RcodeNameError || len(in.Ns) != 1 ||
+		in.Ns[0].Header().Name != "sehr.cool." {
+		t.Error("Unexpected negative answer:", in, err)
+	}
+	in, err = dnsQuery(port, "host.nicht.sehr.cool.org.", dns.TypeA)
+	if err != nil || in.Rcode != dns.RcodeRefused {
+		t.Error("Query outside the zones was not refused:", in, err)
+	}
+
+	// Transfers only contain the entries of the zone
+	key, _ := NewTsigKey()
+	port = startDnsServerConfig(db, &DnsServerConfig{
+		Domain:  "ist.nicht.cool.",
+		TsigKey: key,
+		Zones:   zones,
+	})
+	m := new(dns.Msg)
+	m.SetAxfr("sehr.cool.")
+	rrs, err := transfer(port, key, m)
+	if err != nil {
+		t.Fatal("AXFR failed:", err)
+	}
+	if countType(rrs, dns.TypeA) != 2 || rrs[0].Header().Name != "sehr.cool." {
+		t.Error("Unexpected AXFR of the zone:", rrs)
+	}
+}
@@ -16,7 +16,11 @@
 
 package main
 
-import "./cooldns"
+import (
+	"./cooldns"
+	"fmt"
+	"os"
+)
 
 func main() {
 	config := cooldns.LoadConfig()
@@ -24,5 +28,40 @@ func main() {
 	if config.Domain == "" {
 		config.SetDomain("ist.nicht.cool.")
 	}
+	if len(os.Args) > 1 {
+		if (len(os.Args) == 3 || len(os.Args) == 4) && os.Args[1] == "rollover" {
+			zone := ""
+			if len(os.Args) == 4 {
+				zone = os.Args[3]
+			}
+			cooldns.Rollover(config, os.Args[2], zone)
+			return
+		}
+		if (len(os.Args) == 2 || len(os.Args) == 3) && os.Args[1] == "export" {
+			zone := ""
+			if len(os.Args) == 3 {
+				zone = os.Args[2]
+			}
+			cooldns.ExportZone(config, zone)
+			return
+		}
+		if len(os.Args) >= 3 && os.Args[1] == "import" {
+			args := os.Args[2:]
+			dryRun := args[0] == "-n"
+			if dryRun {
+				args = args[1:]
+			}
+			if len(args) == 1 || len(args) == 2 {
+				zone := ""
+				if len(args) == 2 {
+					zone = args[1]
+				}
+				cooldns.ImportZone(config, args[0], zone, dryRun)
+				return
+			}
+		}
+		fmt.Fprintln(os.Stderr, "usage: cooldns [rollover zsk|ksk|ksk-finish [zone] | export [zone] | import [-n] <file> [zone]]")
+		os.Exit(2)
+	}
 	cooldns.Run(config)
 }